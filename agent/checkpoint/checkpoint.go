@@ -0,0 +1,171 @@
+package checkpoint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+const (
+	DefaultDir      = "/opt/LogCrunch/agent/state"
+	DefaultInterval = 5 * time.Second
+)
+
+// State records how far into a file the agent has read. Dev and Inode
+// identify the exact file, so a rotated replacement is never mistaken
+// for the file the offset belongs to.
+type State struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Dev    uint64 `json:"dev"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Store keeps one small state file per tailed file in a directory
+type Store struct {
+	dir      string
+	interval time.Duration
+}
+
+// Open creates the state directory if needed, applying defaults for anything left blank
+func Open(cfg structs.CheckpointConfig) (*Store, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultDir
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+	return &Store{dir: cfg.Dir, interval: cfg.Interval}, nil
+}
+
+// Interval is how often readers should flush their checkpoints
+func (s *Store) Interval() time.Duration {
+	return s.interval
+}
+
+// key maps a target name + file path to a state file name
+func (s *Store) key(name, path string) string {
+	sum := sha256.Sum256([]byte(name + "\x00" + path))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:12])+".json")
+}
+
+// Load returns the saved state for a file, and false if it has never been seen
+func (s *Store) Load(name, path string) (State, bool, error) {
+	var st State
+	if err := s.read(s.key(name, path), &st); err != nil {
+		if os.IsNotExist(err) {
+			return State{}, false, nil
+		}
+		return State{}, false, err
+	}
+	return st, true, nil
+}
+
+// Find returns the saved state of a file by its device and inode, for a file
+// that was renamed since it was checkpointed, and false if there is none
+func (s *Store) Find(name string, dev, inode uint64) (State, bool, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return State{}, false, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		var st State
+		if err := s.read(filepath.Join(s.dir, e.Name()), &st); err != nil {
+			continue // Load reports corrupt checkpoints for the files they belong to
+		}
+		// cursors are stored alongside, with no path or inode
+		if st.Name == name && st.Path != "" && st.Inode != 0 && st.Dev == dev && st.Inode == inode {
+			return st, true, nil
+		}
+	}
+	return State{}, false, nil
+}
+
+// Save durably records the state for a file
+func (s *Store) Save(st State) error {
+	return s.write(s.key(st.Name, st.Path), st)
+}
+
+// Delete forgets the state for a file, for files that are gone for good
+func (s *Store) Delete(name, path string) error {
+	if err := os.Remove(s.key(name, path)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete checkpoint: %w", err)
+	}
+	return nil
+}
+
+// read decodes a JSON state file
+func (s *Store) read(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("corrupt checkpoint %s: %w", path, err)
+	}
+	return nil
+}
+
+// write replaces a state file atomically: write a temp file, fsync it, then rename over the old one
+func (s *Store) write(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync checkpoint: %w", err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace checkpoint: %w", err)
+	}
+	return nil
+}
+
+// cursorState is the on-disk form of an opaque resume cursor, such as a journal cursor
+type cursorState struct {
+	Name   string `json:"name"`
+	Cursor string `json:"cursor"`
+}
+
+// LoadCursor returns a saved cursor, and false if none has been saved yet
+func (s *Store) LoadCursor(name string) (string, bool, error) {
+	var st cursorState
+	if err := s.read(s.key(name, ""), &st); err != nil {
+		if os.IsNotExist(err) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return st.Cursor, true, nil
+}
+
+// SaveCursor durably records a cursor under name
+func (s *Store) SaveCursor(name, cursor string) error {
+	return s.write(s.key(name, ""), cursorState{Name: name, Cursor: cursor})
+}
@@ -0,0 +1,155 @@
+package checkpoint
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+func openStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(structs.CheckpointConfig{Dir: filepath.Join(t.TempDir(), "state")})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return s
+}
+
+func TestOpenAppliesDefaults(t *testing.T) {
+	s := openStore(t)
+	if s.Interval() != DefaultInterval {
+		t.Errorf("Interval = %v, want %v", s.Interval(), DefaultInterval)
+	}
+	if _, err := os.Stat(s.dir); err != nil {
+		t.Errorf("state directory not created: %v", err)
+	}
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	s := openStore(t)
+	want := State{Name: "Auth", Path: "/var/log/auth.log", Dev: 2049, Inode: 1234, Offset: 5678}
+	if err := s.Save(want); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// a reopened store reads what the last one saved
+	reopened, err := Open(structs.CheckpointConfig{Dir: s.dir, Interval: time.Second})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	got, seen, err := reopened.Load("Auth", "/var/log/auth.log")
+	if err != nil || !seen {
+		t.Fatalf("Load = %v, %v, want a saved state", seen, err)
+	}
+	if got != want {
+		t.Errorf("Load = %+v, want %+v", got, want)
+	}
+
+	// saving replaces the file without leaving the temp file behind
+	want.Offset = 9000
+	if err := s.Save(want); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if got, _, _ := s.Load("Auth", "/var/log/auth.log"); got.Offset != 9000 {
+		t.Errorf("Offset = %d after second save, want 9000", got.Offset)
+	}
+	entries, _ := os.ReadDir(s.dir)
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Errorf("temp file %s left behind", e.Name())
+		}
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d state files, want 1", len(entries))
+	}
+}
+
+func TestLoadUnseenAndCorrupt(t *testing.T) {
+	s := openStore(t)
+	if _, seen, err := s.Load("Auth", "/var/log/auth.log"); seen || err != nil {
+		t.Errorf("Load of unseen file = %v, %v, want false, nil", seen, err)
+	}
+
+	if err := os.WriteFile(s.key("Auth", "/var/log/auth.log"), []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Load("Auth", "/var/log/auth.log"); err == nil {
+		t.Error("Expected an error for a corrupt checkpoint")
+	}
+}
+
+func TestStatesAreKeyedByNameAndPath(t *testing.T) {
+	s := openStore(t)
+	states := []State{
+		{Name: "Auth", Path: "/var/log/auth.log", Offset: 1},
+		{Name: "Auth", Path: "/var/log/auth.log.1", Offset: 2},
+		{Name: "Other", Path: "/var/log/auth.log", Offset: 3},
+	}
+	for _, st := range states {
+		if err := s.Save(st); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+	for _, want := range states {
+		got, seen, err := s.Load(want.Name, want.Path)
+		if err != nil || !seen || got.Offset != want.Offset {
+			t.Errorf("Load(%s, %s) = %+v, %v, %v, want offset %d", want.Name, want.Path, got, seen, err, want.Offset)
+		}
+	}
+
+	if err := s.Delete("Auth", "/var/log/auth.log"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, seen, _ := s.Load("Auth", "/var/log/auth.log"); seen {
+		t.Error("Deleted state still loads")
+	}
+	if _, seen, _ := s.Load("Other", "/var/log/auth.log"); !seen {
+		t.Error("Delete removed another target's state")
+	}
+	if err := s.Delete("Auth", "/var/log/auth.log"); err != nil {
+		t.Errorf("Deleting a missing state failed: %v", err)
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	s := openStore(t)
+	if _, seen, err := s.LoadCursor("journal"); seen || err != nil {
+		t.Errorf("LoadCursor before save = %v, %v, want false, nil", seen, err)
+	}
+	if err := s.SaveCursor("journal", "s=abc;i=1"); err != nil {
+		t.Fatalf("SaveCursor failed: %v", err)
+	}
+	got, seen, err := s.LoadCursor("journal")
+	if err != nil || !seen || got != "s=abc;i=1" {
+		t.Errorf("LoadCursor = %q, %v, %v, want s=abc;i=1", got, seen, err)
+	}
+	// a cursor doesn't collide with a file state of the same name
+	if _, seen, _ := s.Load("journal", "/var/log/journal"); seen {
+		t.Error("Cursor loaded as a file state")
+	}
+}
+
+func TestFindRenamedFile(t *testing.T) {
+	s := openStore(t)
+	if err := s.SaveCursor("systemd-journal", "s=abc"); err != nil {
+		t.Fatal(err)
+	}
+	want := State{Name: "App", Path: "/var/log/app.log", Dev: 1, Inode: 42, Offset: 10}
+	for _, st := range []State{want, {Name: "Other", Path: "/var/log/app.log", Dev: 1, Inode: 42, Offset: 99}} {
+		if err := s.Save(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, ok, err := s.Find("App", 1, 42)
+	if err != nil || !ok || got != want {
+		t.Errorf("Find = %+v, %v, %v; want %+v", got, ok, err, want)
+	}
+	if _, ok, _ := s.Find("App", 1, 43); ok {
+		t.Error("Find matched a different inode")
+	}
+}
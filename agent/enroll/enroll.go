@@ -0,0 +1,132 @@
+// Package enroll gets the agent a client certificate from the server,
+// in exchange for a one-time token created in the web UI.
+package enroll
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+const (
+	DefaultDir = "/opt/LogCrunch/agent/tls"
+
+	requestTimeout = 30 * time.Second
+)
+
+// Files are where an enrolled agent's credentials were written. They are
+// ready to go into the TLS section of the config as is.
+type Files struct {
+	structs.TLSConfig
+	CAFingerprint string // SHA-256 of the CA, as checked against the expected one
+}
+
+// Enroll generates a key, has the server at serverURL sign it as name, and
+// writes the key, certificate and CA into dir. caFingerprint is the SHA-256
+// of the CA shown on the enrollment page; the server's answer is only
+// trusted, and anything written, if the CA it sent matches.
+func Enroll(serverURL, token, caFingerprint, name, dir string) (Files, error) {
+	want := normalizeFingerprint(caFingerprint)
+	if len(want) != sha256.Size*2 {
+		return Files{}, errors.New("expected CA fingerprint must be a SHA-256 in hex")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Files{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name},
+	}, key)
+	if err != nil {
+		return Files{}, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	resp, err := request(serverURL, protocol.EnrollRequest{
+		Token: token,
+		Name:  name,
+		CSR:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		return Files{}, err
+	}
+	caBlock, _ := pem.Decode([]byte(resp.CA))
+	if caBlock == nil {
+		return Files{}, errors.New("server sent an invalid CA certificate")
+	}
+	sum := sha256.Sum256(caBlock.Bytes)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return Files{}, fmt.Errorf("server sent a CA with fingerprint %s, not the expected %s; nothing was written", got, want)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return Files{}, fmt.Errorf("failed to encode key: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return Files{}, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	files := Files{TLSConfig: structs.TLSConfig{
+		CABundle: filepath.Join(dir, "ca.crt"),
+		Cert:     filepath.Join(dir, "agent.crt"),
+		Key:      filepath.Join(dir, "agent.key"),
+	}}
+	files.CAFingerprint = want
+
+	if err := os.WriteFile(files.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return Files{}, fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := os.WriteFile(files.Cert, []byte(resp.Certificate), 0o644); err != nil {
+		return Files{}, fmt.Errorf("failed to write certificate: %w", err)
+	}
+	if err := os.WriteFile(files.CABundle, []byte(resp.CA), 0o644); err != nil {
+		return Files{}, fmt.Errorf("failed to write CA: %w", err)
+	}
+	return files, nil
+}
+
+// normalizeFingerprint accepts fingerprints as the enrollment page shows them,
+// or as openssl prints them (upper case, colon separated)
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+// request posts an enrollment request to the server's web UI
+func request(serverURL string, req protocol.EnrollRequest) (protocol.EnrollResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return protocol.EnrollResponse{}, err
+	}
+	client := &http.Client{Timeout: requestTimeout}
+	httpResp, err := client.Post(strings.TrimSuffix(serverURL, "/")+protocol.EnrollPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return protocol.EnrollResponse{}, fmt.Errorf("error contacting server: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	var resp protocol.EnrollResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return protocol.EnrollResponse{}, fmt.Errorf("unexpected response from server (%s): %w", httpResp.Status, err)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return protocol.EnrollResponse{}, fmt.Errorf("server refused enrollment: %s", resp.Error)
+	}
+	return resp, nil
+}
@@ -0,0 +1,75 @@
+package enroll
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TLop503/LogCrunch/protocol"
+)
+
+// fakeServer answers enrollment requests with caDER as the CA
+func fakeServer(t *testing.T, caDER []byte) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req protocol.EnrollRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token != "tok" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(protocol.EnrollResponse{Error: "bad token"})
+			return
+		}
+		json.NewEncoder(w).Encode(protocol.EnrollResponse{
+			Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("signed")})),
+			CA:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestEnrollChecksCAFingerprint(t *testing.T) {
+	caDER := []byte("the real CA")
+	sum := sha256.Sum256(caDER)
+	fingerprint := hex.EncodeToString(sum[:])
+	srv := fakeServer(t, caDER)
+
+	dir := filepath.Join(t.TempDir(), "tls")
+	other := sha256.Sum256([]byte("another CA"))
+	if _, err := Enroll(srv.URL, "tok", hex.EncodeToString(other[:]), "host", dir); err == nil {
+		t.Fatal("Expected enrolling against the wrong CA to fail")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("Files were written for a CA that didn't match: %v", err)
+	}
+
+	// openssl's upper case, colon separated form is accepted too
+	var colons []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		colons = append(colons, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	files, err := Enroll(srv.URL, "tok", strings.Join(colons, ":"), "host", dir)
+	if err != nil {
+		t.Fatalf("Enroll failed: %v", err)
+	}
+	if files.CAFingerprint != fingerprint {
+		t.Errorf("CAFingerprint = %s, want %s", files.CAFingerprint, fingerprint)
+	}
+	for _, name := range []string{files.CABundle, files.Cert, files.Key} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%s not written: %v", name, err)
+		}
+	}
+}
+
+func TestEnrollRejectsBadFingerprintArgument(t *testing.T) {
+	if _, err := Enroll("http://127.0.0.1:1", "tok", "abc", "host", t.TempDir()); err == nil {
+		t.Error("Expected a fingerprint that isn't a SHA-256 to be refused before contacting the server")
+	}
+}
@@ -0,0 +1,153 @@
+package filter
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// rule actions
+const (
+	Drop = "drop"
+	Keep = "keep"
+)
+
+// rule is a compiled structs.FilterRule
+type rule struct {
+	keep        bool
+	raw         *regexp.Regexp
+	fields      map[string]*regexp.Regexp
+	minSeverity structs.Severity
+	maxSeverity structs.Severity
+}
+
+// Set is an ordered list of rules. The first rule that matches a log decides
+// whether it is kept or dropped; logs no rule matches are kept.
+type Set struct {
+	rules []rule
+}
+
+// Compile checks and compiles rules. It returns nil (which keeps everything)
+// when there are no rules.
+func Compile(rules []structs.FilterRule) (*Set, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	s := &Set{}
+	for i, r := range rules {
+		var c rule
+		switch strings.ToLower(r.Action) {
+		case Drop:
+		case Keep:
+			c.keep = true
+		default:
+			return nil, fmt.Errorf("filter %d: unknown action %q, expected drop or keep", i+1, r.Action)
+		}
+
+		if r.Raw != "" {
+			re, err := regexp.Compile(r.Raw)
+			if err != nil {
+				return nil, fmt.Errorf("filter %d: invalid raw regex: %w", i+1, err)
+			}
+			c.raw = re
+		}
+
+		if len(r.Fields) > 0 {
+			c.fields = make(map[string]*regexp.Regexp, len(r.Fields))
+			for field, pattern := range r.Fields {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("filter %d: invalid regex for field %s: %w", i+1, field, err)
+				}
+				c.fields[field] = re
+			}
+		}
+
+		var err error
+		if c.minSeverity, err = structs.ParseSeverity(r.MinSeverity); err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i+1, err)
+		}
+		if c.maxSeverity, err = structs.ParseSeverity(r.MaxSeverity); err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i+1, err)
+		}
+
+		s.rules = append(s.rules, c)
+	}
+	return s, nil
+}
+
+// Keep reports whether a log should be sent
+func (s *Set) Keep(l structs.Log) bool {
+	if s == nil {
+		return true
+	}
+	for _, r := range s.rules {
+		if r.matches(l) {
+			return r.keep
+		}
+	}
+	return true
+}
+
+// matches reports whether every condition of the rule holds for l.
+// A rule without conditions matches everything.
+func (r rule) matches(l structs.Log) bool {
+	if r.raw != nil && !r.raw.MatchString(l.Raw) {
+		return false
+	}
+	if r.minSeverity != structs.SeverityUnknown && l.Severity < r.minSeverity {
+		return false
+	}
+	if r.maxSeverity != structs.SeverityUnknown && l.Severity > r.maxSeverity {
+		return false
+	}
+	for field, re := range r.fields {
+		value, ok := fieldValue(l.Parsed, field)
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldValue looks up a parsed field as a string. Parsed logs are usually
+// maps from MetaParse; structs (like journal entries) are matched on their
+// logfield tag or field name, ignoring case.
+func fieldValue(parsed interface{}, name string) (string, bool) {
+	switch p := parsed.(type) {
+	case nil:
+		return "", false
+	case map[string]interface{}:
+		v, ok := p[name]
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprint(v), true
+	}
+
+	v := reflect.ValueOf(parsed)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return "", false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if strings.EqualFold(f.Tag.Get("logfield"), name) || strings.EqualFold(f.Name, name) {
+			return fmt.Sprint(v.Field(i).Interface()), true
+		}
+	}
+	return "", false
+}
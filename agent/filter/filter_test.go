@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+func compile(t *testing.T, rules ...structs.FilterRule) *Set {
+	t.Helper()
+	s, err := Compile(rules)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	return s
+}
+
+func TestNoRulesKeepsEverything(t *testing.T) {
+	s := compile(t)
+	if !s.Keep(structs.Log{Raw: "anything"}) {
+		t.Error("Expected a nil set to keep every log")
+	}
+}
+
+func TestDropByRawRegex(t *testing.T) {
+	s := compile(t, structs.FilterRule{Action: "drop", Raw: `CRON\[\d+\]`})
+
+	if s.Keep(structs.Log{Raw: "Oct 1 00:00:01 host CRON[123]: (root) CMD (run-parts)"}) {
+		t.Error("Expected cron line to be dropped")
+	}
+	if !s.Keep(structs.Log{Raw: "Oct 1 00:00:01 host sshd[42]: Failed password"}) {
+		t.Error("Expected sshd line to be kept")
+	}
+}
+
+func TestFieldsMatchMapsAndStructs(t *testing.T) {
+	s := compile(t, structs.FilterRule{Action: "drop", Fields: map[string]string{"process": "^systemd-logind$"}})
+
+	if s.Keep(structs.Log{Parsed: map[string]interface{}{"process": "systemd-logind"}}) {
+		t.Error("Expected logind line to be dropped")
+	}
+	if !s.Keep(structs.Log{Parsed: map[string]interface{}{"message": "no process field"}}) {
+		t.Error("Expected log without the field to be kept")
+	}
+
+	journal := compile(t, structs.FilterRule{Action: "drop", Fields: map[string]string{"message": "^Started Session"}})
+	entry := structs.SyslogPrettyEntry{Message: "Started Session 4 of user root.", Priority: 6}
+	if journal.Keep(structs.Log{Parsed: entry}) {
+		t.Error("Expected journal entry to be matched by its logfield tag")
+	}
+}
+
+func TestKeepThenDropEverythingElse(t *testing.T) {
+	s := compile(t,
+		structs.FilterRule{Action: "keep", MinSeverity: "warning"},
+		structs.FilterRule{Action: "drop"},
+	)
+
+	if !s.Keep(structs.Log{Severity: structs.SeverityError}) {
+		t.Error("Expected error log to be kept")
+	}
+	if s.Keep(structs.Log{Severity: structs.SeverityInfo}) {
+		t.Error("Expected info log to be dropped")
+	}
+}
+
+func TestMaxSeverity(t *testing.T) {
+	s := compile(t, structs.FilterRule{Action: "drop", MaxSeverity: "info", Raw: "session"})
+
+	if s.Keep(structs.Log{Raw: "session opened", Severity: structs.SeverityDebug}) {
+		t.Error("Expected debug session line to be dropped")
+	}
+	if !s.Keep(structs.Log{Raw: "session opened", Severity: structs.SeverityWarning}) {
+		t.Error("Expected warning session line to be kept")
+	}
+}
+
+func TestCompileRejectsBadRules(t *testing.T) {
+	bad := []structs.FilterRule{
+		{Action: "maybe"},
+		{Action: "drop", Raw: "("},
+		{Action: "drop", Fields: map[string]string{"x": "["}},
+		{Action: "keep", MinSeverity: "loud"},
+	}
+	for _, r := range bad {
+		if _, err := Compile([]structs.FilterRule{r}); err == nil {
+			t.Errorf("Expected an error for %+v", r)
+		}
+	}
+}
@@ -1,33 +1,128 @@
 package heartbeat
 
 import (
+	"context"
+	"log"
 	"strconv"
 	"time"
 
+	"github.com/TLop503/LogCrunch/agent/identity"
+	"github.com/TLop503/LogCrunch/agent/stats"
+	"github.com/TLop503/LogCrunch/protocol"
 	"github.com/TLop503/LogCrunch/structs"
 )
 
-// Heartbeat creates and transmits an "I'm alive" log every minute
-func Heartbeat(logChan chan<- structs.Log, hostname string) {
-	seq := 0
-	for {
-		// Create raw JSON as a map
-		seqAsJSON := map[string]int{"seq": seq}
+// Sources are where a heartbeat's numbers come from besides the stats package
+type Sources struct {
+	Spool      interface{ Stats() (int, int64, uint64) }
+	ConfigHash func() string
+	// Config reports the profile the agent runs and why it rejected the last one
+	Config func() (version, err string)
+	// Now sends a heartbeat early, so the server hears of a config change right away
+	Now <-chan struct{}
+}
+
+// reporter builds heartbeats, remembering the CPU time used as of the last one
+type reporter struct {
+	src     Sources
+	started time.Time
+	lastCPU time.Duration
+	lastAt  time.Time // zero before the first report, which has no CPU figure
+}
+
+// report describes the agent's health as of now
+func (r *reporter) report(seq int64) protocol.Heartbeat {
+	now := time.Now()
+	hb := protocol.Heartbeat{
+		Seq:     seq,
+		Version: identity.Version,
+		Uptime:  int64(now.Sub(r.started).Seconds()),
+	}
+
+	rss, cpu, err := stats.Process()
+	if err != nil {
+		log.Printf("Error reading process stats: %v", err)
+	}
+	hb.RSS = rss
+	if elapsed := now.Sub(r.lastAt); !r.lastAt.IsZero() && elapsed > 0 {
+		hb.CPU = 100 * float64(cpu-r.lastCPU) / float64(elapsed)
+	}
+	r.lastCPU, r.lastAt = cpu, now
+
+	if r.src.Spool != nil {
+		hb.QueueDepth, hb.SpoolBytes, hb.SpoolDropped = r.src.Spool.Stats()
+	}
+	if r.src.ConfigHash != nil {
+		hb.ConfigHash = r.src.ConfigHash()
+	}
+	if r.src.Config != nil {
+		hb.ConfigVersion, hb.ConfigError = r.src.Config()
+	}
 
+	read, parsed, failed := stats.Read.Snapshot(), stats.Parsed.Snapshot(), stats.Failed.Snapshot()
+	hb.Filtered = stats.Filtered.Snapshot()
+	errs := stats.Errors.Snapshot()
+	hb.Targets = make(map[string]protocol.TargetStats)
+	target := func(name string) protocol.TargetStats {
+		return protocol.TargetStats{
+			Read:          read[name],
+			Parsed:        parsed[name],
+			Failed:        failed[name],
+			Dropped:       hb.Filtered[name],
+			LastError:     errs[name].Message,
+			LastErrorTime: errs[name].Time,
+		}
+	}
+	for _, names := range []map[string]uint64{read, hb.Filtered} {
+		for name := range names {
+			hb.Targets[name] = target(name)
+		}
+	}
+	for name := range errs {
+		hb.Targets[name] = target(name)
+	}
+
+	raw, wire := stats.Transport.Raw.Load(), stats.Transport.Wire.Load()
+	hb.Transport = protocol.TransportStats{
+		Compression: stats.Transport.Codec(),
+		RawBytes:    raw,
+		WireBytes:   wire,
+		Ratio:       protocol.Ratio(raw, wire),
+	}
+	return hb
+}
+
+// Heartbeat creates and transmits an "I'm alive" log every minute until ctx is done.
+// Each one reports the agent's resource use, spool, and per-target counters.
+func Heartbeat(ctx context.Context, logChan chan<- structs.Log, hostname string, src Sources) {
+	r := &reporter{src: src, started: time.Now()}
+	var seq int64
+	for {
 		// Create the log struct
+		now := time.Now().Unix()
 		hb := structs.Log{
-			Host:      hostname,
-			Timestamp: time.Now().Unix(),
-			Module:    "Heartbeat",
-			Path:      "self",
-			Parsed:    seqAsJSON,
-			Raw:       strconv.Itoa(seq),
+			Host:       hostname,
+			Timestamp:  now,
+			IngestTime: now,
+			Module:     protocol.HeartbeatModule,
+			Path:       "self",
+			Parsed:     r.report(seq),
+			Raw:        strconv.FormatInt(seq, 10),
 		}
 
 		// Send the structured log over the channel
-		logChan <- hb
+		select {
+		case logChan <- hb:
+		case <-ctx.Done():
+			return
+		}
 
-		time.Sleep(60 * time.Second)
+		select {
+		case <-time.After(60 * time.Second):
+		case <-src.Now:
+		case <-ctx.Done():
+			return
+		}
 		seq++
 	}
 }
@@ -0,0 +1,79 @@
+package heartbeat
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/stats"
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+type fakeSpool struct{}
+
+func (fakeSpool) Stats() (int, int64, uint64) { return 12, 4096, 3 }
+
+func TestReportCountsPerTarget(t *testing.T) {
+	stats.Read.Add("hb-auth", 10)
+	stats.Parsed.Add("hb-auth", 8)
+	stats.Failed.Add("hb-auth", 2)
+	stats.Filtered.Add("hb-auth", 1)
+	stats.Filtered.Add("hb-sshd", 5)
+	stats.Errors.Set("hb-nginx", errors.New("permission denied"))
+
+	r := &reporter{
+		src:     Sources{Spool: fakeSpool{}, ConfigHash: func() string { return "abc123" }},
+		started: time.Now().Add(-time.Hour),
+		lastAt:  time.Now().Add(-time.Minute),
+	}
+	hb := r.report(4)
+
+	if hb.Seq != 4 || hb.Uptime < 3599 || hb.ConfigHash != "abc123" {
+		t.Errorf("Unexpected heartbeat: %+v", hb)
+	}
+	if hb.QueueDepth != 12 || hb.SpoolBytes != 4096 || hb.SpoolDropped != 3 {
+		t.Errorf("Expected the spool's stats, got %d/%d/%d", hb.QueueDepth, hb.SpoolBytes, hb.SpoolDropped)
+	}
+	if hb.RSS <= 0 {
+		t.Errorf("Expected a resident set size, got %d", hb.RSS)
+	}
+
+	auth := hb.Targets["hb-auth"]
+	if auth.Read != 10 || auth.Parsed != 8 || auth.Failed != 2 || auth.Dropped != 1 {
+		t.Errorf("Unexpected counts for hb-auth: %+v", auth)
+	}
+	if hb.Targets["hb-sshd"].Dropped != 5 {
+		t.Errorf("Expected a target that only dropped logs to be reported, got %+v", hb.Targets["hb-sshd"])
+	}
+	if nginx := hb.Targets["hb-nginx"]; nginx.LastError != "permission denied" || nginx.LastErrorTime == 0 {
+		t.Errorf("Expected hb-nginx's last error, got %+v", nginx)
+	}
+}
+
+func TestHeartbeatSendsEarlyOnConfigChange(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logs := make(chan structs.Log)
+	now := make(chan struct{}, 1)
+	version := "web@1"
+	go Heartbeat(ctx, logs, "host", Sources{
+		Spool:      fakeSpool{},
+		ConfigHash: func() string { return "" },
+		Config:     func() (string, string) { return version, "" },
+		Now:        now,
+	})
+
+	<-logs
+	version = "web@2"
+	now <- struct{}{}
+	select {
+	case hb := <-logs:
+		if got := hb.Parsed.(protocol.Heartbeat).ConfigVersion; got != "web@2" {
+			t.Errorf("ConfigVersion = %q, want web@2", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat after the config changed")
+	}
+}
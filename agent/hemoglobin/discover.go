@@ -0,0 +1,201 @@
+package hemoglobin
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often glob and directory targets are re-expanded to find new files.
+// A variable so tests don't have to wait it out.
+var discoveryInterval = 10 * time.Second
+
+var (
+	// compressed files can't be tailed as text
+	compressedName = regexp.MustCompile(`\.(gz|bz2|xz|zst|lz4|zip|Z)$`)
+	// names logrotate gives rotated files: app.log.1, app.log-20260102
+	rotatedName = regexp.MustCompile(`(\.\d+|-\d{8,10})$`)
+)
+
+// skipped reports whether a discovered file is a compressed or, unless
+// includeRotated, rotated copy of a log, rather than a log being written
+func skipped(file string, includeRotated bool) bool {
+	base := filepath.Base(file)
+	if compressedName.MatchString(base) {
+		return true
+	}
+	return !includeRotated && rotatedName.MatchString(base)
+}
+
+// isPattern reports whether a target path contains glob syntax
+func isPattern(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// targetPattern turns a target path into a glob. Directories mean every file
+// directly inside them; literal file paths are returned as-is.
+func targetPattern(p string) string {
+	if isPattern(p) {
+		return p
+	}
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		return filepath.Join(p, "*")
+	}
+	return p
+}
+
+// matchGlob matches a slash-separated path against a pattern where "**"
+// stands for any number of directories (including none) and every other
+// segment uses path.Match syntax
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(pat[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// excluded reports whether a file matches any exclude pattern.
+// Patterns without a slash are matched against the file name only.
+func excluded(file string, excludes []string) bool {
+	for _, ex := range excludes {
+		if !strings.Contains(ex, "/") {
+			if ok, _ := path.Match(ex, filepath.Base(file)); ok {
+				return true
+			}
+			continue
+		}
+		if matchGlob(ex, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandGlob returns every regular file matching pattern that isn't excluded,
+// compressed, or rotated when includeRotated is false
+func expandGlob(pattern string, excludes []string, includeRotated bool) ([]string, error) {
+	var matches []string
+
+	if !strings.Contains(pattern, "**") {
+		found, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matches = found
+	} else {
+		// walk from the deepest directory that has no wildcards in it
+		segs := strings.Split(pattern, "/")
+		root := "/"
+		for i, seg := range segs {
+			if isPattern(seg) {
+				root = strings.Join(segs[:i], "/")
+				break
+			}
+		}
+		if root == "" {
+			root = "/"
+		}
+
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// unreadable directories are skipped, not fatal
+				return nil
+			}
+			if !d.IsDir() && matchGlob(pattern, p) {
+				matches = append(matches, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files := matches[:0]
+	for _, m := range matches {
+		if excluded(m, excludes) || skipped(m, includeRotated) {
+			continue
+		}
+		if fi, err := os.Stat(m); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, m)
+	}
+	return files, nil
+}
+
+// discover keeps expanding pattern and starts a tailer for every new file.
+// A tailer exits on its own once its file is deleted, and is started again
+// if the file comes back. A tailer also exits when its file is still being
+// read under the name it was renamed from, and is retried on the next pass.
+// Discovery stops when ctx is done; tailers are expected to watch the same
+// ctx, and discover waits for them to exit.
+func discover(ctx context.Context, pattern string, excludes []string, includeRotated bool, start func(file string, done func())) {
+	type finished struct{ file string }
+	active := make(map[string]bool)
+	done := make(chan finished, 16)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		files, err := expandGlob(pattern, excludes, includeRotated)
+		if err != nil {
+			log.Printf("Error expanding %s: %v", pattern, err)
+		}
+		for _, file := range files {
+			if active[file] {
+				continue
+			}
+			log.Printf("Discovered %s for %s", file, pattern)
+			active[file] = true
+			wg.Add(1)
+			go start(file, func() {
+				defer wg.Done()
+				select {
+				case done <- finished{file}:
+				case <-ctx.Done():
+				}
+			})
+		}
+
+		timeout := time.After(discoveryInterval)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case f := <-done:
+				delete(active, f.file)
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package hemoglobin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"/var/log/nginx/*.access.log", "/var/log/nginx/site.access.log", true},
+		{"/var/log/nginx/*.access.log", "/var/log/nginx/site.error.log", false},
+		{"/var/log/**/*.log", "/var/log/app.log", true},
+		{"/var/log/**/*.log", "/var/log/containers/a/b/c.log", true},
+		{"/var/log/**/*.log", "/var/log/containers/a/b/c.log.1", false},
+		{"/var/log/**", "/var/log/a/b", true},
+		{"/var/lib/**/*.log", "/var/log/app.log", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{
+		"a.log",
+		"b.log",
+		"b.log.gz",
+		"nested/c.log",
+		"nested/deeper/d.log",
+		"nested/deeper/skip.log",
+	} {
+		p := filepath.Join(dir, f)
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		os.WriteFile(p, []byte("x\n"), 0o644)
+	}
+
+	t.Run("single level", func(t *testing.T) {
+		got, err := expandGlob(filepath.Join(dir, "*.log"), nil, false)
+		if err != nil {
+			t.Fatalf("expandGlob failed: %v", err)
+		}
+		want := []string{filepath.Join(dir, "a.log"), filepath.Join(dir, "b.log")}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("recursive with excludes", func(t *testing.T) {
+		got, err := expandGlob(filepath.Join(dir, "**", "*.log"), []string{"skip.*", filepath.Join(dir, "b.*")}, false)
+		if err != nil {
+			t.Fatalf("expandGlob failed: %v", err)
+		}
+		sort.Strings(got)
+		want := []string{
+			filepath.Join(dir, "a.log"),
+			filepath.Join(dir, "nested", "c.log"),
+			filepath.Join(dir, "nested", "deeper", "d.log"),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("directory target", func(t *testing.T) {
+		pattern := targetPattern(filepath.Join(dir, "nested"))
+		got, err := expandGlob(pattern, nil, false)
+		if err != nil {
+			t.Fatalf("expandGlob failed: %v", err)
+		}
+		want := []string{filepath.Join(dir, "nested", "c.log")}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	})
+}
+
+func TestSkippedNames(t *testing.T) {
+	tests := []struct {
+		name           string
+		includeRotated bool
+		want           bool
+	}{
+		{"app.log", false, false},
+		{"app.log.1", false, true},
+		{"app.log.1", true, false},
+		{"app.log-20260102", false, true},
+		{"app.log.2.gz", true, true},
+		{"app.log-20260102.zst", true, true},
+		{"v1.2.log", false, false},
+	}
+	for _, tt := range tests {
+		if got := skipped(filepath.Join("/var/log", tt.name), tt.includeRotated); got != tt.want {
+			t.Errorf("skipped(%q, %v) = %v, want %v", tt.name, tt.includeRotated, got, tt.want)
+		}
+	}
+}
+
+func TestDiscoverDoesNotResendRenamedFile(t *testing.T) {
+	defer func(d time.Duration) { discoveryInterval = d }(discoveryInterval)
+	discoveryInterval = 20 * time.Millisecond
+
+	for _, includeRotated := range []bool{false, true} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "a.log")
+		appendLines(t, path, "one", "two")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		logChan := make(chan structs.Log, 16)
+		target := structs.Target{Name: "Renamed", Path: dir, ServerParse: true, Module: "syslog", IncludeRotated: includeRotated}
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			ReadLog(ctx, logChan, target, openStore(t))
+		}()
+
+		seen := make(map[string]int)
+		receive := func(n int) {
+			t.Helper()
+			for i := 0; i < n; i++ {
+				select {
+				case l := <-logChan:
+					seen[l.Raw]++
+				case <-time.After(3 * time.Second):
+					t.Fatalf("include_rotated %v: timed out, got %v", includeRotated, seen)
+				}
+			}
+		}
+		receive(2)
+
+		// logrotate: move the file aside, the writer finishes with it, then a new file starts
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatal(err)
+		}
+		appendLines(t, path+".1", "three")
+		appendLines(t, path, "four")
+		receive(2)
+
+		// give discovery plenty of passes to pick a.log.1 up again
+		time.Sleep(20 * discoveryInterval)
+		cancel()
+		<-stopped
+		close(logChan)
+		for l := range logChan {
+			seen[l.Raw]++
+		}
+
+		want := map[string]int{"one": 1, "two": 1, "three": 1, "four": 1}
+		if !reflect.DeepEqual(seen, want) {
+			t.Errorf("include_rotated %v: lines sent %v, want each once", includeRotated, seen)
+		}
+	}
+}
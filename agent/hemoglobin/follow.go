@@ -0,0 +1,387 @@
+package hemoglobin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+)
+
+// how often to look for new data once we've caught up with a file
+const pollInterval = 250 * time.Millisecond
+
+// follower reads complete lines from a file and keeps following it across
+// rotation (the path now points at a different inode) and truncation
+// (copytruncate leaves the inode but shrinks the file under us).
+type follower struct {
+	name   string
+	path   string
+	store  *checkpoint.Store
+	file   *os.File
+	reader *bufio.Reader
+
+	dev       uint64
+	inode     uint64
+	offset    int64  // offset just past the last complete line handed out
+	committed int64  // offset up to which lines have been handled and may be checkpointed
+	partial   []byte // bytes of a line whose newline hasn't been written yet
+
+	lastSave time.Time
+	saved    int64
+	rotating bool         // the path points at a new file, drain the old one first
+	pending  func() error // file switch to perform on the next call to Next
+
+	stopWhenGone bool // give up once the file is deleted, instead of waiting for it to return
+	gone         bool // the file was deleted and fully read, so its checkpoint is dropped on Close
+}
+
+// fileKey identifies a file a target reads, whatever name it goes by
+type fileKey struct {
+	name       string
+	dev, inode uint64
+}
+
+// movedOff is how far a follower got in a file before it moved off it
+type movedOff struct {
+	offset int64
+	at     time.Time
+}
+
+// reading tracks the files followers have open, so a file renamed under a
+// glob (a.log to a.log.1 by logrotate) isn't read again from the start by a
+// second follower. Files a follower moved off are remembered for a few
+// discovery passes, long enough for the renamed file to be found.
+var reading = struct {
+	sync.Mutex
+	open  map[fileKey]bool
+	moved map[fileKey]movedOff
+}{open: make(map[fileKey]bool), moved: make(map[fileKey]movedOff)}
+
+// errReadElsewhere is returned by newFollower when another follower of the
+// same target is reading the file under another name
+var errReadElsewhere = errors.New("file is being read under another name")
+
+// claimFile marks a file as being read. If a follower recently moved off it,
+// it returns how far that follower got.
+func claimFile(key fileKey) (int64, bool, error) {
+	reading.Lock()
+	defer reading.Unlock()
+	for k, m := range reading.moved {
+		if time.Since(m.at) > 3*discoveryInterval {
+			delete(reading.moved, k)
+		}
+	}
+	if reading.open[key] {
+		return 0, false, errReadElsewhere
+	}
+	reading.open[key] = true
+	m, ok := reading.moved[key]
+	delete(reading.moved, key)
+	return m.offset, ok, nil
+}
+
+// releaseFile marks a file as no longer read. Files the follower moved off,
+// because they were rotated away or deleted, are remembered with offset.
+func releaseFile(key fileKey, offset int64, moved bool) {
+	reading.Lock()
+	defer reading.Unlock()
+	delete(reading.open, key)
+	if moved {
+		reading.moved[key] = movedOff{offset: offset, at: time.Now()}
+	}
+}
+
+// fileID returns the device and inode of a file
+func fileID(fi os.FileInfo) (uint64, uint64) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Dev), uint64(st.Ino)
+}
+
+// newFollower opens path, resuming from its checkpoint when the checkpoint
+// still describes the same file. A file that was renamed resumes where it was
+// read up to under its old name, and files it has never seen start from zero.
+// If the file doesn't exist yet, it waits for it (or for ctx to be done).
+func newFollower(ctx context.Context, name, path string, store *checkpoint.Store) (*follower, error) {
+	f := &follower{name: name, path: path, store: store}
+
+	st, seen, err := store.Load(name, path)
+	if err != nil {
+		log.Printf("Ignoring unreadable checkpoint for %s: %v", path, err)
+		seen = false
+	}
+
+	for {
+		file, fi, err := f.openFile()
+		if err == nil {
+			dev, ino := fileID(fi)
+			moved, wasMoved, err := claimFile(fileKey{name, dev, ino})
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			var renamed checkpoint.State
+			wasRenamed := false
+			if !wasMoved && (!seen || st.Dev != dev || st.Inode != ino) {
+				if renamed, wasRenamed, err = store.Find(name, dev, ino); err != nil {
+					log.Printf("Error looking for a checkpoint of %s under another name: %v", path, err)
+				}
+			}
+
+			start := int64(0)
+			switch {
+			case wasMoved && moved <= fi.Size():
+				start = moved
+				log.Printf("%s was already read under another name, resuming at offset %d", path, start)
+			case wasRenamed && renamed.Path != path && renamed.Offset <= fi.Size():
+				start = renamed.Offset
+				log.Printf("%s was renamed from %s, resuming at offset %d", path, renamed.Path, start)
+			case !seen:
+				log.Printf("No checkpoint for %s, reading from the start", path)
+			case st.Dev != dev || st.Inode != ino:
+				log.Printf("%s was rotated while the agent was down, reading new file from the start", path)
+			case st.Offset > fi.Size():
+				log.Printf("%s was truncated while the agent was down, reading from the start", path)
+			default:
+				start = st.Offset
+				log.Printf("Resuming %s at offset %d", path, start)
+			}
+			if err := f.attach(file, fi, start); err != nil {
+				releaseFile(fileKey{name, dev, ino}, 0, false)
+				return nil, err
+			}
+			f.saved = start
+			return f, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		// don't err if file dne yet
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// openFile opens the followed path and stats the opened handle
+func (f *follower) openFile() (*os.File, os.FileInfo, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("error stating %s: %w", f.path, err)
+	}
+	return file, fi, nil
+}
+
+// attach switches the follower to a newly opened file at the given offset
+func (f *follower) attach(file *os.File, fi os.FileInfo, offset int64) error {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("error seeking %s: %w", f.path, err)
+	}
+	if f.file != nil && f.file != file {
+		f.file.Close()
+	}
+	f.file = file
+	f.reader = bufio.NewReader(file)
+	f.dev, f.inode = fileID(fi)
+	f.offset = offset
+	f.committed = offset
+	f.partial = nil
+	f.rotating = false
+	return nil
+}
+
+// errIdle is returned by Next when no line arrived within the requested wait
+var errIdle = errors.New("no new line")
+
+// errGone is returned by Next when the file was deleted and fully read,
+// for followers created with stopWhenGone
+var errGone = errors.New("file is gone")
+
+// errSwitching is returned by Next just before it moves on to a rotated or
+// truncated file, so callers can flush anything buffered from the old one
+var errSwitching = errors.New("switching files")
+
+// Next blocks until a complete line is available and returns it without the
+// newline, along with the offset just past it. With wait > 0 it gives up
+// with errIdle once wait has passed without a new line. It returns ctx.Err()
+// once ctx is done.
+func (f *follower) Next(ctx context.Context, wait time.Duration) (string, int64, error) {
+	if f.pending != nil {
+		switchFiles := f.pending
+		f.pending = nil
+		if err := switchFiles(); err != nil {
+			return "", 0, err
+		}
+	}
+
+	var deadline time.Time
+	if wait > 0 {
+		deadline = time.Now().Add(wait)
+	}
+
+	for {
+		chunk, err := f.reader.ReadBytes('\n')
+		if len(chunk) > 0 {
+			f.partial = append(f.partial, chunk...)
+		}
+		if err == nil {
+			line := f.partial
+			f.partial = nil
+			f.offset += int64(len(line))
+			line = line[:len(line)-1]
+			if n := len(line); n > 0 && line[n-1] == '\r' {
+				line = line[:n-1]
+			}
+			return string(line), f.offset, nil
+		}
+		if err != io.EOF {
+			return "", 0, fmt.Errorf("error reading %s: %w", f.path, err)
+		}
+
+		// caught up: good moment to flush the checkpoint and look for rotation
+		f.maybeSave()
+		switchFiles, err := f.checkRotation()
+		if err != nil {
+			return "", 0, err
+		}
+		if switchFiles != nil {
+			f.pending = switchFiles
+			return "", 0, errSwitching
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return "", 0, errIdle
+		}
+		select {
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Commit records that everything before offset has been handled,
+// so it is safe to checkpoint
+func (f *follower) Commit(offset int64) {
+	if offset > f.committed && offset <= f.offset {
+		f.committed = offset
+	}
+}
+
+// checkRotation looks for the path pointing at a different file, or the
+// current file shrinking below our offset. If either happened it returns a
+// function that moves the follower onto the right file.
+func (f *follower) checkRotation() (func() error, error) {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		if f.stopWhenGone && errors.Is(err, os.ErrNotExist) {
+			f.gone = true
+			return nil, errGone
+		}
+		// moved away and not recreated yet; keep the old handle and wait
+		return nil, nil
+	}
+
+	dev, ino := fileID(fi)
+	if dev != f.dev || ino != f.inode {
+		if !f.rotating {
+			// give the writer one more poll to finish with the old file
+			f.rotating = true
+			return nil, nil
+		}
+		return func() error {
+			file, newFi, err := f.openFile()
+			if err != nil {
+				// vanished again, look for it on the next poll
+				f.rotating = false
+				return nil
+			}
+			newDev, newIno := fileID(newFi)
+			if _, _, err := claimFile(fileKey{f.name, newDev, newIno}); err != nil {
+				// something else was renamed into place; wait for it to be let go
+				file.Close()
+				f.rotating = false
+				return nil
+			}
+			log.Printf("%s was rotated, following the new file", f.path)
+			releaseFile(f.key(), f.committed, true)
+			if err := f.attach(file, newFi, 0); err != nil {
+				return err
+			}
+			return f.save()
+		}, nil
+	}
+	f.rotating = false
+
+	if fi.Size() < f.offset+int64(len(f.partial)) {
+		return func() error {
+			log.Printf("%s was truncated, reading from the start", f.path)
+			if err := f.attach(f.file, fi, 0); err != nil {
+				return err
+			}
+			return f.save()
+		}, nil
+	}
+	return nil, nil
+}
+
+// key identifies the file the follower is reading
+func (f *follower) key() fileKey {
+	return fileKey{f.name, f.dev, f.inode}
+}
+
+// maybeSave writes a checkpoint if the offset moved and the interval has passed
+func (f *follower) maybeSave() {
+	if f.committed == f.saved || time.Since(f.lastSave) < f.store.Interval() {
+		return
+	}
+	if err := f.save(); err != nil {
+		log.Printf("Error saving checkpoint for %s: %v", f.path, err)
+	}
+}
+
+// save writes the current position to the checkpoint store
+func (f *follower) save() error {
+	err := f.store.Save(checkpoint.State{
+		Name:   f.name,
+		Path:   f.path,
+		Dev:    f.dev,
+		Inode:  f.inode,
+		Offset: f.committed,
+	})
+	if err != nil {
+		return err
+	}
+	f.saved = f.committed
+	f.lastSave = time.Now()
+	return nil
+}
+
+// Close flushes the checkpoint and closes the file. Files that are gone
+// have their checkpoint deleted instead, so the state directory doesn't
+// fill up with files a glob matched once.
+func (f *follower) Close() error {
+	defer f.file.Close()
+	releaseFile(f.key(), f.committed, f.gone)
+	if f.gone {
+		return f.store.Delete(f.name, f.path)
+	}
+	return f.save()
+}
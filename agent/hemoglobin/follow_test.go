@@ -0,0 +1,242 @@
+package hemoglobin
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// -- Helpers --
+
+func openStore(t *testing.T) *checkpoint.Store {
+	t.Helper()
+	store, err := checkpoint.Open(structs.CheckpointConfig{Dir: t.TempDir(), Interval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("checkpoint.Open failed: %v", err)
+	}
+	return store
+}
+
+func appendLines(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	for _, l := range lines {
+		f.WriteString(l + "\n")
+	}
+}
+
+// nextLine reads one line from the follower, committing it like ReadLog
+// does once a line has been sent, or fails after a timeout
+func nextLine(t *testing.T, f *follower) string {
+	t.Helper()
+	type result struct {
+		line string
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		for {
+			line, end, err := f.Next(context.Background(), 0)
+			if errors.Is(err, errSwitching) {
+				continue
+			}
+			if err == nil {
+				f.Commit(end)
+			}
+			ch <- result{line, err}
+			return
+		}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("Next failed: %v", r.err)
+		}
+		return r.line
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for line")
+		return ""
+	}
+}
+
+// -- Tests --
+
+func TestFollowerResumesFromCheckpoint(t *testing.T) {
+	store := openStore(t)
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendLines(t, path, "one", "two", "three")
+
+	f, err := newFollower(context.Background(), "Auth", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	if got := nextLine(t, f); got != "one" {
+		t.Fatalf("Expected 'one', got %q", got)
+	}
+	if got := nextLine(t, f); got != "two" {
+		t.Fatalf("Expected 'two', got %q", got)
+	}
+	f.Close()
+
+	// a restarted reader picks up after the last line it handed out
+	f, err = newFollower(context.Background(), "Auth", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	defer f.Close()
+	if got := nextLine(t, f); got != "three" {
+		t.Errorf("Expected 'three' after resume, got %q", got)
+	}
+}
+
+func TestFollowerHandlesTruncation(t *testing.T) {
+	store := openStore(t)
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendLines(t, path, "first line before truncation", "second line before truncation")
+
+	f, err := newFollower(context.Background(), "App", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	defer f.Close()
+	nextLine(t, f)
+	nextLine(t, f)
+
+	// copytruncate
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	appendLines(t, path, "after")
+
+	if got := nextLine(t, f); got != "after" {
+		t.Errorf("Expected 'after' following truncation, got %q", got)
+	}
+}
+
+func TestFollowerHandlesRotation(t *testing.T) {
+	store := openStore(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	appendLines(t, path, "old")
+
+	f, err := newFollower(context.Background(), "App", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	defer f.Close()
+	nextLine(t, f)
+
+	// rename + recreate, with a straggler written to the old file
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	appendLines(t, path+".1", "straggler")
+	appendLines(t, path, "new")
+
+	if got := nextLine(t, f); got != "straggler" {
+		t.Errorf("Expected 'straggler' from the old file, got %q", got)
+	}
+	if got := nextLine(t, f); got != "new" {
+		t.Errorf("Expected 'new' from the rotated file, got %q", got)
+	}
+}
+
+func TestFollowerRestartsRotatedFileFromZero(t *testing.T) {
+	store := openStore(t)
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendLines(t, path, "a", "b")
+
+	f, err := newFollower(context.Background(), "App", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	nextLine(t, f)
+	nextLine(t, f)
+	f.Close()
+
+	// rotated while the agent was down
+	os.Rename(path, path+".1")
+	appendLines(t, path, "fresh")
+
+	f, err = newFollower(context.Background(), "App", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	defer f.Close()
+	if got := nextLine(t, f); got != "fresh" {
+		t.Errorf("Expected 'fresh', got %q", got)
+	}
+}
+
+func TestFollowerResumesRenamedFile(t *testing.T) {
+	store := openStore(t)
+	path := filepath.Join(t.TempDir(), "app.log")
+	appendLines(t, path, "a", "b")
+
+	f, err := newFollower(context.Background(), "Renamed", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	nextLine(t, f)
+	nextLine(t, f)
+
+	// a second follower can't start on the same file under its new name
+	os.Rename(path, path+".1")
+	if _, err := newFollower(context.Background(), "Renamed", path+".1", store); !errors.Is(err, errReadElsewhere) {
+		t.Fatalf("Expected errReadElsewhere while the old name is read, got %v", err)
+	}
+	f.Close()
+
+	// once the agent restarts, the renamed file resumes where the old name stopped
+	appendLines(t, path+".1", "c")
+	f, err = newFollower(context.Background(), "Renamed", path+".1", store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	defer f.Close()
+	if got := nextLine(t, f); got != "c" {
+		t.Errorf("Expected 'c', got %q", got)
+	}
+}
+
+func TestFollowerDropsCheckpointOfDeletedFile(t *testing.T) {
+	store := openStore(t)
+	path := filepath.Join(t.TempDir(), "app-1.log")
+	appendLines(t, path, "one")
+
+	f, err := newFollower(context.Background(), "App", path, store)
+	if err != nil {
+		t.Fatalf("newFollower failed: %v", err)
+	}
+	f.stopWhenGone = true
+	if got := nextLine(t, f); got != "one" {
+		t.Fatalf("Expected 'one', got %q", got)
+	}
+	if err := f.save(); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	os.Remove(path)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, _, err := f.Next(ctx, 0); !errors.Is(err, errGone) {
+		t.Fatalf("Expected errGone, got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, seen, _ := store.Load("App", path); seen {
+		t.Error("Checkpoint of a deleted file was kept")
+	}
+}
@@ -1,14 +1,21 @@
 package hemoglobin
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+	"github.com/TLop503/LogCrunch/agent/filter"
 	"github.com/TLop503/LogCrunch/agent/hemoglobin/modules"
+	"github.com/TLop503/LogCrunch/agent/redact"
+	"github.com/TLop503/LogCrunch/agent/stats"
 	"github.com/TLop503/LogCrunch/agent/utils"
 	"github.com/TLop503/LogCrunch/structs"
 	"log"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"time"
-
-	"github.com/hpcloud/tail"
 )
 
 /*
@@ -21,52 +28,262 @@ type ParserEntry struct {
 	NewStruct func() interface{}
 }
 
-// ReadLog watches a log file and parses lines with a generic meta parser
-func ReadLog(logChan chan<- structs.Log, target structs.Target) {
+// ReadLog watches a log file and parses lines with a generic meta parser.
+// Progress is checkpointed in store, so a restarted agent picks up where it left off.
+// Targets with multiline options have their lines grouped into events before parsing.
+// If the target path is a glob or a directory, every matching file is tailed,
+// and new matches are picked up as they appear. ReadLog returns once ctx is done.
+func ReadLog(ctx context.Context, logChan chan<- structs.Log, target structs.Target, store *checkpoint.Store) {
 	parserModule, err := modules.HandleConfigTarget(target)
 	if err != nil {
 		log.Println("Error handling config target:", err)
 		return
 	}
 
-	tailConfig := tail.Config{
-		ReOpen:    true,                                 // handle rotation
-		Follow:    true,                                 // continuous
-		MustExist: false,                                // don't err if file dne yet
-		Location:  &tail.SeekInfo{Offset: 0, Whence: 0}, // start from end of file
-		Logger:    tail.DiscardingLogger,                // disable internal logging
+	// validate multiline options once up front, each file gets its own assembler
+	if _, err := newAssembler(target.Multiline); err != nil {
+		log.Printf("Error handling multiline options for %s: %v", target.Name, err)
+		return
+	}
+	if _, err := newTimeExtractor(target.Timestamp); err != nil {
+		log.Printf("Error handling timestamp options for %s: %v", target.Name, err)
+		return
+	}
+	filters, err := filter.Compile(target.Filters)
+	if err != nil {
+		log.Printf("Error handling filters for %s: %v", target.Name, err)
+		return
+	}
+	redactor, err := redact.Compile(target.Redact)
+	if err != nil {
+		log.Printf("Error handling redaction for %s: %v", target.Name, err)
+		return
+	}
+	out := output{filters: filters, redactor: redactor}
+
+	pattern := targetPattern(target.Path)
+	if !isPattern(pattern) {
+		tailFile(ctx, logChan, target, target.Path, parserModule, out, store, false)
+		return
+	}
+
+	discover(ctx, pattern, target.Exclude, target.IncludeRotated, func(file string, done func()) {
+		defer done()
+		tailFile(ctx, logChan, target, file, parserModule, out, store, true)
+	})
+}
+
+// ValidateTarget checks everything about a target that ReadLog would otherwise
+// only complain about once it is running
+func ValidateTarget(target structs.Target) error {
+	if target.Name == "" {
+		return fmt.Errorf("target with path %q has no name", target.Path)
+	}
+	if target.Path == "" {
+		return fmt.Errorf("target %s has no path", target.Name)
+	}
+	if _, err := modules.HandleConfigTarget(target); err != nil {
+		return err
+	}
+	if _, err := structs.ParseSeverity(target.Severity); err != nil {
+		return fmt.Errorf("target %s: %w", target.Name, err)
+	}
+	if _, err := newAssembler(target.Multiline); err != nil {
+		return fmt.Errorf("target %s: %w", target.Name, err)
+	}
+	if _, err := newTimeExtractor(target.Timestamp); err != nil {
+		return fmt.Errorf("target %s: %w", target.Name, err)
+	}
+	if target.ServerParse {
+		if target.Timestamp != nil {
+			return fmt.Errorf("target %s: timestamp needs parsed fields, which the server only has once the log is sent", target.Name)
+		}
+		// these would match nothing and let the raw line go out as is
+		for _, rule := range target.Filters {
+			if len(rule.Fields) > 0 {
+				return fmt.Errorf("target %s: filters on fields need parsed fields, which the server only has once the log is sent", target.Name)
+			}
+		}
+		if err := CheckRawOnlyRedact(target.Redact); err != nil {
+			return fmt.Errorf("target %s: %w", target.Name, err)
+		}
+	}
+	if _, err := filter.Compile(target.Filters); err != nil {
+		return fmt.Errorf("target %s: %w", target.Name, err)
+	}
+	if _, err := redact.Compile(target.Redact); err != nil {
+		return fmt.Errorf("target %s: %w", target.Name, err)
+	}
+	for _, ex := range target.Exclude {
+		if _, err := filepath.Match(ex, ""); err != nil {
+			return fmt.Errorf("target %s: invalid exclude pattern %q: %w", target.Name, ex, err)
+		}
+	}
+	return nil
+}
+
+// CheckRawOnlyRedact rejects redaction rules limited to parsed fields, which
+// would leave the raw line of a server_parse target unmasked
+func CheckRawOnlyRedact(rules []structs.RedactRule) error {
+	for _, rule := range rules {
+		if len(rule.Fields) > 0 {
+			return fmt.Errorf("redaction of fields %v needs parsed fields, which the server only has once the log is sent; use a pattern instead", rule.Fields)
+		}
+	}
+	return nil
+}
+
+// output holds what happens to a target's logs between parsing and sending
+type output struct {
+	filters  *filter.Set
+	redactor *redact.Redactor
+}
+
+// send hands a log to the transmitter, giving up if ctx is done first
+func send(ctx context.Context, logChan chan<- structs.Log, l structs.Log) bool {
+	select {
+	case logChan <- l:
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	t, err := tail.TailFile(target.Path, tailConfig)
+// tailFile follows a single concrete file for a target until ctx is done
+func tailFile(ctx context.Context, logChan chan<- structs.Log, target structs.Target, path string, parserModule structs.ParserModule, out output, store *checkpoint.Store, discovered bool) {
+	asm, _ := newAssembler(target.Multiline)
+	ts, _ := newTimeExtractor(target.Timestamp)
+
+	// emit sends a log unless the target's filters drop it, and reports whether
+	// tailing should go on. Dropped logs still count as handled for checkpoints.
+	emit := func(l structs.Log) bool {
+		if !out.filters.Keep(l) {
+			stats.Filtered.Add(target.Name, 1)
+			return true
+		}
+		return send(ctx, logChan, out.redactor.Apply(l))
+	}
+
+	f, err := newFollower(ctx, target.Name, path, store)
+	if errors.Is(err, errReadElsewhere) {
+		// discovery tries again once the old name lets go of it
+		log.Printf("%s is still being read under its old name, waiting", path)
+		return
+	}
 	if err != nil {
-		log.Fatalf("Error opening log file: %v", err)
+		if ctx.Err() == nil {
+			log.Printf("Error opening log file: %v", err)
+			stats.Errors.Set(target.Name, err)
+		}
+		return
 	}
+	f.stopWhenGone = discovered
+	defer f.Close()
+
+	for {
+		var wait time.Duration
+		if asm != nil {
+			wait = asm.Wait()
+		}
 
-	for line := range t.Lines {
-		if line.Err != nil {
-			log.Printf("Error reading line from file %v: %v\n", target.Path, line.Err)
+		line, end, err := f.Next(ctx, wait)
+		if errors.Is(err, errIdle) || errors.Is(err, errSwitching) || errors.Is(err, errGone) {
+			// nothing more is coming for the buffered event (for now, or from this file)
+			if asm != nil {
+				if event, eventEnd, ok := asm.Flush(); ok {
+					if !emit(buildLog(event, target, path, parserModule, ts)) {
+						return
+					}
+					f.Commit(eventEnd)
+				}
+			}
+			if errors.Is(err, errGone) {
+				log.Printf("%s was removed, no longer tailing it", path)
+				return
+			}
 			continue
 		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading line from file %v: %v\n", path, err)
+			stats.Errors.Set(target.Name, fmt.Errorf("reading %s: %w", path, err))
+			return
+		}
+
+		if asm == nil {
+			if !emit(buildLog(line, target, path, parserModule, ts)) {
+				return
+			}
+			f.Commit(end)
+			continue
+		}
+		if event, eventEnd, ok := asm.Add(line, end); ok {
+			if !emit(buildLog(event, target, path, parserModule, ts)) {
+				return
+			}
+			f.Commit(eventEnd)
+		}
+	}
+}
 
-		var parsed interface{}
+// buildLog parses a line (or multiline event) read from path into a log ready for transmission.
+// ts may be nil, in which case the log is stamped with the time it was read.
+func buildLog(raw string, target structs.Target, path string, parserModule structs.ParserModule, ts *timeExtractor) structs.Log {
+	var parsed interface{}
+	readTime := time.Now()
 
-		// Parse line using the generic MetaParse function
-		parsed, err := modules.MetaParse(line.Text, parserModule)
-		if err != nil {
-			log.Printf("Parse error for line in %v: %v", target.Path, err)
-			parsed = map[string]error{"Parsing error": err}
+	// ValidateTarget already rejected unknown severities
+	fallback, _ := structs.ParseSeverity(target.Severity)
+
+	// the server parses these with its definition of the module
+	if target.ServerParse {
+		stats.Read.Add(target.Name, 1)
+		return structs.Log{
+			Host:       utils.GetHostName(),
+			Timestamp:  readTime.Unix(),
+			IngestTime: readTime.Unix(),
+			Module:     target.Module,
+			Name:       target.Name,
+			Path:       path,
+			Raw:        raw,
+			Severity:   logSeverity(raw, nil, fallback),
+			RawOnly:    true,
 		}
+	}
 
-		logEntry := structs.Log{
-			Host:      utils.GetHostName(),
-			Timestamp: time.Now().Unix(),
-			Module:    target.Module,
-			Name:      target.Name,
-			Path:      target.Path,
-			Raw:       line.Text,
-			Parsed:    parsed,
+	// Parse line using the generic MetaParse function
+	parsed, err := modules.MetaParse(raw, parserModule)
+	if err != nil {
+		// a multiline event usually only matches on its first line;
+		// keep the rest (the stack trace, etc.) alongside the parsed fields
+		if first, rest, ok := strings.Cut(raw, "\n"); ok {
+			if fields, ferr := modules.MetaParse(first, parserModule); ferr == nil {
+				fields["continuation"] = rest
+				parsed, err = fields, nil
+			}
 		}
+	}
+	stats.Read.Add(target.Name, 1)
+	if err != nil {
+		log.Printf("Parse error for line in %v: %v", path, err)
+		parsed = map[string]error{"Parsing error": err}
+		stats.Failed.Add(target.Name, 1)
+		stats.Errors.Set(target.Name, fmt.Errorf("parsing %s: %w", path, err))
+	} else {
+		stats.Parsed.Add(target.Name, 1)
+	}
 
-		logChan <- logEntry
+	return structs.Log{
+		Host:       utils.GetHostName(),
+		Timestamp:  ts.eventTime(parsed, readTime, path).Unix(),
+		IngestTime: readTime.Unix(),
+		Module:     target.Module,
+		Name:       target.Name,
+		Path:       path,
+		Raw:        raw,
+		Parsed:     parsed,
+		Severity:   logSeverity(raw, parsed, fallback),
 	}
 }
@@ -8,8 +8,18 @@ import (
 )
 
 // HandleConfigTarget determines if each target is using a custom module,
-// and then either initializes the module or pulls from the registry
+// and then either initializes the module or pulls from the registry.
+// Targets the server parses get an empty module, since only the server knows it.
 func HandleConfigTarget(target structs.Target) (structs.ParserModule, error) {
+	if target.ServerParse {
+		if target.Module == "" {
+			return structs.ParserModule{}, fmt.Errorf("target %s is parsed by the server but names no module", target.Name)
+		}
+		if target.Custom {
+			return structs.ParserModule{}, fmt.Errorf("target %s can't have a custom regex and be parsed by the server", target.Name)
+		}
+		return structs.ParserModule{}, nil
+	}
 	if target.Custom {
 		re, err := regexp.Compile(target.Regex)
 		if err != nil {
@@ -120,3 +120,25 @@ func TestHandleConfigTarget_InvalidRegex(t *testing.T) {
 		t.Fatal("Expected error for invalid regex, got nil")
 	}
 }
+
+func TestHandleConfigTarget_ServerParse(t *testing.T) {
+	target := structs.Target{Name: "App", Path: "/var/log/app.log", Module: "app", ServerParse: true}
+	module, err := HandleConfigTarget(target)
+	if err != nil {
+		t.Fatalf("HandleConfigTarget failed: %v", err)
+	}
+	if module.Regex != nil {
+		t.Errorf("Expected no regex for a target the server parses, got %s", module.Regex)
+	}
+
+	target.Module = ""
+	if _, err := HandleConfigTarget(target); err == nil {
+		t.Error("Expected a target the server parses to need a module")
+	}
+
+	custom := makeCustomTarget()
+	custom.Module, custom.ServerParse = "custom", true
+	if _, err := HandleConfigTarget(custom); err == nil {
+		t.Error("Expected a custom target the server parses to be rejected")
+	}
+}
@@ -1,12 +1,17 @@
 package modules
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"strconv"
 	"time"
 
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+	"github.com/TLop503/LogCrunch/agent/filter"
+	"github.com/TLop503/LogCrunch/agent/redact"
+	"github.com/TLop503/LogCrunch/agent/stats"
 	"github.com/TLop503/LogCrunch/agent/utils"
 	"github.com/TLop503/LogCrunch/structs"
 	"github.com/coreos/go-systemd/v22/sdjournal"
@@ -21,17 +26,55 @@ func startJour() (*sdjournal.Journal, error) {
 	return j, nil
 }
 
-// ListenToSystemd Logs through coreos journal
-func ListenToSystemd(logChan chan<- structs.Log, services []structs.Service) {
-	j, err := startJour()
+// journalUnit holds the settings of the service a unit belongs to
+type journalUnit struct {
+	name     string
+	severity structs.Severity
+	filters  *filter.Set
+	redactor *redact.Redactor
+}
+
+const (
+	// name the journal cursor is saved under in the checkpoint store
+	journalCursorName = "systemd-journal"
+	// upper bound on a single journal Wait, so the loop stays responsive
+	journalWait = time.Second
+)
+
+// ListenToSystemd follows the journal through coreos journal, forever.
+// The cursor of the last entry sent is checkpointed in store so a restarted
+// agent resumes right after it; without a cursor, cfg.Start picks head or tail.
+// It returns once ctx is done.
+func ListenToSystemd(ctx context.Context, logChan chan<- structs.Log, services []structs.Service, store *checkpoint.Store, cfg structs.JournalConfig) {
+	if len(services) == 0 {
+		log.Println("No systemd services configured, not listening to the journal")
+		return
+	}
 
+	j, err := startJour()
 	if err != nil {
-		log.Fatalf("Error starting jour: %s", err)
+		// a reload or profile push restarts us, so don't take the agent down
+		log.Printf("Not listening to the journal: %s", err)
+		stats.Errors.Set("journal", err) // not tied to one service
+		return
 	}
 	defer j.Close()
 
-	// add services to listener
+	// add services to listener, remembering each unit's settings
+	units := make(map[string]journalUnit)
 	for _, service := range services {
+		unit := journalUnit{name: service.Name}
+		unit.severity, _ = structs.ParseSeverity(service.Severity)
+		if unit.filters, err = filter.Compile(service.Filters); err != nil {
+			log.Printf("Ignoring filters for %s: %s", service.Name, err)
+		}
+		if unit.redactor, err = redact.Compile(service.Redact); err != nil {
+			// sending secrets is worse than not listening
+			log.Printf("Not listening to %s, invalid redaction: %s", service.Name, err)
+			continue
+		}
+		units[service.Key+".service"] = unit
+
 		// parse keys (daemon names, usually) into services
 		err := j.AddMatch("_SYSTEMD_UNIT=" + service.Key + ".service")
 		if err != nil {
@@ -39,44 +82,170 @@ func ListenToSystemd(logChan chan<- structs.Log, services []structs.Service) {
 		}
 
 	}
+	if len(units) == 0 {
+		// without any matches the journal would hand us every unit
+		log.Println("No usable systemd services, not listening to the journal")
+		return
+	}
 
-	// move cursor to now
-	j.SeekHead()
-	for {
+	if err := seekJournal(j, store, cfg); err != nil {
+		log.Printf("Not listening to the journal, failed to position it: %s", err)
+		stats.Errors.Set("journal", err) // not tied to one service
+		return
+	}
+
+	var cursor, savedCursor string
+	lastSave := time.Now()
+	defer func() {
+		// remember where we stopped
+		if cursor != savedCursor {
+			if err := store.SaveCursor(journalCursorName, cursor); err != nil {
+				log.Printf("Error saving journal cursor: %s", err)
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
 		n, err := j.Next()
 		if err != nil {
-			log.Fatalf("Error reading systemd journal: %s", err)
+			log.Printf("Error reading systemd journal: %s", err)
+			stats.Errors.Set("journal", err) // not tied to one service
+			time.Sleep(journalWait)
+			continue
 		}
 		if n == 0 {
-			break
+			// caught up: flush the cursor, then block until the journal changes
+			if cursor != savedCursor {
+				if err := store.SaveCursor(journalCursorName, cursor); err != nil {
+					log.Printf("Error saving journal cursor: %s", err)
+				} else {
+					savedCursor = cursor
+					lastSave = time.Now()
+				}
+			}
+			j.Wait(journalWait)
+			continue
 		}
 
 		entry, err := j.GetEntry()
 		if err != nil {
 			log.Printf("Error getting journal entry: %s", err)
+			stats.Errors.Set("journal", err) // not tied to one service
 			continue
 		}
+		unit := units[entry.Fields["_SYSTEMD_UNIT"]]
+		stats.Read.Add(unit.name, 1)
 		parsed, err := entryToPrettyString(entry)
 		if err != nil {
 			log.Printf("Error parsing journal entry: %s", err)
+			stats.Failed.Add(unit.name, 1)
+			stats.Errors.Set(unit.name, err)
+		} else {
+			stats.Parsed.Add(unit.name, 1)
 		}
 		raw, err := entryToString(entry)
 		if err != nil {
 			log.Printf("Error converting journal entry to string: %s", err)
 		}
 		logEntry := structs.Log{
-			Host:      utils.GetHostName(),
-			Timestamp: time.Now().Unix(),
-			Module:    "systemd",
-			Name:      entry.Fields["_SYSTEMD_UNIT"],
-			Path:      "systemd",
-			Raw:       raw,
-			Parsed:    parsed,
+			Host: utils.GetHostName(),
+			// the journal records when each entry was logged
+			Timestamp:  time.UnixMicro(int64(entry.RealtimeTimestamp)).Unix(),
+			IngestTime: time.Now().Unix(),
+			Module:     "systemd",
+			Name:       entry.Fields["_SYSTEMD_UNIT"],
+			Path:       "systemd",
+			Raw:        raw,
+			Parsed:     parsed,
+			Severity:   entrySeverity(entry, unit.severity),
+		}
+		if unit.filters.Keep(logEntry) {
+			select {
+			case logChan <- unit.redactor.Apply(logEntry):
+			case <-ctx.Done():
+				return
+			}
+		} else {
+			stats.Filtered.Add(unit.name, 1)
+		}
+		cursor = entry.Cursor
+
+		// busy journals never catch up, so also save on an interval
+		if time.Since(lastSave) >= store.Interval() {
+			if err := store.SaveCursor(journalCursorName, cursor); err != nil {
+				log.Printf("Error saving journal cursor: %s", err)
+			} else {
+				savedCursor = cursor
+			}
+			lastSave = time.Now()
 		}
-		logChan <- logEntry
 	}
 }
 
+// seekJournal moves the read pointer to just after the saved cursor,
+// or to the head or tail of the journal when there isn't one. A saved
+// cursor the journal rejects is dropped, and reading starts at the tail.
+func seekJournal(j *sdjournal.Journal, store *checkpoint.Store, cfg structs.JournalConfig) error {
+	cursor, ok, err := store.LoadCursor(journalCursorName)
+	if err != nil {
+		log.Printf("Ignoring unreadable journal cursor: %s", err)
+		ok = false
+	}
+
+	if ok {
+		err := seekCursor(j, cursor)
+		if err == nil {
+			log.Println("Resuming systemd journal from saved cursor")
+			return nil
+		}
+		log.Printf("Dropping saved journal cursor, starting at the tail: %s", err)
+		if err := store.Delete(journalCursorName, ""); err != nil {
+			log.Printf("Error deleting journal cursor: %s", err)
+		}
+		return seekTail(j)
+	}
+
+	switch cfg.Start {
+	case "tail":
+		log.Println("No journal cursor saved, starting at the tail")
+		return seekTail(j)
+	case "", "head":
+		log.Println("No journal cursor saved, starting at the head")
+		return j.SeekHead()
+	default:
+		return fmt.Errorf("unknown journal start %q, expected head or tail", cfg.Start)
+	}
+}
+
+// seekCursor moves the read pointer to just after the entry at cursor
+func seekCursor(j *sdjournal.Journal, cursor string) error {
+	if err := j.SeekCursor(cursor); err != nil {
+		return fmt.Errorf("failed to seek to saved cursor: %w", err)
+	}
+	// SeekCursor lands on the entry we already sent; step over it
+	if _, err := j.Next(); err != nil {
+		return fmt.Errorf("failed to step past saved cursor: %w", err)
+	}
+	if err := j.TestCursor(cursor); err != nil {
+		// the entry was vacuumed away, we're already at the next one
+		log.Printf("Saved journal cursor no longer exists, resuming at the closest entry")
+		if _, err := j.Previous(); err != nil {
+			return fmt.Errorf("failed to step back: %w", err)
+		}
+	}
+	return nil
+}
+
+// seekTail moves the read pointer to the end, so only new entries are read
+func seekTail(j *sdjournal.Journal) error {
+	if err := j.SeekTail(); err != nil {
+		return err
+	}
+	// SeekTail points past the end; step back so Next waits for new entries
+	_, err := j.Previous()
+	return err
+}
+
 // systemd entryToString
 func entryToString(entry *sdjournal.JournalEntry) (string, error) {
 	// Serialize the Fields map to JSON
@@ -87,6 +256,19 @@ func entryToString(entry *sdjournal.JournalEntry) (string, error) {
 	return string(out), nil
 }
 
+// entrySeverity maps the entry's PRIORITY onto the severity scale,
+// falling back to the service's configured severity
+func entrySeverity(entry *sdjournal.JournalEntry, fallback structs.Severity) structs.Severity {
+	priority, err := strconv.Atoi(entry.Fields["PRIORITY"])
+	if err != nil {
+		return fallback
+	}
+	if sev := structs.SeverityFromSyslog(priority); sev != structs.SeverityUnknown {
+		return sev
+	}
+	return fallback
+}
+
 // entryToPrettyString creates "parsed" entries
 func entryToPrettyString(entry *sdjournal.JournalEntry) (structs.SyslogPrettyEntry, error) {
 	priorityInt, err := strconv.Atoi(entry.Fields["PRIORITY"])
@@ -0,0 +1,117 @@
+package hemoglobin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+const (
+	defaultMaxLines         = 500
+	defaultMultilineTimeout = 2 * time.Second
+)
+
+// assembler groups raw lines into logical events before they are parsed
+type assembler struct {
+	start    *regexp.Regexp
+	cont     *regexp.Regexp
+	maxLines int
+	timeout  time.Duration
+
+	lines []string
+	end   int64     // offset just past the last buffered line
+	last  time.Time // when the last line was buffered
+}
+
+// newAssembler builds an assembler from a target's multiline options.
+// It returns nil when the target doesn't use multiline grouping.
+func newAssembler(cfg *structs.MultilineConfig) (*assembler, error) {
+	if cfg == nil || (cfg.Start == "" && cfg.Continue == "") {
+		return nil, nil
+	}
+
+	a := &assembler{
+		maxLines: cfg.MaxLines,
+		timeout:  cfg.Timeout,
+	}
+	if a.maxLines <= 0 {
+		a.maxLines = defaultMaxLines
+	}
+	if a.timeout <= 0 {
+		a.timeout = defaultMultilineTimeout
+	}
+
+	var err error
+	if cfg.Start != "" {
+		if a.start, err = regexp.Compile(cfg.Start); err != nil {
+			return nil, fmt.Errorf("invalid multiline start pattern: %w", err)
+		}
+	}
+	if cfg.Continue != "" {
+		if a.cont, err = regexp.Compile(cfg.Continue); err != nil {
+			return nil, fmt.Errorf("invalid multiline continue pattern: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// continues reports whether line belongs to the event being built
+func (a *assembler) continues(line string) bool {
+	if a.start != nil && a.start.MatchString(line) {
+		return false
+	}
+	if a.cont != nil {
+		return a.cont.MatchString(line)
+	}
+	// only a start pattern: everything up to the next start belongs together
+	return true
+}
+
+// Add feeds a line (ending at offset end) into the assembler. If the line
+// completes an event, the event and the offset just past it are returned.
+func (a *assembler) Add(line string, end int64) (string, int64, bool) {
+	var (
+		event    string
+		eventEnd int64
+		done     bool
+	)
+
+	if len(a.lines) > 0 && !a.continues(line) {
+		event, eventEnd, done = a.Flush()
+	}
+
+	a.lines = append(a.lines, line)
+	a.end = end
+	a.last = time.Now()
+
+	if !done && len(a.lines) >= a.maxLines {
+		event, eventEnd, done = a.Flush()
+	}
+	return event, eventEnd, done
+}
+
+// Flush returns whatever event is buffered, if any
+func (a *assembler) Flush() (string, int64, bool) {
+	if len(a.lines) == 0 {
+		return "", 0, false
+	}
+	event := strings.Join(a.lines, "\n")
+	a.lines = a.lines[:0]
+	return event, a.end, true
+}
+
+// Wait returns how long to wait for more lines before the buffered event
+// should be flushed. Zero means nothing is buffered.
+func (a *assembler) Wait() time.Duration {
+	if len(a.lines) == 0 {
+		return 0
+	}
+	remaining := a.timeout - time.Since(a.last)
+	if remaining <= 0 {
+		return time.Nanosecond
+	}
+	return remaining
+}
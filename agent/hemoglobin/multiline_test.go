@@ -0,0 +1,100 @@
+package hemoglobin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// feed runs lines through an assembler and collects the completed events
+func feed(a *assembler, lines ...string) []string {
+	var events []string
+	for i, line := range lines {
+		if event, _, ok := a.Add(line, int64(i+1)); ok {
+			events = append(events, event)
+		}
+	}
+	if event, _, ok := a.Flush(); ok {
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAssemblerStartPattern(t *testing.T) {
+	a, err := newAssembler(&structs.MultilineConfig{Start: `^\d{4}-\d{2}-\d{2} `})
+	if err != nil {
+		t.Fatalf("newAssembler failed: %v", err)
+	}
+
+	events := feed(a,
+		"2025-01-15 10:30:00 ERROR boom",
+		"java.lang.IllegalStateException: bad",
+		"\tat com.example.Main.run(Main.java:10)",
+		"2025-01-15 10:30:01 INFO fine",
+	)
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %q", len(events), events)
+	}
+	expected := "2025-01-15 10:30:00 ERROR boom\njava.lang.IllegalStateException: bad\n\tat com.example.Main.run(Main.java:10)"
+	if events[0] != expected {
+		t.Errorf("Expected %q, got %q", expected, events[0])
+	}
+}
+
+func TestAssemblerContinuePattern(t *testing.T) {
+	a, err := newAssembler(&structs.MultilineConfig{Continue: `^(\s|Traceback|\w+Error:)`})
+	if err != nil {
+		t.Fatalf("newAssembler failed: %v", err)
+	}
+
+	events := feed(a,
+		"Traceback (most recent call last):",
+		`  File "app.py", line 1, in <module>`,
+		"ValueError: nope",
+		"next event",
+	)
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d: %q", len(events), events)
+	}
+	if events[1] != "next event" {
+		t.Errorf("Expected last event to stand alone, got %q", events[1])
+	}
+}
+
+func TestAssemblerMaxLines(t *testing.T) {
+	a, _ := newAssembler(&structs.MultilineConfig{Start: `^START`, MaxLines: 2})
+
+	events := feed(a, "START", "a", "b", "c")
+	if len(events) != 2 || events[0] != "START\na" {
+		t.Errorf("Expected events capped at 2 lines, got %q", events)
+	}
+}
+
+func TestAssemblerWait(t *testing.T) {
+	a, _ := newAssembler(&structs.MultilineConfig{Start: `^START`, Timeout: time.Minute})
+
+	if a.Wait() != 0 {
+		t.Error("Expected no wait with nothing buffered")
+	}
+	a.Add("START", 6)
+	if w := a.Wait(); w <= 0 || w > time.Minute {
+		t.Errorf("Expected wait within the timeout, got %v", w)
+	}
+}
+
+func TestNewAssemblerDisabled(t *testing.T) {
+	a, err := newAssembler(nil)
+	if err != nil || a != nil {
+		t.Errorf("Expected nil assembler without multiline options, got %v, %v", a, err)
+	}
+}
+
+func TestNewAssemblerInvalidRegex(t *testing.T) {
+	_, err := newAssembler(&structs.MultilineConfig{Start: `^(unclosed[`})
+	if err == nil {
+		t.Fatal("Expected error for invalid regex, got nil")
+	}
+}
@@ -0,0 +1,38 @@
+package hemoglobin
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// fields checked, in order, for a severity the log declares about itself
+var severityFields = []string{"severity", "level", "priority"}
+
+// syslogPRI matches the <PRI> prefix of a raw syslog line
+var syslogPRI = regexp.MustCompile(`^<(\d{1,3})>`)
+
+// logSeverity works out the severity of a line: a level the log declares
+// (a parsed severity/level/priority field, or a syslog <PRI> prefix) wins,
+// otherwise the target's configured severity is used
+func logSeverity(raw string, parsed interface{}, fallback structs.Severity) structs.Severity {
+	if fields, ok := parsed.(map[string]interface{}); ok {
+		for _, name := range severityFields {
+			v, ok := fields[name]
+			if !ok {
+				continue
+			}
+			if sev, err := structs.ParseSeverity(fmt.Sprint(v)); err == nil && sev != structs.SeverityUnknown {
+				return sev
+			}
+		}
+	}
+	if m := syslogPRI.FindStringSubmatch(raw); m != nil {
+		if pri, err := strconv.Atoi(m[1]); err == nil && pri <= 191 {
+			return structs.SeverityFromSyslog(pri % 8)
+		}
+	}
+	return fallback
+}
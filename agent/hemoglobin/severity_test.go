@@ -0,0 +1,29 @@
+package hemoglobin
+
+import (
+	"testing"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+func TestLogSeverity(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		parsed   interface{}
+		fallback structs.Severity
+		want     structs.Severity
+	}{
+		{"target default", "plain line", map[string]interface{}{"message": "plain line"}, structs.SeverityNotice, structs.SeverityNotice},
+		{"level name", "", map[string]interface{}{"level": "WARN"}, structs.SeverityInfo, structs.SeverityWarning},
+		{"numeric priority", "", map[string]interface{}{"priority": 3}, structs.SeverityInfo, structs.SeverityError},
+		{"unknown level", "", map[string]interface{}{"level": "loud"}, structs.SeverityInfo, structs.SeverityInfo},
+		{"syslog PRI", "<34>Oct 11 22:14:15 host su: failed", nil, structs.SeverityInfo, structs.SeverityCritical},
+		{"parse error", "junk", map[string]error{"Parsing error": nil}, structs.SeverityDebug, structs.SeverityDebug},
+	}
+	for _, tt := range tests {
+		if got := logSeverity(tt.raw, tt.parsed, tt.fallback); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package hemoglobin
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// named layouts a target can use instead of spelling out a Go layout
+const (
+	layoutSyslog  = "syslog"
+	layoutApache  = "apache"
+	layoutRFC3339 = "rfc3339"
+	layoutEpoch   = "epoch"
+)
+
+var namedLayouts = map[string]string{
+	layoutSyslog:  time.Stamp,                   // Jan _2 15:04:05, no year
+	layoutApache:  "02/Jan/2006:15:04:05 -0700", // %d/%b/%Y:%H:%M:%S %z
+	layoutRFC3339: time.RFC3339Nano,             // also accepts times without fractions
+}
+
+// syslog timestamps have no year; one this far past now must be from last year
+const syslogFutureSlack = 24 * time.Hour
+
+// timeExtractor pulls the event time out of a parsed field
+type timeExtractor struct {
+	field   string
+	layouts []string
+	loc     *time.Location
+	now     func() time.Time
+	warned  bool
+}
+
+// newTimeExtractor builds an extractor from a target's timestamp options.
+// It returns nil if the target has none.
+func newTimeExtractor(cfg *structs.TimestampConfig) (*timeExtractor, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.Field == "" {
+		return nil, errors.New("timestamp needs a field")
+	}
+	if len(cfg.Layouts) == 0 {
+		return nil, errors.New("timestamp needs at least one layout")
+	}
+
+	loc := time.Local
+	if cfg.Timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp timezone: %w", err)
+		}
+	}
+
+	return &timeExtractor{
+		field:   cfg.Field,
+		layouts: cfg.Layouts,
+		loc:     loc,
+		now:     time.Now,
+	}, nil
+}
+
+// Extract finds the configured field in parsed and parses it with the first
+// layout that fits
+func (te *timeExtractor) Extract(parsed interface{}) (time.Time, error) {
+	fields, ok := parsed.(map[string]interface{})
+	if !ok {
+		return time.Time{}, errors.New("log wasn't parsed")
+	}
+	v, ok := fields[te.field]
+	if !ok {
+		return time.Time{}, fmt.Errorf("no %q field", te.field)
+	}
+	value := strings.TrimSpace(fmt.Sprint(v))
+
+	for _, layout := range te.layouts {
+		if t, err := te.parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q matches none of %v", value, te.layouts)
+}
+
+// parse reads value with a single layout
+func (te *timeExtractor) parse(layout, value string) (time.Time, error) {
+	switch layout {
+	case layoutEpoch:
+		return parseEpoch(value)
+	case layoutSyslog:
+		t, err := time.ParseInLocation(namedLayouts[layoutSyslog], value, te.loc)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return inferYear(t, te.now().In(te.loc)), nil
+	}
+	if named, ok := namedLayouts[layout]; ok {
+		layout = named
+	}
+	return time.ParseInLocation(layout, value, te.loc)
+}
+
+// inferYear gives a year-less syslog time the current year, or last year
+// if that would put it in the future (December logs read in January)
+func inferYear(t, now time.Time) time.Time {
+	t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if t.Sub(now) > syslogFutureSlack {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
+
+// parseEpoch reads a unix timestamp in seconds (optionally fractional),
+// milliseconds, microseconds or nanoseconds, going by its magnitude
+func parseEpoch(value string) (time.Time, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f < 0 {
+		return time.Time{}, fmt.Errorf("invalid epoch %q", value)
+	}
+	switch {
+	case f >= 1e17:
+		return time.Unix(0, int64(f)), nil
+	case f >= 1e14:
+		return time.UnixMicro(int64(f)), nil
+	case f >= 1e11:
+		return time.UnixMilli(int64(f)), nil
+	default:
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+}
+
+// eventTime returns the time a line was logged, falling back to readTime
+// when the target has no timestamp options or the field can't be parsed
+func (te *timeExtractor) eventTime(parsed interface{}, readTime time.Time, path string) time.Time {
+	if te == nil {
+		return readTime
+	}
+	t, err := te.Extract(parsed)
+	if err != nil {
+		// once per file is enough to point at a bad layout
+		if !te.warned {
+			log.Printf("Can't read event time in %s, using read time: %v", path, err)
+			te.warned = true
+		}
+		return readTime
+	}
+	return t
+}
@@ -0,0 +1,98 @@
+package hemoglobin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+func newTestExtractor(t *testing.T, layouts []string, tz string, now time.Time) *timeExtractor {
+	t.Helper()
+	te, err := newTimeExtractor(&structs.TimestampConfig{Field: "timestamp", Layouts: layouts, Timezone: tz})
+	if err != nil {
+		t.Fatalf("newTimeExtractor failed: %v", err)
+	}
+	te.now = func() time.Time { return now }
+	return te
+}
+
+func TestTimeExtractorLayouts(t *testing.T) {
+	utc := time.UTC
+	now := time.Date(2025, time.June, 15, 12, 0, 0, 0, utc)
+
+	tests := []struct {
+		name    string
+		layouts []string
+		value   interface{}
+		want    time.Time
+	}{
+		{"syslog", []string{"syslog"}, "Jun  3 08:01:02", time.Date(2025, time.June, 3, 8, 1, 2, 0, utc)},
+		{"apache", []string{"apache"}, "10/Oct/2024:13:55:36 -0700", time.Date(2024, time.October, 10, 20, 55, 36, 0, utc)},
+		{"rfc3339", []string{"rfc3339"}, "2024-02-29T10:00:00.5Z", time.Date(2024, time.February, 29, 10, 0, 0, 5e8, utc)},
+		{"epoch seconds", []string{"epoch"}, 1700000000, time.Unix(1700000000, 0)},
+		{"epoch millis", []string{"epoch"}, "1700000000123", time.UnixMilli(1700000000123)},
+		{"go layout", []string{"2006-01-02 15:04:05"}, "2024-01-02 03:04:05", time.Date(2024, time.January, 2, 3, 4, 5, 0, utc)},
+		{"falls through layouts", []string{"rfc3339", "apache"}, "10/Oct/2024:13:55:36 +0000", time.Date(2024, time.October, 10, 13, 55, 36, 0, utc)},
+	}
+	for _, tt := range tests {
+		te := newTestExtractor(t, tt.layouts, "UTC", now)
+		got, err := te.Extract(map[string]interface{}{"timestamp": tt.value})
+		if err != nil {
+			t.Errorf("%s: Extract failed: %v", tt.name, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestTimeExtractorSyslogYearInference(t *testing.T) {
+	// a December line read just after new year belongs to last year
+	now := time.Date(2025, time.January, 1, 0, 5, 0, 0, time.UTC)
+	te := newTestExtractor(t, []string{"syslog"}, "UTC", now)
+
+	got, err := te.Extract(map[string]interface{}{"timestamp": "Dec 31 23:59:58"})
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	if want := time.Date(2024, time.December, 31, 23, 59, 58, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestTimeExtractorTimezone(t *testing.T) {
+	now := time.Date(2025, time.June, 15, 12, 0, 0, 0, time.UTC)
+	te := newTestExtractor(t, []string{"syslog"}, "America/New_York", now)
+
+	got, err := te.Extract(map[string]interface{}{"timestamp": "Jun 15 08:00:00"})
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	// EDT is UTC-4
+	if want := time.Date(2025, time.June, 15, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+func TestEventTimeFallsBackToReadTime(t *testing.T) {
+	readTime := time.Unix(1234, 0)
+
+	var none *timeExtractor
+	if got := none.eventTime(nil, readTime, "x"); !got.Equal(readTime) {
+		t.Errorf("Expected read time without options, got %v", got)
+	}
+
+	te := newTestExtractor(t, []string{"rfc3339"}, "", time.Now())
+	if got := te.eventTime(map[string]interface{}{"timestamp": "yesterday"}, readTime, "x"); !got.Equal(readTime) {
+		t.Errorf("Expected read time for an unparsable field, got %v", got)
+	}
+	if got := te.eventTime(map[string]interface{}{"message": "no time"}, readTime, "x"); !got.Equal(readTime) {
+		t.Errorf("Expected read time for a missing field, got %v", got)
+	}
+
+	if _, err := newTimeExtractor(&structs.TimestampConfig{Field: "ts", Layouts: []string{"epoch"}, Timezone: "Mars/Olympus"}); err == nil {
+		t.Error("Expected an error for an unknown timezone")
+	}
+}
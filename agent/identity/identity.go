@@ -0,0 +1,92 @@
+// Package identity is how the agent introduces itself to the server:
+// a random ID that survives restarts, plus what it runs on.
+package identity
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/utils"
+	"github.com/TLop503/LogCrunch/protocol"
+)
+
+// Version is the agent's release, set at build time with
+// -ldflags "-X github.com/TLop503/LogCrunch/agent/identity.Version=v1.2.3"
+var Version = "dev"
+
+const idFile = "agent-id"
+
+// LoadID returns the agent ID stored in dir, creating one on first run
+func LoadID(dir string) (string, error) {
+	path := filepath.Join(dir, idFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read agent ID: %w", err)
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o600); err != nil {
+		return "", fmt.Errorf("failed to save agent ID: %w", err)
+	}
+	return id, nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate agent ID: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Kernel returns the running kernel's release, or "" where we can't tell
+func Kernel() string {
+	data, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Hello describes this agent for the handshake, with the profile it runs and
+// why it rejected the last one. The transport fills in the protocol versions
+// and codecs.
+func Hello(id string, targets []string, expect map[string]time.Duration, configVersion, configError string) protocol.Hello {
+	return protocol.Hello{
+		AgentID:       id,
+		AgentVersion:  Version,
+		Hostname:      utils.GetHostName(),
+		OS:            runtime.GOOS + "/" + runtime.GOARCH,
+		Kernel:        Kernel(),
+		Targets:       targets,
+		Expect:        expect,
+		ConfigVersion: configVersion,
+		ConfigError:   configError,
+		Capabilities: []string{
+			protocol.CapBatches,
+			protocol.CapCompression,
+			protocol.CapJournal,
+			protocol.CapFilters,
+			protocol.CapRedaction,
+			protocol.CapProfiles,
+		},
+	}
+}
@@ -0,0 +1,25 @@
+package identity
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestLoadIDPersists(t *testing.T) {
+	dir := t.TempDir()
+	id, err := LoadID(dir)
+	if err != nil {
+		t.Fatalf("LoadID failed: %v", err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("Expected a v4 UUID, got %q", id)
+	}
+
+	again, err := LoadID(dir)
+	if err != nil {
+		t.Fatalf("LoadID failed on second run: %v", err)
+	}
+	if again != id {
+		t.Errorf("Expected the ID to survive a restart, got %q then %q", id, again)
+	}
+}
@@ -0,0 +1,22 @@
+package redact
+
+// Presets are built-in patterns for common secrets. Where a pattern has a
+// group named "secret", only that part of the match is masked, so the key
+// ("password=", "Bearer ") stays readable.
+var Presets = map[string]string{
+	// password=hunter2, pwd: hunter2
+	"password": `(?i)\b(?:password|passwd|pwd|pass)\s*[=:]\s*(?P<secret>[^\s&"',;]+)`,
+	// sshd logs whatever was typed at the username prompt, which is often a password
+	"ssh_invalid_user": `\b[Ii]nvalid user (?P<secret>\S+) from\b`,
+	// ?token=...&api_key=... in request lines and URLs
+	"url_secrets": `(?i)[?&](?:token|access_token|refresh_token|id_token|api_key|apikey|key|secret|client_secret|session|sessionid|sid|auth|password|passwd|signature|sig)=(?P<secret>[^&\s"#]+)`,
+	// Authorization: Bearer ... / Basic ...
+	"bearer": `(?i)\b(?:bearer|basic)\s+(?P<secret>[A-Za-z0-9._~+/=-]{8,})`,
+	"jwt":    `\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+	// AWS access key IDs
+	"aws_key": `\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	// 13-19 digit card numbers, optionally split by spaces or dashes
+	"credit_card": `\b(?:\d[ -]?){12,18}\d\b`,
+	// PEM private keys, for multiline events
+	"private_key": `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+}
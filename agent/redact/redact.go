@@ -0,0 +1,269 @@
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// rule actions
+const (
+	Replace  = "replace"
+	Hash     = "hash"
+	Truncate = "truncate"
+)
+
+const defaultReplacement = "[REDACTED]"
+
+// rule is a compiled structs.RedactRule
+type rule struct {
+	pattern     *regexp.Regexp // nil masks whole field values
+	secret      int            // index of the "secret" group, or 0 for the whole match
+	fields      []string
+	action      string
+	replacement string
+	salt        []byte
+	keep        int
+}
+
+// Redactor masks secrets in logs. A nil Redactor leaves logs untouched.
+type Redactor struct {
+	rules []rule
+}
+
+// Compile checks and compiles rules. It returns nil when there are none.
+func Compile(rules []structs.RedactRule) (*Redactor, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	r := &Redactor{}
+	for i, cfg := range rules {
+		c, err := compileRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("redact rule %d: %w", i+1, err)
+		}
+		r.rules = append(r.rules, c)
+	}
+	return r, nil
+}
+
+func compileRule(cfg structs.RedactRule) (rule, error) {
+	c := rule{
+		fields:      cfg.Fields,
+		action:      strings.ToLower(cfg.Action),
+		replacement: cfg.Replacement,
+		salt:        []byte(cfg.Salt),
+		keep:        cfg.Length,
+	}
+
+	pattern := cfg.Pattern
+	if cfg.Preset != "" {
+		if pattern != "" {
+			return rule{}, errors.New("use either preset or pattern, not both")
+		}
+		var ok bool
+		if pattern, ok = Presets[cfg.Preset]; !ok {
+			return rule{}, fmt.Errorf("unknown preset %q", cfg.Preset)
+		}
+	}
+	if pattern == "" && len(cfg.Fields) == 0 {
+		return rule{}, errors.New("needs a preset, a pattern, or fields to mask")
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return rule{}, fmt.Errorf("invalid pattern: %w", err)
+		}
+		c.pattern = re
+		c.secret = re.SubexpIndex("secret")
+		if c.secret < 0 {
+			c.secret = 0
+		}
+	}
+
+	switch c.action {
+	case "":
+		c.action = Replace
+		fallthrough
+	case Replace:
+		if c.replacement == "" {
+			c.replacement = defaultReplacement
+		}
+	case Hash:
+		if len(c.salt) == 0 {
+			return rule{}, errors.New("hash needs a salt, or equal secrets can be looked up across hosts")
+		}
+	case Truncate:
+		if c.keep < 0 {
+			return rule{}, errors.New("truncate length can't be negative")
+		}
+	default:
+		return rule{}, fmt.Errorf("unknown action %q, expected replace, hash or truncate", cfg.Action)
+	}
+	return c, nil
+}
+
+// Apply returns l with every rule applied to its raw line and parsed fields
+func (r *Redactor) Apply(l structs.Log) structs.Log {
+	if r == nil {
+		return l
+	}
+	for _, c := range r.rules {
+		l = c.apply(l)
+	}
+	return l
+}
+
+// apply runs one rule over a log
+func (c rule) apply(l structs.Log) structs.Log {
+	if c.pattern == nil {
+		// whole values of the named fields; the same text in the raw line goes too
+		l.Parsed = mapFields(l.Parsed, c.fields, func(value string) string {
+			if value == "" {
+				return value
+			}
+			masked := c.mask(value)
+			l.Raw = replaceRaw(l.Raw, value, masked)
+			return masked
+		})
+		return l
+	}
+
+	if len(c.fields) == 0 {
+		// everywhere: the raw line and every parsed string
+		l.Raw = c.replaceAll(l.Raw)
+		l.Parsed = mapFields(l.Parsed, nil, c.replaceAll)
+		return l
+	}
+
+	// only inside the named fields, and wherever their old values show up in the raw line
+	l.Parsed = mapFields(l.Parsed, c.fields, func(value string) string {
+		masked := c.replaceAll(value)
+		if masked != value {
+			l.Raw = replaceRaw(l.Raw, value, masked)
+		}
+		return masked
+	})
+	return l
+}
+
+// replaceRaw replaces a field's value wherever it shows up in the raw line,
+// also in its JSON-encoded form, as journal entries keep their fields in the
+// raw line as JSON and escape quotes, backslashes and newlines there
+func replaceRaw(raw, value, masked string) string {
+	raw = strings.ReplaceAll(raw, value, masked)
+	if encoded, ok := jsonString(value); ok && encoded != value {
+		encodedMask, _ := jsonString(masked)
+		raw = strings.ReplaceAll(raw, encoded, encodedMask)
+	}
+	return raw
+}
+
+// jsonString returns s as encoding/json writes it inside a string, without the quotes
+func jsonString(s string) (string, bool) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", false
+	}
+	return string(b[1 : len(b)-1]), true
+}
+
+// replaceAll masks every match of the rule's pattern in s
+func (c rule) replaceAll(s string) string {
+	if c.secret == 0 {
+		return c.pattern.ReplaceAllStringFunc(s, c.mask)
+	}
+
+	idx := c.pattern.FindAllStringSubmatchIndex(s, -1)
+	if idx == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range idx {
+		start, end := m[2*c.secret], m[2*c.secret+1]
+		if start < 0 {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(c.mask(s[start:end]))
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// mask applies the rule's action to a single secret
+func (c rule) mask(secret string) string {
+	switch c.action {
+	case Hash:
+		mac := hmac.New(sha256.New, c.salt)
+		mac.Write([]byte(secret))
+		return "hash:" + hex.EncodeToString(mac.Sum(nil))[:16]
+	case Truncate:
+		runes := []rune(secret)
+		if len(runes) <= c.keep {
+			return secret
+		}
+		return string(runes[:c.keep]) + "..."
+	default:
+		return c.replacement
+	}
+}
+
+// mapFields runs fn over parsed string fields: the named ones, or all of them
+// when names is empty. Maps from MetaParse are updated in place; structs
+// (like journal entries) are copied and matched on their logfield tag or
+// field name, ignoring case.
+func mapFields(parsed interface{}, names []string, fn func(string) string) interface{} {
+	wanted := func(name string) bool {
+		if len(names) == 0 {
+			return true
+		}
+		for _, n := range names {
+			if strings.EqualFold(n, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch p := parsed.(type) {
+	case nil:
+		return nil
+	case map[string]interface{}:
+		for name, v := range p {
+			if s, ok := v.(string); ok && wanted(name) {
+				p[name] = fn(s)
+			}
+		}
+		return p
+	}
+
+	v := reflect.ValueOf(parsed)
+	if v.Kind() != reflect.Struct {
+		return parsed
+	}
+	out := reflect.New(v.Type()).Elem()
+	out.Set(v)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Type.Kind() != reflect.String {
+			continue
+		}
+		if wanted(f.Name) || (f.Tag.Get("logfield") != "" && wanted(f.Tag.Get("logfield"))) {
+			out.Field(i).SetString(fn(out.Field(i).String()))
+		}
+	}
+	return out.Interface()
+}
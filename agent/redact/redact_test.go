@@ -0,0 +1,141 @@
+package redact
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+func compile(t *testing.T, rules ...structs.RedactRule) *Redactor {
+	t.Helper()
+	r, err := Compile(rules)
+	if err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	return r
+}
+
+func TestPresetMasksOnlyTheSecret(t *testing.T) {
+	r := compile(t, structs.RedactRule{Preset: "url_secrets"})
+
+	l := r.Apply(structs.Log{
+		Raw:    `10.0.0.1 - - [10/Oct/2024:13:55:36 +0000] "GET /login?user=bob&token=abc123 HTTP/1.1" 200 512`,
+		Parsed: map[string]interface{}{"request": "GET /login?user=bob&token=abc123 HTTP/1.1", "size": 512},
+	})
+
+	if strings.Contains(l.Raw, "abc123") {
+		t.Errorf("Token survived in raw: %s", l.Raw)
+	}
+	if !strings.Contains(l.Raw, "user=bob&token=[REDACTED]") {
+		t.Errorf("Expected only the token to be masked, got %s", l.Raw)
+	}
+	if got := l.Parsed.(map[string]interface{})["request"]; got != "GET /login?user=bob&token=[REDACTED] HTTP/1.1" {
+		t.Errorf("Token survived in parsed field: %v", got)
+	}
+}
+
+func TestSSHInvalidUser(t *testing.T) {
+	r := compile(t, structs.RedactRule{Preset: "ssh_invalid_user"})
+	l := r.Apply(structs.Log{Raw: "sshd[1]: Failed password for invalid user hunter2 from 10.0.0.9 port 22 ssh2"})
+	if strings.Contains(l.Raw, "hunter2") {
+		t.Errorf("Password typed as username survived: %s", l.Raw)
+	}
+}
+
+func TestHashIsStableAndSalted(t *testing.T) {
+	a := compile(t, structs.RedactRule{Preset: "password", Action: "hash", Salt: "one"})
+	b := compile(t, structs.RedactRule{Preset: "password", Action: "hash", Salt: "two"})
+
+	first := a.Apply(structs.Log{Raw: "password=hunter2"}).Raw
+	second := a.Apply(structs.Log{Raw: "password=hunter2"}).Raw
+	other := b.Apply(structs.Log{Raw: "password=hunter2"}).Raw
+
+	if strings.Contains(first, "hunter2") || !strings.HasPrefix(first, "password=hash:") {
+		t.Errorf("Expected hashed password, got %s", first)
+	}
+	if first != second {
+		t.Errorf("Expected equal secrets to hash the same, got %s and %s", first, second)
+	}
+	if first == other {
+		t.Error("Expected different salts to give different hashes")
+	}
+}
+
+func TestWholeFieldTruncate(t *testing.T) {
+	r := compile(t, structs.RedactRule{Fields: []string{"remote_user"}, Action: "truncate", Length: 2})
+
+	l := r.Apply(structs.Log{
+		Raw:    `10.0.0.1 - administrator [10/Oct/2024:13:55:36 +0000] "GET / HTTP/1.1" 200 1`,
+		Parsed: map[string]interface{}{"remote_user": "administrator", "remote": "10.0.0.1"},
+	})
+	fields := l.Parsed.(map[string]interface{})
+	if fields["remote_user"] != "ad..." {
+		t.Errorf("Expected truncated user, got %v", fields["remote_user"])
+	}
+	if fields["remote"] != "10.0.0.1" {
+		t.Errorf("Expected other fields untouched, got %v", fields["remote"])
+	}
+	if strings.Contains(l.Raw, "administrator") {
+		t.Errorf("Field value survived in raw: %s", l.Raw)
+	}
+}
+
+func TestEscapedValueInJournalRaw(t *testing.T) {
+	// journal entries keep their fields as JSON in the raw line, escaping the value there
+	secret := "pa\"ss\\word\nline2 <x>"
+	fields := map[string]string{"PASSWORD": secret, "MESSAGE": "token=" + secret}
+	raw, _ := json.MarshalIndent(fields, "", "  ")
+
+	for _, rule := range []structs.RedactRule{
+		{Fields: []string{"PASSWORD"}},
+		{Fields: []string{"MESSAGE"}, Pattern: `token=(.*)`},
+	} {
+		l := compile(t, rule).Apply(structs.Log{Raw: string(raw), Parsed: map[string]interface{}{"PASSWORD": secret, "MESSAGE": "token=" + secret}})
+		var decoded map[string]string
+		if err := json.Unmarshal([]byte(l.Raw), &decoded); err != nil {
+			t.Fatalf("Raw is no longer JSON with rule %+v: %v", rule, err)
+		}
+		field := rule.Fields[0]
+		masked := l.Parsed.(map[string]interface{})[field]
+		if strings.Contains(decoded[field], "pa\"ss") || decoded[field] != masked {
+			t.Errorf("Raw holds %s = %q, want the masked %q", field, decoded[field], masked)
+		}
+	}
+}
+
+func TestStructFields(t *testing.T) {
+	r := compile(t, structs.RedactRule{Preset: "bearer"})
+	entry := structs.SyslogPrettyEntry{Message: "sent Authorization: Bearer abcdefghijkl", Priority: 6}
+
+	l := r.Apply(structs.Log{Raw: entry.Message, Parsed: entry})
+	got := l.Parsed.(structs.SyslogPrettyEntry)
+	if strings.Contains(got.Message, "abcdefghijkl") {
+		t.Errorf("Token survived in struct field: %s", got.Message)
+	}
+	if entry.Message != "sent Authorization: Bearer abcdefghijkl" {
+		t.Error("Expected the original struct to be left alone")
+	}
+}
+
+func TestCompileRejectsBadRules(t *testing.T) {
+	bad := []structs.RedactRule{
+		{Preset: "nope"},
+		{Pattern: "("},
+		{},
+		{Preset: "password", Pattern: "x"},
+		{Preset: "password", Action: "hash"},
+		{Preset: "password", Action: "shred"},
+	}
+	for _, rule := range bad {
+		if _, err := Compile([]structs.RedactRule{rule}); err == nil {
+			t.Errorf("Expected an error for %+v", rule)
+		}
+	}
+	for name := range Presets {
+		if _, err := Compile([]structs.RedactRule{{Preset: name}}); err != nil {
+			t.Errorf("Preset %s doesn't compile: %v", name, err)
+		}
+	}
+}
@@ -1,22 +1,42 @@
 package main
 
 import (
-	"crypto/tls"
+	"cmp"
+	"context"
 	"fmt"
-	"github.com/TLop503/LogCrunch/agent/hemoglobin/modules"
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+	"github.com/TLop503/LogCrunch/agent/enroll"
+	"github.com/TLop503/LogCrunch/agent/identity"
+	"github.com/TLop503/LogCrunch/agent/spool"
+	"github.com/TLop503/LogCrunch/agent/supervisor"
+	"github.com/TLop503/LogCrunch/agent/transport"
+	"github.com/TLop503/LogCrunch/protocol"
 	"github.com/TLop503/LogCrunch/structs"
-	"gopkg.in/yaml.v3"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/TLop503/LogCrunch/agent/heartbeat"
-	"github.com/TLop503/LogCrunch/agent/hemoglobin"
 	"github.com/TLop503/LogCrunch/agent/utils"
 )
 
+// how long to keep sending queued logs on shutdown
+const drainTimeout = 10 * time.Second
+
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "enroll" {
+		enrollAgent(os.Args[2:])
+		return
+	}
+
 	if len(os.Args) < 5 {
 		fmt.Println("Usage: program <host> <port> <congfig file> <verify certs y/n")
+		fmt.Println("   or: program enroll <web ui url> <token> <ca sha256> [dir]")
 		return
 	}
 
@@ -27,55 +47,167 @@ func main() {
 	ISV := (os.Args[4] == "n")
 	//fmt.Println(ISV)
 
-	// Configure TLS
-	config := &tls.Config{InsecureSkipVerify: ISV} // Set to `false` in production with valid certs
-	// Connect to server
-	conn, err := tls.Dial("tcp", host+":"+port, config)
+	// Read log file paths from config file`
+	log.Println("Loading config file", cfg)
+	yamlConfig, err := supervisor.LoadConfig(cfg)
 	if err != nil {
-		log.Println("Error connecting to server:", err)
+		log.Fatalln("Error loading config file:", err)
 		return
 	}
-	defer conn.Close()
-	log.Printf("Connected to %s:%s via TLS\n", host, port)
+	log.Println("Successfully loaded config.")
+
+	// open the disk spool so logs survive server outages and agent restarts
+	sp, err := spool.Open(yamlConfig.Spool)
+	if err != nil {
+		log.Fatalln("Error opening spool:", err)
+	}
+	defer sp.Close()
+	pending, _, _ := sp.Stats()
+	log.Printf("Spool opened with %d unsent logs\n", pending)
+
+	// read offsets for tailed files, so restarts don't resend whole files
+	store, err := checkpoint.Open(yamlConfig.Checkpoints)
+	if err != nil {
+		log.Fatalln("Error opening checkpoint store:", err)
+	}
+
+	// the agent ID lives next to the checkpoints, so it survives restarts and upgrades
+	stateDir := cmp.Or(yamlConfig.Checkpoints.Dir, checkpoint.DefaultDir)
+	agentID, err := identity.LoadID(stateDir)
+	if err != nil {
+		log.Fatalln("Error loading agent ID:", err)
+	}
+	log.Printf("Agent %s, version %s\n", agentID, identity.Version)
+
+	// SIGINT/SIGTERM cancel ctx, which winds every reader down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// create channel for thread-safe writes
 	logChan := make(chan structs.Log)
 
-	// start the writer
-	go utils.TransmitJson(conn, logChan)
+	// everything read goes to disk first
+	spooled := make(chan struct{})
+	go func() {
+		utils.SpoolLogs(logChan, sp)
+		close(spooled)
+	}()
+
+	// start the writer, which (re)connects to the server on its own.
+	// It gets its own context so it can keep draining the spool after ctx is done.
+	sendCtx, stopSending := context.WithCancel(context.Background())
+	defer stopSending()
+	config, err := transport.TLSConfig(yamlConfig.TLS, ISV)
+	if err != nil {
+		log.Fatalln("Error setting up TLS:", err)
+	}
+	sup := supervisor.New(ctx, logChan, store)
+
+	// a profile from the server replaces the config file's targets and
+	// services. The last one is kept next to the checkpoints for restarts.
+	if err := sup.LoadProfile(filepath.Join(stateDir, "profile.json")); err != nil {
+		log.Println("Ignoring saved profile:", err)
+	}
+
+	// Start a hemoglobin instance for each target path, plus the systemd listener.
+	// The supervisor restarts them as the config file or profile changes.
+	log.Println("Loaded targets:", yamlConfig.Targets)
+	log.Println("Loaded Systemd Services:", yamlConfig.Services)
+	sup.Apply(yamlConfig)
+	if v := sup.ConfigVersion(); v != "" {
+		log.Println("Running saved profile", v)
+	}
+	go sup.Watch(cfg)
+
+	hello := func() protocol.Hello {
+		return identity.Hello(agentID, sup.Targets(), sup.Expected(), sup.ConfigVersion(), sup.ConfigError())
+	}
+	configChanged := make(chan struct{}, 1)
+	onProfile := func(p protocol.Profile) {
+		if err := sup.ApplyProfile(p); err != nil {
+			log.Printf("Rejecting profile %s from the server, keeping the running config: %v", p.Label(), err)
+		}
+		select {
+		case configChanged <- struct{}{}:
+		default: // one is already pending
+		}
+	}
+	conns := transport.NewManager(host+":"+port, config, sp, yamlConfig.Reconnect, yamlConfig.Transport, hello, onProfile)
+	sent := make(chan struct{})
+	go func() {
+		conns.Run(sendCtx)
+		close(sent)
+	}()
 
 	// spin up a heartbeat goroutine to send proof of life
 	// once every minute
-	go heartbeat.Heartbeat(logChan, utils.GetHostName())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		heartbeat.Heartbeat(ctx, logChan, utils.GetHostName(), heartbeat.Sources{
+			Spool:      sp,
+			ConfigHash: sup.ConfigHash,
+			Config:     func() (string, string) { return sup.ConfigVersion(), sup.ConfigError() },
+			Now:        configChanged,
+		})
+	}()
 
-	// Read log file paths from config file`
-	data, err := os.ReadFile(cfg)
-	if err != nil {
-		fmt.Errorf("Error reading config file: %v", err)
-		return
+	<-ctx.Done()
+	stop() // a second signal kills the agent outright
+	log.Println("Shutting down, press Ctrl+C again to force")
+
+	// stop every producer, saving checkpoints, then get what they read onto disk
+	sup.Stop()
+	wg.Wait()
+	close(logChan)
+	<-spooled
+
+	// give the writer a chance to send whatever is still queued
+	if remaining := drain(sp, drainTimeout); remaining > 0 {
+		log.Printf("Gave up draining after %v, %d logs stay spooled for next start\n", drainTimeout, remaining)
+	} else {
+		log.Println("All queued logs sent")
 	}
+	stopSending()
+	<-sent
+}
 
-	log.Println("Attempting to unmarshal config file...", string(data))
-	var yamlConfig structs.YamlConfig
-	err = yaml.Unmarshal(data, &yamlConfig)
-	if err != nil {
-		log.Fatalln("Error unmarshalling config file:", err)
-		return
+// drain waits until the spool is empty or timeout passes,
+// and returns how many logs are still unsent
+func drain(sp *spool.Spool, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		pending, _, _ := sp.Stats()
+		if pending == 0 || time.Now().After(deadline) {
+			return pending
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	log.Println("Successfully unmarshalled config.")
+}
 
-	// Start a hemoglobin instance for each target path
-	log.Println("Loaded targets:", yamlConfig.Targets)
-	log.Println("Starting to iterate and spawn hemoglobins")
-	for _, target := range yamlConfig.Targets {
-		go hemoglobin.ReadLog(logChan, target)
+// enrollAgent handles `enroll <web ui url> <token> <ca sha256> [dir]`,
+// getting a client certificate from the server for this host
+func enrollAgent(args []string) {
+	if len(args) < 3 {
+		fmt.Println("Usage: program enroll <web ui url> <token> <ca sha256> [dir]")
+		return
+	}
+	dir := enroll.DefaultDir
+	if len(args) >= 4 {
+		dir = args[3]
+	}
+	if strings.HasPrefix(args[0], "http://") {
+		log.Println("Enrolling over plain HTTP, the token can be read on the way; use https where the web UI is reachable over untrusted networks")
 	}
 
-	// listen to systemd log api
-	log.Println("Loaded Systemd Services:", yamlConfig.Services)
-	log.Println("Starting to spawn systemd listener")
-	modules.ListenToSystemd(logChan, yamlConfig.Services)
+	name := utils.GetHostName()
+	files, err := enroll.Enroll(args[0], args[1], args[2], name, dir)
+	if err != nil {
+		log.Fatalln("Error enrolling:", err)
+	}
 
-	// TODO: Add graceful shutdowns
-	select {}
+	fmt.Printf("Enrolled as %s, with the CA %s\n", name, files.CAFingerprint)
+	fmt.Println("An admin has to approve this agent before it can connect. Add this to the config:")
+	fmt.Printf("TLS:\n  ca_bundle: %s\n  cert: %s\n  key: %s\n", files.CABundle, files.Cert, files.Key)
 }
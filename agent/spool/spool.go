@@ -0,0 +1,515 @@
+package spool
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+/*
+	The spool is an on-disk FIFO that sits between logChan and the transmitter.
+	Logs are appended as JSON lines to numbered segment files, and a small cursor
+	file remembers how far the transmitter has gotten. If the agent crashes or the
+	server goes away, everything after the cursor is replayed in order.
+*/
+
+// Policy decides what to throw away once the spool hits its size cap
+type Policy string
+
+const (
+	DropOldest Policy = "drop-oldest" // delete the oldest segment to make room
+	DropNewest Policy = "drop-newest" // refuse incoming logs until there is room
+)
+
+const (
+	DefaultDir      = "/opt/LogCrunch/agent/spool"
+	DefaultMaxBytes = 64 << 20 // 64 MiB
+
+	segmentSuffix = ".seg"
+	cursorFile    = "cursor"
+	syncInterval  = time.Second
+)
+
+// ErrFull is returned by Put when the spool is full and the policy is DropNewest
+var ErrFull = errors.New("spool is full")
+
+// ErrClosed is returned once the spool has been closed
+var ErrClosed = errors.New("spool is closed")
+
+type segment struct {
+	id      uint64
+	size    int64
+	records int
+}
+
+// cursor is the persisted commit point
+type cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Records int    `json:"records"`
+}
+
+// position is a location in the spool, used for both the read and commit points
+type position struct {
+	idx     int   // index into Spool.segments
+	offset  int64 // byte offset within that segment
+	records int   // records before offset within that segment
+}
+
+// Spool is a bounded, crash-safe disk queue of logs
+type Spool struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	segMax   int64
+	policy   Policy
+
+	segments []*segment // oldest first, the last one is being written to
+	writer   *os.File
+	size     int64 // bytes on disk across all segments
+
+	commit position
+	read   position
+	reader *bufio.Reader
+	rfile  *os.File
+
+	dropped     uint64
+	lastSync    time.Time
+	lastPersist time.Time
+	dirty       bool // commit point moved since it was last persisted
+	closed      bool
+	notify      chan struct{}
+}
+
+// Open opens (or creates) a spool described by cfg, applying defaults
+// for anything left blank. Unsent logs from a previous run are kept.
+func Open(cfg structs.SpoolConfig) (*Spool, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultDir
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultMaxBytes
+	}
+	policy := Policy(cfg.Policy)
+	switch policy {
+	case "":
+		policy = DropOldest
+	case DropOldest, DropNewest:
+	default:
+		return nil, fmt.Errorf("unknown spool policy %q", cfg.Policy)
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+
+	s := &Spool{
+		dir:      cfg.Dir,
+		maxBytes: cfg.MaxBytes,
+		segMax:   max(cfg.MaxBytes/8, 1),
+		policy:   policy,
+		notify:   make(chan struct{}, 1),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load rebuilds the in-memory view of the spool from disk
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var cur cursor
+	data, err := os.ReadFile(filepath.Join(s.dir, cursorFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &cur); err != nil {
+			log.Printf("Spool cursor is corrupt, replaying everything: %v", err)
+			cur = cursor{}
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read spool cursor: %w", err)
+	}
+
+	for _, id := range ids {
+		if id < cur.Segment {
+			// fully delivered before we went down
+			os.Remove(s.segmentPath(id))
+			continue
+		}
+		seg := &segment{id: id}
+		if err := s.scan(seg); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+	}
+
+	if len(s.segments) > 0 && s.segments[0].id == cur.Segment && cur.Offset <= s.segments[0].size {
+		s.commit = position{offset: cur.Offset, records: cur.Records}
+	}
+
+	// always write into a fresh segment so a torn tail from a crash stays isolated
+	next := uint64(1)
+	if n := len(s.segments); n > 0 {
+		next = s.segments[n-1].id + 1
+	}
+	if err := s.openSegment(next); err != nil {
+		return err
+	}
+
+	s.read = s.commit
+	return s.openReader()
+}
+
+// scan counts the records and bytes in a segment file
+func (s *Spool) scan(seg *segment) error {
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		seg.size += int64(len(line))
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			seg.records++
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scan spool segment: %w", err)
+		}
+	}
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// openSegment starts a new segment and makes it the write target
+func (s *Spool) openSegment(id uint64) error {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %w", err)
+	}
+	if s.writer != nil {
+		s.writer.Sync()
+		s.writer.Close()
+	}
+	s.writer = f
+	s.segments = append(s.segments, &segment{id: id})
+	return nil
+}
+
+// openReader (re)opens the read handle at the current read position
+func (s *Spool) openReader() error {
+	if s.rfile != nil {
+		s.rfile.Close()
+		s.rfile = nil
+	}
+	f, err := os.Open(s.segmentPath(s.segments[s.read.idx].id))
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment for reading: %w", err)
+	}
+	if _, err := f.Seek(s.read.offset, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to seek spool segment: %w", err)
+	}
+	s.rfile = f
+	s.reader = bufio.NewReader(f)
+	return nil
+}
+
+// Put appends a log to the spool. With the DropNewest policy ErrFull is
+// returned when there is no room; with DropOldest the oldest segment is
+// discarded instead. Logs without an ID are given one here, so every
+// replay of a log carries the same ID.
+func (s *Spool) Put(l structs.Log) error {
+	if l.ID == "" {
+		l.ID = newID()
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log for spool: %w", err)
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if int64(len(data)) > s.maxBytes {
+		s.dropped++
+		return ErrFull
+	}
+
+	for s.size+int64(len(data)) > s.maxBytes {
+		if s.policy == DropNewest {
+			s.dropped++
+			return ErrFull
+		}
+		if err := s.dropOldest(); err != nil {
+			return err
+		}
+	}
+
+	tail := s.segments[len(s.segments)-1]
+	if tail.size >= s.segMax {
+		if err := s.openSegment(tail.id + 1); err != nil {
+			return err
+		}
+		tail = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write to spool: %w", err)
+	}
+	tail.size += int64(len(data))
+	tail.records++
+	s.size += int64(len(data))
+
+	if time.Since(s.lastSync) >= syncInterval {
+		s.writer.Sync()
+		s.lastSync = time.Now()
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// newID returns a random 128-bit log ID
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// dropOldest deletes the oldest segment, moving the read and commit
+// points forward if they were inside it. Caller must hold s.mu.
+func (s *Spool) dropOldest() error {
+	if len(s.segments) == 1 {
+		// the only segment is the one being written, start a new one first
+		if err := s.openSegment(s.segments[0].id + 1); err != nil {
+			return err
+		}
+	}
+
+	oldest := s.segments[0]
+	lost := oldest.records - s.commit.records
+	if lost > 0 {
+		s.dropped += uint64(lost)
+	}
+
+	os.Remove(s.segmentPath(oldest.id))
+	s.segments = s.segments[1:]
+	s.size -= oldest.size
+	s.commit = position{}
+	s.dirty = true
+
+	if s.read.idx == 0 {
+		s.read = position{}
+		return s.openReader()
+	}
+	s.read.idx--
+	return nil
+}
+
+// Next blocks until a log is available (or ctx is done) and returns it.
+// The log stays in the spool until Commit is called.
+func (s *Spool) Next(ctx context.Context) (structs.Log, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return structs.Log{}, ErrClosed
+		}
+		l, ok, err := s.readOne()
+		s.mu.Unlock()
+		if err != nil {
+			return structs.Log{}, err
+		}
+		if ok {
+			return l, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return structs.Log{}, ctx.Err()
+		case <-s.notify:
+		}
+	}
+}
+
+// readOne reads the next unread record, if any. Caller must hold s.mu.
+func (s *Spool) readOne() (structs.Log, bool, error) {
+	for {
+		seg := s.segments[s.read.idx]
+		if s.read.records >= seg.records {
+			if s.read.idx == len(s.segments)-1 {
+				return structs.Log{}, false, nil
+			}
+			s.read = position{idx: s.read.idx + 1}
+			if err := s.openReader(); err != nil {
+				return structs.Log{}, false, err
+			}
+			continue
+		}
+
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			return structs.Log{}, false, fmt.Errorf("failed to read from spool: %w", err)
+		}
+		s.read.offset += int64(len(line))
+		s.read.records++
+
+		var l structs.Log
+		if err := json.Unmarshal(line, &l); err != nil {
+			log.Printf("Skipping corrupt spool record: %v", err)
+			continue
+		}
+		return l, true, nil
+	}
+}
+
+// Commit marks everything returned by Next so far as delivered
+func (s *Spool) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// segments before the read position are fully delivered
+	for s.read.idx > 0 {
+		oldest := s.segments[0]
+		os.Remove(s.segmentPath(oldest.id))
+		s.segments = s.segments[1:]
+		s.size -= oldest.size
+		s.read.idx--
+	}
+	s.commit = s.read
+	s.dirty = true
+
+	if time.Since(s.lastPersist) >= syncInterval {
+		return s.persist()
+	}
+	return nil
+}
+
+// Rewind moves the read position back to the last commit, so that
+// anything handed out by Next but never committed is sent again
+func (s *Spool) Rewind() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	s.read = s.commit
+	return s.openReader()
+}
+
+// persist writes the commit point to disk. Caller must hold s.mu.
+func (s *Spool) persist() error {
+	if !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(cursor{
+		Segment: s.segments[0].id,
+		Offset:  s.commit.offset,
+		Records: s.commit.records,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(s.dir, cursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write spool cursor: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write spool cursor: %w", err)
+	}
+	f.Sync()
+	f.Close()
+	if err := os.Rename(tmp, filepath.Join(s.dir, cursorFile)); err != nil {
+		return fmt.Errorf("failed to replace spool cursor: %w", err)
+	}
+
+	s.dirty = false
+	s.lastPersist = time.Now()
+	return nil
+}
+
+// Stats reports the number of undelivered logs, bytes on disk, and logs
+// dropped because the spool was full
+func (s *Spool) Stats() (pending int, bytes int64, dropped uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		pending += seg.records
+	}
+	pending -= s.commit.records
+	return pending, s.size, s.dropped
+}
+
+// Close flushes the spool to disk and releases its files
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.notify) // wake anyone blocked in Next
+	err := s.persist()
+	s.writer.Sync()
+	s.writer.Close()
+	if s.rfile != nil {
+		s.rfile.Close()
+	}
+	return err
+}
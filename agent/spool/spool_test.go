@@ -0,0 +1,191 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// -- Helpers --
+
+func makeLog(i int) structs.Log {
+	return structs.Log{
+		Name:      "test",
+		Path:      "/var/log/test.log",
+		Host:      "testhost",
+		Timestamp: int64(i),
+		Module:    "syslog",
+		Raw:       "line " + strconv.Itoa(i),
+	}
+}
+
+func openSpool(t *testing.T, dir string, maxBytes int64, policy Policy) *Spool {
+	t.Helper()
+	s, err := Open(structs.SpoolConfig{Dir: dir, MaxBytes: maxBytes, Policy: string(policy)})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return s
+}
+
+func nextRaw(t *testing.T, s *Spool) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	l, err := s.Next(ctx)
+	if err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	return l.Raw
+}
+
+// -- Tests --
+
+func TestSpoolReplaysInOrderAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openSpool(t, dir, 1<<20, DropOldest)
+	for i := 0; i < 5; i++ {
+		if err := s.Put(makeLog(i)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// deliver the first two, then "crash"
+	for i := 0; i < 2; i++ {
+		if got := nextRaw(t, s); got != "line "+strconv.Itoa(i) {
+			t.Fatalf("Expected line %d, got %q", i, got)
+		}
+	}
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	nextRaw(t, s) // read but never committed
+	s.Close()
+
+	s = openSpool(t, dir, 1<<20, DropOldest)
+	defer s.Close()
+
+	pending, _, _ := s.Stats()
+	if pending != 3 {
+		t.Errorf("Expected 3 pending logs, got %d", pending)
+	}
+	for i := 2; i < 5; i++ {
+		if got := nextRaw(t, s); got != "line "+strconv.Itoa(i) {
+			t.Errorf("Expected line %d, got %q", i, got)
+		}
+	}
+}
+
+func TestSpoolRewind(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 1<<20, DropOldest)
+	defer s.Close()
+
+	s.Put(makeLog(0))
+	s.Put(makeLog(1))
+
+	nextRaw(t, s)
+	nextRaw(t, s)
+	if err := s.Rewind(); err != nil {
+		t.Fatalf("Rewind failed: %v", err)
+	}
+
+	if got := nextRaw(t, s); got != "line 0" {
+		t.Errorf("Expected line 0 after rewind, got %q", got)
+	}
+}
+
+func TestSpoolKeepsIDsAcrossReplays(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 1<<20, DropOldest)
+	defer s.Close()
+
+	s.Put(makeLog(0))
+	s.Put(makeLog(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	first, _ := s.Next(ctx)
+	second, _ := s.Next(ctx)
+	if first.ID == "" || first.ID == second.ID {
+		t.Fatalf("Expected distinct IDs, got %q and %q", first.ID, second.ID)
+	}
+
+	s.Rewind()
+	again, err := s.Next(ctx)
+	if err != nil {
+		t.Fatalf("Next failed: %v", err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("Expected a replayed log to keep ID %q, got %q", first.ID, again.ID)
+	}
+}
+
+func TestSpoolDropNewest(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 512, DropNewest)
+	defer s.Close()
+
+	var err error
+	puts := 0
+	for err == nil {
+		err = s.Put(makeLog(puts))
+		puts++
+	}
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("Expected ErrFull, got %v", err)
+	}
+
+	// the oldest log must still be there
+	if got := nextRaw(t, s); got != "line 0" {
+		t.Errorf("Expected line 0 to survive, got %q", got)
+	}
+	_, _, dropped := s.Stats()
+	if dropped != 1 {
+		t.Errorf("Expected 1 dropped log, got %d", dropped)
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 1024, DropOldest)
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := s.Put(makeLog(i)); err != nil {
+			t.Fatalf("Put %d failed: %v", i, err)
+		}
+	}
+
+	_, size, dropped := s.Stats()
+	if size > 1024 {
+		t.Errorf("Spool grew past its cap: %d bytes", size)
+	}
+	if dropped == 0 {
+		t.Error("Expected old logs to be dropped")
+	}
+	if got := nextRaw(t, s); got == "line 0" {
+		t.Error("Expected line 0 to have been dropped")
+	}
+}
+
+func TestSpoolNextBlocksUntilPut(t *testing.T) {
+	s := openSpool(t, t.TempDir(), 1<<20, DropOldest)
+	defer s.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Put(makeLog(7))
+	}()
+
+	if got := nextRaw(t, s); got != "line 7" {
+		t.Errorf("Expected line 7, got %q", got)
+	}
+}
+
+func TestOpenInvalidPolicy(t *testing.T) {
+	_, err := Open(structs.SpoolConfig{Dir: t.TempDir(), Policy: "drop-everything"})
+	if err == nil {
+		t.Fatal("Expected error for invalid policy, got nil")
+	}
+}
@@ -0,0 +1,34 @@
+package stats
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Process returns the agent's resident memory and the CPU time it has used so far
+func Process() (rss int64, cpu time.Duration, err error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0, fmt.Errorf("failed to read CPU usage: %w", err)
+	}
+	cpu = time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+
+	// the second field of statm is the resident set, in pages
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, cpu, fmt.Errorf("failed to read memory usage: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, cpu, fmt.Errorf("unexpected /proc/self/statm: %q", data)
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, cpu, fmt.Errorf("unexpected /proc/self/statm: %w", err)
+	}
+	return pages * int64(os.Getpagesize()), cpu, nil
+}
@@ -0,0 +1,103 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter keeps a running total per name. It is safe for concurrent use.
+type Counter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+// Add adds n to name's total
+func (c *Counter) Add(name string, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]uint64)
+	}
+	c.counts[name] += n
+}
+
+// Snapshot returns a copy of every total
+func (c *Counter) Snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make(map[string]uint64, len(c.counts))
+	for name, n := range c.counts {
+		out[name] = n
+	}
+	return out
+}
+
+// Per target or service name, cumulative since the agent started:
+var (
+	Read     Counter // lines (or multiline events) read
+	Parsed   Counter // of those, parsed by the target's module
+	Failed   Counter // of those, the module couldn't parse
+	Filtered Counter // dropped by filter rules
+)
+
+// ErrorReport is the most recent error a reader ran into
+type ErrorReport struct {
+	Message string `json:"message"`
+	Time    int64  `json:"time"`
+}
+
+// LastErrors keeps the latest error per name. It is safe for concurrent use.
+type LastErrors struct {
+	mu     sync.Mutex
+	errors map[string]ErrorReport
+}
+
+// Set records err as name's latest error
+func (e *LastErrors) Set(name string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.errors == nil {
+		e.errors = make(map[string]ErrorReport)
+	}
+	e.errors[name] = ErrorReport{Message: err.Error(), Time: time.Now().Unix()}
+}
+
+// Snapshot returns a copy of every latest error
+func (e *LastErrors) Snapshot() map[string]ErrorReport {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := make(map[string]ErrorReport, len(e.errors))
+	for name, r := range e.errors {
+		out[name] = r
+	}
+	return out
+}
+
+// Errors holds the latest error of each target or service reader
+var Errors LastErrors
+
+// TransportStats tracks what has been sent to the server, before and after compression
+type TransportStats struct {
+	Raw   atomic.Int64 // bytes of JSON written
+	Wire  atomic.Int64 // bytes that hit the connection
+	codec atomic.Value
+}
+
+// SetCodec records the compression negotiated for the current connection
+func (t *TransportStats) SetCodec(codec string) {
+	t.codec.Store(codec)
+}
+
+// Codec returns the compression negotiated for the current connection
+func (t *TransportStats) Codec() string {
+	codec, _ := t.codec.Load().(string)
+	return codec
+}
+
+// Transport counts bytes sent across every connection since the agent started
+var Transport TransportStats
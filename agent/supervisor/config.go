@@ -0,0 +1,114 @@
+package supervisor
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/TLop503/LogCrunch/agent/filter"
+	"github.com/TLop503/LogCrunch/agent/hemoglobin"
+	"github.com/TLop503/LogCrunch/agent/redact"
+	"github.com/TLop503/LogCrunch/agent/spool"
+	"github.com/TLop503/LogCrunch/agent/transport"
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig reads and validates the agent config at path
+func LoadConfig(path string) (structs.YamlConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return structs.YamlConfig{}, fmt.Errorf("error reading config file: %w", err)
+	}
+	return ParseConfig(data)
+}
+
+// ParseConfig unmarshals and validates an agent config
+func ParseConfig(data []byte) (structs.YamlConfig, error) {
+	var cfg structs.YamlConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return structs.YamlConfig{}, fmt.Errorf("error unmarshalling config file: %w", err)
+	}
+	if err := Validate(cfg); err != nil {
+		return structs.YamlConfig{}, err
+	}
+	return cfg, nil
+}
+
+// Validate rejects configs that would fail once the agent tried to use them
+func Validate(cfg structs.YamlConfig) error {
+	names := make(map[string]bool)
+	for _, target := range cfg.Targets {
+		if err := hemoglobin.ValidateTarget(target); err != nil {
+			return err
+		}
+		// targets are tracked by name across reloads, so names must be unique
+		if names[target.Name] {
+			return fmt.Errorf("duplicate target name %q", target.Name)
+		}
+		names[target.Name] = true
+		if target.ExpectEvery < 0 {
+			return fmt.Errorf("target %s: negative expect_every", target.Name)
+		}
+	}
+
+	for _, service := range cfg.Services {
+		if service.Key == "" {
+			return fmt.Errorf("service %q has no key", service.Name)
+		}
+		if _, err := structs.ParseSeverity(service.Severity); err != nil {
+			return fmt.Errorf("service %s: %w", service.Name, err)
+		}
+		if _, err := filter.Compile(service.Filters); err != nil {
+			return fmt.Errorf("service %s: %w", service.Name, err)
+		}
+		if _, err := redact.Compile(service.Redact); err != nil {
+			return fmt.Errorf("service %s: %w", service.Name, err)
+		}
+		if service.ExpectEvery < 0 {
+			return fmt.Errorf("service %s: negative expect_every", service.Name)
+		}
+	}
+
+	if _, err := redact.Compile(cfg.Redact); err != nil {
+		return fmt.Errorf("global %w", err)
+	}
+	// global rules apply to server_parse targets too, which have no fields to mask
+	for _, target := range cfg.Targets {
+		if !target.ServerParse {
+			continue
+		}
+		if err := hemoglobin.CheckRawOnlyRedact(cfg.Redact); err != nil {
+			return fmt.Errorf("global Redact with server_parse target %s: %w", target.Name, err)
+		}
+	}
+
+	switch cfg.Journal.Start {
+	case "", "head", "tail":
+	default:
+		return fmt.Errorf("unknown journal start %q, expected head or tail", cfg.Journal.Start)
+	}
+
+	for _, codec := range cfg.Transport.Compression {
+		if !protocol.Valid(codec) {
+			return fmt.Errorf("unknown compression %q, expected zstd, gzip or none", codec)
+		}
+	}
+
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		return fmt.Errorf("TLS cert and key must be set together")
+	}
+	for _, pin := range cfg.TLS.PinnedSHA256 {
+		if _, err := transport.ParsePin(pin); err != nil {
+			return err
+		}
+	}
+
+	switch spool.Policy(cfg.Spool.Policy) {
+	case "", spool.DropOldest, spool.DropNewest:
+	default:
+		return fmt.Errorf("unknown spool policy %q", cfg.Spool.Policy)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// withProfile merges a profile from the server into the config file: its
+// targets and services replace the file's, and its redaction rules apply
+// after the file's, so a profile can't loosen what a host masks. The result
+// is validated like a config file.
+func withProfile(local structs.YamlConfig, p protocol.Profile) (structs.YamlConfig, error) {
+	if p.Name == "" {
+		return local, nil
+	}
+	pc, err := p.Parse()
+	if err != nil {
+		return local, err
+	}
+	merged := local
+	merged.Targets, merged.Services = pc.Targets, pc.Services
+	merged.Redact = append(slices.Clone(local.Redact), pc.Redact...)
+	if err := Validate(merged); err != nil {
+		return local, fmt.Errorf("profile %s: %w", p.Label(), err)
+	}
+	return merged, nil
+}
+
+// ApplyProfile runs a profile the server sent in place of the config file's
+// targets and services, and saves it so the agent starts with it next time.
+// A profile without a name goes back to the config file. Invalid profiles
+// are rejected and the running config is kept.
+func (s *Supervisor) ApplyProfile(p protocol.Profile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p == s.profile && s.running == p.Label() {
+		return nil
+	}
+	merged, err := withProfile(s.local, p)
+	if err != nil {
+		s.profileErr = err.Error()
+		return err
+	}
+
+	if p.Name == "" {
+		log.Printf("Profile %s unassigned, running the config file", s.profile.Label())
+	} else {
+		log.Printf("Running profile %s from the server", p.Label())
+	}
+	s.profile, s.running, s.profileErr = p, p.Label(), ""
+	s.apply(merged)
+
+	if err := s.saveProfile(); err != nil {
+		log.Printf("Error saving profile: %v", err)
+	}
+	return nil
+}
+
+// LoadProfile restores the profile saved at path, so a restarted agent runs
+// it before the server is reachable, and saves profiles applied later there.
+// Call it before the first Apply. A missing file means no profile.
+func (s *Supervisor) LoadProfile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.profilePath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read saved profile: %w", err)
+	}
+	var p protocol.Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("failed to decode saved profile: %w", err)
+	}
+	s.profile = p
+	return nil
+}
+
+// saveProfile writes the profile to profilePath. Caller must hold s.mu.
+func (s *Supervisor) saveProfile() error {
+	if s.profilePath == "" {
+		return nil
+	}
+	if s.profile.Name == "" {
+		if err := os.Remove(s.profilePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(s.profile)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.profilePath), 0o700); err != nil {
+		return err
+	}
+	tmp := s.profilePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.profilePath)
+}
+
+// ConfigVersion is the Label of the profile the agent runs, empty when it
+// runs its config file alone
+func (s *Supervisor) ConfigVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// ConfigError says why the last profile from the server was rejected, if it was
+func (s *Supervisor) ConfigError() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.profileErr
+}
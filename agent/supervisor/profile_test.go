@@ -0,0 +1,119 @@
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// catchAllProfile is a profile with one catch-all target
+func catchAllProfile(version int64, name, path string) protocol.Profile {
+	return protocol.Profile{Name: "web", Version: version, Config: fmt.Sprintf(`
+Targets:
+  - name: %s
+    path: %s
+    custom: true
+    module: catch_all
+    regex: '^(?P<message>.*)$'
+    schema: {message: string}
+`, name, path)}
+}
+
+func TestApplyProfileReplacesTargets(t *testing.T) {
+	dir := t.TempDir()
+	store, err := checkpoint.Open(structs.CheckpointConfig{Dir: filepath.Join(dir, "state")})
+	if err != nil {
+		t.Fatalf("checkpoint.Open failed: %v", err)
+	}
+	a := filepath.Join(dir, "a.log")
+	b := filepath.Join(dir, "b.log")
+	appendLine(t, a, "a1")
+	appendLine(t, b, "b1")
+	saved := filepath.Join(dir, "state", "profile.json")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logChan := make(chan structs.Log, 16)
+	sup := New(ctx, logChan, store)
+	defer sup.Stop()
+	if err := sup.LoadProfile(saved); err != nil {
+		t.Fatalf("LoadProfile failed: %v", err)
+	}
+
+	local := structs.YamlConfig{Targets: []structs.Target{catchAll("A", a)}}
+	sup.Apply(local)
+	expectLog(t, logChan, "a1")
+
+	// the profile's target runs instead of the config file's
+	if err := sup.ApplyProfile(catchAllProfile(1, "B", b)); err != nil {
+		t.Fatalf("ApplyProfile failed: %v", err)
+	}
+	expectLog(t, logChan, "b1")
+	appendLine(t, a, "a2")
+	select {
+	case l := <-logChan:
+		t.Fatalf("Expected the config file's target to be stopped, got %q", l.Raw)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if v := sup.ConfigVersion(); v != "web@1" {
+		t.Errorf("Expected to run web@1, got %q", v)
+	}
+
+	// a broken profile is turned down and the last one keeps running
+	bad := protocol.Profile{Name: "web", Version: 2, Config: "Targets:\n  - {name: X, path: /tmp/x, module: nope}\n"}
+	if err := sup.ApplyProfile(bad); err == nil {
+		t.Fatal("Expected a profile with an unknown module to be rejected")
+	}
+	if sup.ConfigVersion() != "web@1" || sup.ConfigError() == "" {
+		t.Errorf("Expected web@1 to keep running with an error, got %q, %q", sup.ConfigVersion(), sup.ConfigError())
+	}
+	appendLine(t, b, "b2")
+	expectLog(t, logChan, "b2")
+
+	// so is one whose server_parse target only masks fields it never has
+	unmasked := protocol.Profile{Name: "web", Version: 3, Config: "Targets:\n  - {name: X, path: /tmp/x, module: app, server_parse: true, redact: [{fields: [password]}]}\n"}
+	if err := sup.ApplyProfile(unmasked); err == nil {
+		t.Fatal("Expected a profile with field redaction on a server_parse target to be rejected")
+	}
+	// and one adding a server_parse target to a host that masks fields globally
+	masking := structs.YamlConfig{Redact: []structs.RedactRule{{Fields: []string{"password"}}}}
+	plain := protocol.Profile{Name: "web", Version: 4, Config: "Targets:\n  - {name: X, path: /tmp/x, module: app, server_parse: true}\n"}
+	if _, err := withProfile(masking, plain); err == nil {
+		t.Error("Expected a server_parse target under global field redaction to be rejected")
+	}
+
+	// a restarted agent starts with the saved profile
+	sup.Stop()
+	sup = New(ctx, logChan, store)
+	if err := sup.LoadProfile(saved); err != nil {
+		t.Fatalf("LoadProfile failed: %v", err)
+	}
+	sup.Apply(local)
+	if v := sup.ConfigVersion(); v != "web@1" {
+		t.Errorf("Expected the saved profile to be restored, got %q", v)
+	}
+	appendLine(t, b, "b3")
+	expectLog(t, logChan, "b3")
+
+	// taking the profile away goes back to the config file
+	if err := sup.ApplyProfile(protocol.Profile{}); err != nil {
+		t.Fatalf("ApplyProfile failed: %v", err)
+	}
+	appendLine(t, a, "a3")
+	expectLog(t, logChan, "a2") // A resumes from its checkpoint
+	expectLog(t, logChan, "a3")
+	if v := sup.ConfigVersion(); v != "" {
+		t.Errorf("Expected to run the config file, got %q", v)
+	}
+	if _, err := os.Stat(saved); !os.IsNotExist(err) {
+		t.Errorf("Expected the saved profile to be removed, got %v", err)
+	}
+	sup.Stop()
+}
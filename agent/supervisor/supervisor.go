@@ -0,0 +1,304 @@
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+	"github.com/TLop503/LogCrunch/agent/hemoglobin"
+	"github.com/TLop503/LogCrunch/agent/hemoglobin/modules"
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+	"gopkg.in/yaml.v3"
+)
+
+// how often the config file is checked for changes
+const watchInterval = 5 * time.Second
+
+// worker is a running reader that can be stopped
+type worker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stop cancels the worker and waits for it to exit
+func (w *worker) stop() {
+	w.cancel()
+	<-w.done
+}
+
+// Supervisor runs a hemoglobin for every target plus the journal listener,
+// and reconciles them against new configs without restarting the agent
+type Supervisor struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	logChan chan<- structs.Log
+	store   *checkpoint.Store
+
+	current structs.YamlConfig // what runs: the config file with the profile merged in
+	local   structs.YamlConfig // the config file
+
+	profile     protocol.Profile // from the server, see profile.go
+	running     string           // Label of the profile in current, empty if none
+	profileErr  string           // why the last profile was rejected
+	profilePath string           // where profiles are saved, empty to not save them
+
+	targets map[string]*worker // by target name
+	journal *worker
+	stopped bool
+}
+
+// New creates a supervisor. Everything it starts stops when ctx is done.
+func New(ctx context.Context, logChan chan<- structs.Log, store *checkpoint.Store) *Supervisor {
+	return &Supervisor{
+		ctx:     ctx,
+		logChan: logChan,
+		store:   store,
+		targets: make(map[string]*worker),
+	}
+}
+
+// spawn runs fn in a goroutine under a child context
+func (s *Supervisor) spawn(fn func(ctx context.Context)) *worker {
+	ctx, cancel := context.WithCancel(s.ctx)
+	w := &worker{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		fn(ctx)
+	}()
+	return w
+}
+
+// Apply runs cfg, the agent's config file, with the server's profile if it
+// has one. A profile that no longer fits with cfg is set aside until the
+// server sends another.
+func (s *Supervisor) Apply(cfg structs.YamlConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.local = cfg
+	merged, err := withProfile(cfg, s.profile)
+	if err != nil {
+		log.Printf("Running the config file without profile %s: %v", s.profile.Label(), err)
+		s.profileErr = err.Error()
+		merged = cfg
+		s.running = ""
+	} else {
+		s.running = s.profile.Label()
+	}
+	s.apply(merged)
+}
+
+// apply diffs cfg against the running config: removed targets are stopped,
+// new ones started, and changed ones restarted. Untouched targets keep running.
+// Caller must hold s.mu.
+func (s *Supervisor) apply(cfg structs.YamlConfig) {
+	if s.stopped {
+		return
+	}
+	cfg = withGlobalRedaction(cfg)
+
+	old := make(map[string]structs.Target)
+	for _, t := range s.current.Targets {
+		old[t.Name] = t
+	}
+	wanted := make(map[string]bool)
+	for _, t := range cfg.Targets {
+		wanted[t.Name] = true
+	}
+
+	for name, w := range s.targets {
+		if !wanted[name] {
+			log.Printf("Stopping removed target %s", name)
+			w.stop()
+			delete(s.targets, name)
+		}
+	}
+
+	for _, target := range cfg.Targets {
+		prev, existed := old[target.Name]
+		if existed && reflect.DeepEqual(prev, target) {
+			continue
+		}
+		if w, running := s.targets[target.Name]; running {
+			log.Printf("Restarting changed target %s", target.Name)
+			w.stop()
+		} else {
+			log.Printf("Starting target %s (%s)", target.Name, target.Path)
+		}
+		target := target
+		s.targets[target.Name] = s.spawn(func(ctx context.Context) {
+			hemoglobin.ReadLog(ctx, s.logChan, target, s.store)
+		})
+	}
+
+	if s.journal == nil || !reflect.DeepEqual(s.current.Services, cfg.Services) || s.current.Journal != cfg.Journal {
+		if s.journal != nil {
+			log.Println("Systemd services changed, restarting journal listener")
+			s.journal.stop()
+		}
+		services, journalCfg := cfg.Services, cfg.Journal
+		s.journal = s.spawn(func(ctx context.Context) {
+			modules.ListenToSystemd(ctx, s.logChan, services, s.store, journalCfg)
+		})
+	}
+
+	if s.current.Spool != cfg.Spool || s.current.Reconnect != cfg.Reconnect || s.current.Checkpoints != cfg.Checkpoints ||
+		!reflect.DeepEqual(s.current.Transport, cfg.Transport) || !reflect.DeepEqual(s.current.TLS, cfg.TLS) {
+		if len(s.current.Targets) > 0 || len(s.current.Services) > 0 {
+			log.Println("Spool, Reconnect, Transport, TLS and Checkpoints changes only take effect after an agent restart")
+		}
+	}
+
+	s.current = cfg
+}
+
+// withGlobalRedaction puts the config-wide Redact rules in front of every
+// target's and service's own, so a change to them restarts everything it affects
+func withGlobalRedaction(cfg structs.YamlConfig) structs.YamlConfig {
+	if len(cfg.Redact) == 0 {
+		return cfg
+	}
+
+	targets := make([]structs.Target, len(cfg.Targets))
+	for i, t := range cfg.Targets {
+		t.Redact = append(append([]structs.RedactRule{}, cfg.Redact...), t.Redact...)
+		targets[i] = t
+	}
+	services := make([]structs.Service, len(cfg.Services))
+	for i, svc := range cfg.Services {
+		svc.Redact = append(append([]structs.RedactRule{}, cfg.Redact...), svc.Redact...)
+		services[i] = svc
+	}
+	cfg.Targets, cfg.Services = targets, services
+	return cfg
+}
+
+// Targets lists the names of the running targets and systemd services
+func (s *Supervisor) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for _, t := range s.current.Targets {
+		names = append(names, t.Name)
+	}
+	for _, svc := range s.current.Services {
+		names = append(names, svc.Name)
+	}
+	return names
+}
+
+// Expected returns how often each running target and service should produce
+// a log, keyed by the name its logs carry. Ones without expect_every are left out.
+func (s *Supervisor) Expected() map[string]time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expect := make(map[string]time.Duration)
+	for _, t := range s.current.Targets {
+		if t.ExpectEvery > 0 {
+			expect[t.Name] = t.ExpectEvery
+		}
+	}
+	for _, svc := range s.current.Services {
+		if svc.ExpectEvery > 0 {
+			expect[svc.Key+".service"] = svc.ExpectEvery // journal logs are named after the unit
+		}
+	}
+	return expect
+}
+
+// ConfigHash identifies the applied config, so hosts running different
+// configs stand out. It only changes when the parsed config does.
+func (s *Supervisor) ConfigHash() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := yaml.Marshal(s.current)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Stop stops every reader and waits for them to exit.
+// Configs applied after Stop are ignored.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+
+	for name, w := range s.targets {
+		w.stop()
+		delete(s.targets, name)
+	}
+	if s.journal != nil {
+		s.journal.stop()
+		s.journal = nil
+	}
+}
+
+// Watch reloads the config at path whenever its contents change or the agent
+// receives SIGHUP. Invalid configs are logged and ignored; the agent keeps
+// running with the last good one.
+func (s *Supervisor) Watch(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	last := fileHash(path)
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hup:
+			log.Println("Received SIGHUP, reloading config")
+			last = fileHash(path)
+			s.reload(path)
+		case <-ticker.C:
+			sum := fileHash(path)
+			if sum == nil || bytes.Equal(sum, last) {
+				continue
+			}
+			log.Println("Config file changed, reloading")
+			last = sum
+			s.reload(path)
+		}
+	}
+}
+
+// reload loads and applies the config at path, keeping the old one on error
+func (s *Supervisor) reload(path string) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		log.Printf("Rejecting new config, keeping the current one: %v", err)
+		return
+	}
+	s.Apply(cfg)
+	log.Println("Config reloaded")
+}
+
+// fileHash returns the sha256 of a file's contents, or nil if it can't be read
+func fileHash(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
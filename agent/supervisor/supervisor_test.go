@@ -0,0 +1,171 @@
+package supervisor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/checkpoint"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// -- Helpers --
+
+func catchAll(name, path string) structs.Target {
+	return structs.Target{
+		Name:   name,
+		Path:   path,
+		Custom: true,
+		Module: "catch_all",
+		Regex:  `^(?P<message>.*)$`,
+		Schema: map[string]string{"message": "string"},
+	}
+}
+
+func appendLine(t *testing.T, path, line string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	f.WriteString(line + "\n")
+}
+
+func expectLog(t *testing.T, logChan <-chan structs.Log, raw string) structs.Log {
+	t.Helper()
+	select {
+	case l := <-logChan:
+		if l.Raw != raw {
+			t.Fatalf("Expected %q, got %q", raw, l.Raw)
+		}
+		return l
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Timed out waiting for %q", raw)
+		return structs.Log{}
+	}
+}
+
+// -- Tests --
+
+func TestParseConfigRejectsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"duplicate names": `
+Targets:
+  - {name: A, path: /tmp/a, module: syslog}
+  - {name: A, path: /tmp/b, module: syslog}
+`,
+		"unknown module": `
+Targets:
+  - {name: A, path: /tmp/a, module: nope}
+`,
+		"bad regex": `
+Targets:
+  - {name: A, path: /tmp/a, custom: true, regex: '('}
+`,
+		"journal start": `
+Journal:
+  start: middle
+`,
+		"service key": `
+Services:
+  - {name: Ssh}
+`,
+		"negative expect_every": `
+Targets:
+  - {name: A, path: /tmp/a, module: syslog, expect_every: -1h}
+`,
+		"server_parse field filter": `
+Targets:
+  - {name: A, path: /tmp/a, module: app, server_parse: true, filters: [{action: drop, fields: {user: root}}]}
+`,
+		"server_parse field redaction": `
+Targets:
+  - {name: A, path: /tmp/a, module: app, server_parse: true, redact: [{fields: [password]}]}
+`,
+		"server_parse global field redaction": `
+Targets:
+  - {name: A, path: /tmp/a, module: app, server_parse: true}
+Redact:
+  - {pattern: 'secret', fields: [message]}
+`,
+		"not yaml": `Targets: [`,
+	}
+	for name, data := range tests {
+		if _, err := ParseConfig([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error, got nil", name)
+		}
+	}
+
+	cfg, err := ParseConfig([]byte(`
+Targets:
+  - {name: Auth, path: /var/log/auth.log, module: syslog, expect_every: 1h}
+`))
+	if err != nil {
+		t.Fatalf("Valid config rejected: %v", err)
+	}
+	if len(cfg.Targets) != 1 || cfg.Targets[0].Name != "Auth" || cfg.Targets[0].ExpectEvery != time.Hour {
+		t.Errorf("Unexpected targets: %+v", cfg.Targets)
+	}
+}
+
+func TestApplyStartsAndStopsTargets(t *testing.T) {
+	dir := t.TempDir()
+	store, err := checkpoint.Open(structs.CheckpointConfig{Dir: filepath.Join(dir, "state")})
+	if err != nil {
+		t.Fatalf("checkpoint.Open failed: %v", err)
+	}
+	a := filepath.Join(dir, "a.log")
+	b := filepath.Join(dir, "b.log")
+	appendLine(t, a, "a1")
+	appendLine(t, b, "b1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logChan := make(chan structs.Log, 16)
+	sup := New(ctx, logChan, store)
+	defer sup.Stop()
+
+	sup.Apply(structs.YamlConfig{Targets: []structs.Target{catchAll("A", a)}})
+	expectLog(t, logChan, "a1")
+
+	// adding B leaves A running, so A doesn't resend anything
+	sup.Apply(structs.YamlConfig{Targets: []structs.Target{catchAll("A", a), catchAll("B", b)}})
+	expectLog(t, logChan, "b1")
+	appendLine(t, a, "a2")
+	expectLog(t, logChan, "a2")
+
+	// removing A stops its tailer
+	sup.Apply(structs.YamlConfig{Targets: []structs.Target{catchAll("B", b)}})
+	appendLine(t, a, "a3")
+	appendLine(t, b, "b2")
+	expectLog(t, logChan, "b2")
+	select {
+	case l := <-logChan:
+		t.Errorf("Expected nothing from the removed target, got %q", l.Raw)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestGlobalRedactionComesFirst(t *testing.T) {
+	global := structs.RedactRule{Preset: "password"}
+	own := structs.RedactRule{Preset: "jwt"}
+	cfg := structs.YamlConfig{
+		Targets:  []structs.Target{{Name: "A", Redact: []structs.RedactRule{own}}},
+		Services: []structs.Service{{Name: "Ssh", Key: "ssh"}},
+		Redact:   []structs.RedactRule{global},
+	}
+
+	got := withGlobalRedaction(cfg)
+	if r := got.Targets[0].Redact; len(r) != 2 || r[0].Preset != "password" || r[1].Preset != "jwt" {
+		t.Errorf("Expected global then target rules, got %+v", r)
+	}
+	if r := got.Services[0].Redact; len(r) != 1 || r[0].Preset != "password" {
+		t.Errorf("Expected global rules on services, got %+v", r)
+	}
+	if len(cfg.Targets[0].Redact) != 1 {
+		t.Error("Expected the original config to be left alone")
+	}
+}
@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff produces exponentially growing delays with jitter so a fleet of
+// agents doesn't stampede the server the moment it comes back
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+// Next returns how long to wait before the next attempt.
+// The delay doubles every attempt up to Max, and the returned value is
+// picked uniformly from the upper half of that window.
+func (b *Backoff) Next() time.Duration {
+	d := b.Min << b.attempt
+	if d <= 0 || d > b.Max {
+		// cap (and guard against shifting past int64)
+		d = b.Max
+	} else {
+		b.attempt++
+	}
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half+1)
+}
+
+// Reset starts the delays over from Min
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
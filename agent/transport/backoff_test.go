@@ -0,0 +1,34 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsAndCaps(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 30 * time.Second}
+
+	for i := 0; i < 20; i++ {
+		window := time.Second << i
+		if window > b.Max {
+			window = b.Max
+		}
+
+		d := b.Next()
+		if d < window/2 || d > window {
+			t.Fatalf("Attempt %d: expected delay in [%v, %v], got %v", i, window/2, window, d)
+		}
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: time.Minute}
+	for i := 0; i < 5; i++ {
+		b.Next()
+	}
+	b.Reset()
+
+	if d := b.Next(); d > time.Second {
+		t.Errorf("Expected delay <= 1s after reset, got %v", d)
+	}
+}
@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+)
+
+// how long to wait for the server's welcome. Servers from before the
+// handshake never answer, so this is also how long falling back takes.
+// A variable so tests don't have to wait it out.
+var handshakeTimeout = 5 * time.Second
+
+// errNoWelcome is returned when the server hangs up without welcoming the agent
+var errNoWelcome = errors.New("server closed the connection without a welcome")
+
+// legacyPolicy says when handshake may settle for the plain, unacknowledged
+// stream of servers from before the handshake
+type legacyPolicy int
+
+const (
+	legacyNever     legacyPolicy = iota // a server already negotiated with this agent
+	legacyOnReply                       // only when the server answers with something other than a welcome
+	legacyOnTimeout                     // also when the server doesn't answer at all
+)
+
+// session is what the agent and server settled on for one connection
+type session struct {
+	codec   string
+	version int           // 0 for servers from before the handshake
+	acks    *bufio.Reader // the server's side of the connection, after the welcome
+}
+
+// handshake introduces the agent, offers our codecs to the server and
+// returns what it picked. Depending on policy, a server that answers with
+// something else or doesn't answer is treated as an old one, and the stream
+// stays uncompressed and unacknowledged. A slow current server would read
+// that stream as garbage, so by default a timeout is an error.
+func handshake(conn net.Conn, hello protocol.Hello, offer []string, policy legacyPolicy) (session, error) {
+	hello.Version = protocol.Version
+	hello.MinVersion = protocol.MinVersion
+	hello.Compression = offer
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	if err := json.NewEncoder(conn).Encode(protocol.Handshake{Hello: &hello}); err != nil {
+		return session{}, fmt.Errorf("error sending hello: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if policy < legacyOnTimeout {
+			return session{}, fmt.Errorf("server didn't answer the handshake within %v", handshakeTimeout)
+		}
+		log.Println("Server didn't answer the handshake, sending uncompressed")
+		return session{codec: protocol.None, acks: r}, nil
+	}
+	if errors.Is(err, io.EOF) {
+		return session{}, errNoWelcome
+	}
+	if err != nil {
+		return session{}, fmt.Errorf("error reading welcome: %w", err)
+	}
+
+	var reply protocol.Handshake
+	if err := json.Unmarshal(line, &reply); err != nil || reply.Welcome == nil {
+		if policy < legacyOnReply {
+			return session{}, fmt.Errorf("unexpected handshake reply %q", line)
+		}
+		log.Println("Server answered the handshake without a welcome, sending uncompressed")
+		return session{codec: protocol.None, acks: r}, nil
+	}
+	if reply.Welcome.Error != "" {
+		return session{}, fmt.Errorf("server turned the agent away: %s", reply.Welcome.Error)
+	}
+	version, err := protocol.Negotiate(reply.Welcome.Version, 0)
+	if err != nil {
+		return session{}, fmt.Errorf("incompatible server: %w", err)
+	}
+	if !protocol.Valid(reply.Welcome.Compression) {
+		return session{}, fmt.Errorf("server picked unknown compression %q", reply.Welcome.Compression)
+	}
+	return session{
+		codec:   reply.Welcome.Compression,
+		version: version,
+		acks:    r,
+	}, nil
+}
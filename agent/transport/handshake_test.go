@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+)
+
+func TestHandshakeUsesServerChoice(t *testing.T) {
+	agent, server := net.Pipe()
+	defer agent.Close()
+	defer server.Close()
+
+	offered := make(chan []string, 1)
+	go func() {
+		line, err := bufio.NewReader(server).ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var hs protocol.Handshake
+		json.Unmarshal(line, &hs)
+		if hs.Hello == nil || hs.Hello.AgentID != "abc" || hs.Hello.Version != protocol.Version {
+			offered <- nil
+			return
+		}
+		offered <- hs.Hello.Compression
+		json.NewEncoder(server).Encode(protocol.Handshake{Welcome: &protocol.Welcome{
+			Version:     1,
+			Compression: protocol.Choose(hs.Hello.Compression),
+		}})
+	}()
+
+	sess, err := handshake(agent, protocol.Hello{AgentID: "abc"}, []string{protocol.Gzip, protocol.Zstd}, legacyNever)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if got := <-offered; len(got) != 2 || got[0] != protocol.Gzip {
+		t.Errorf("Expected the server to see our hello with our preference order, got %v", got)
+	}
+	if sess.codec != protocol.Gzip {
+		t.Errorf("Expected gzip, got %s", sess.codec)
+	}
+	if sess.version != 1 {
+		t.Errorf("Expected to fall back to the server's version 1, got %d", sess.version)
+	}
+}
+
+func TestHandshakeRejectsGarbage(t *testing.T) {
+	agent, server := net.Pipe()
+	defer agent.Close()
+	defer server.Close()
+
+	go func() {
+		bufio.NewReader(server).ReadBytes('\n')
+		server.Write([]byte("{\"welcome\":{\"compression\":\"lzma\"}}\n"))
+	}()
+
+	if _, err := handshake(agent, protocol.Hello{}, protocol.Supported, legacyNever); err == nil {
+		t.Error("Expected an error for an unknown codec")
+	}
+}
+
+func TestHandshakeReportsRejection(t *testing.T) {
+	agent, server := net.Pipe()
+	defer agent.Close()
+	defer server.Close()
+
+	go func() {
+		bufio.NewReader(server).ReadBytes('\n')
+		json.NewEncoder(server).Encode(protocol.Handshake{Welcome: &protocol.Welcome{Error: "agent too old"}})
+	}()
+
+	_, err := handshake(agent, protocol.Hello{}, protocol.Supported, legacyNever)
+	if err == nil || !strings.Contains(err.Error(), "agent too old") {
+		t.Errorf("Expected the server's reason in the error, got %v", err)
+	}
+}
+
+// silentServer reads the hello and never answers, like servers from before the handshake
+func silentServer(t *testing.T) net.Conn {
+	t.Helper()
+	agent, server := net.Pipe()
+	t.Cleanup(func() { agent.Close(); server.Close() })
+	go bufio.NewReader(server).ReadBytes('\n')
+	return agent
+}
+
+func TestHandshakeTimeoutIsRetriedUnlessLegacyIsOn(t *testing.T) {
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 50 * time.Millisecond
+
+	for _, policy := range []legacyPolicy{legacyNever, legacyOnReply} {
+		if _, err := handshake(silentServer(t), protocol.Hello{}, protocol.Supported, policy); err == nil {
+			t.Errorf("policy %d: expected a timeout to be an error, not a fallback", policy)
+		}
+	}
+
+	sess, err := handshake(silentServer(t), protocol.Hello{}, protocol.Supported, legacyOnTimeout)
+	if err != nil {
+		t.Fatalf("Expected to fall back with legacy on, got %v", err)
+	}
+	if sess.codec != protocol.None || sess.version != 0 {
+		t.Errorf("Expected the uncompressed legacy stream, got %s version %d", sess.codec, sess.version)
+	}
+}
+
+func TestHandshakeReplyWithoutWelcome(t *testing.T) {
+	reply := func() net.Conn {
+		agent, server := net.Pipe()
+		t.Cleanup(func() { agent.Close(); server.Close() })
+		go func() {
+			bufio.NewReader(server).ReadBytes('\n')
+			server.Write([]byte("not a welcome\n"))
+		}()
+		return agent
+	}
+
+	sess, err := handshake(reply(), protocol.Hello{}, protocol.Supported, legacyOnReply)
+	if err != nil || sess.codec != protocol.None {
+		t.Errorf("Expected to fall back to the legacy stream, got %+v, %v", sess, err)
+	}
+	if _, err := handshake(reply(), protocol.Hello{}, protocol.Supported, legacyNever); err == nil {
+		t.Error("Expected an error once a server has negotiated with the agent")
+	}
+}
+
+func TestHandshakeHangUp(t *testing.T) {
+	agent, server := net.Pipe()
+	defer agent.Close()
+	go func() {
+		bufio.NewReader(server).ReadBytes('\n')
+		server.Close()
+	}()
+
+	if _, err := handshake(agent, protocol.Hello{}, protocol.Supported, legacyOnTimeout); !errors.Is(err, errNoWelcome) {
+		t.Errorf("Expected errNoWelcome, got %v", err)
+	}
+}
+
+func TestLegacyPolicy(t *testing.T) {
+	m := &Manager{}
+	if got := m.legacyPolicy(); got != legacyOnReply {
+		t.Errorf("Expected to fall back only on a non-welcome reply by default, got %d", got)
+	}
+	m.hungUp = true
+	if got := m.legacyPolicy(); got != legacyOnTimeout {
+		t.Errorf("Expected a server that hung up to be given the legacy stream, got %d", got)
+	}
+	m.legacy, m.hungUp = true, false
+	if got := m.legacyPolicy(); got != legacyOnTimeout {
+		t.Errorf("Expected Transport.legacy to allow falling back on a timeout, got %d", got)
+	}
+	m.negotiated = true
+	if got := m.legacyPolicy(); got != legacyNever {
+		t.Errorf("Expected no fallback after a server negotiated with the agent, got %d", got)
+	}
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/spool"
+	"github.com/TLop503/LogCrunch/agent/stats"
+	"github.com/TLop503/LogCrunch/agent/utils"
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+const (
+	DefaultMinBackoff = time.Second
+	DefaultMaxBackoff = 2 * time.Minute
+
+	dialTimeout = 10 * time.Second
+)
+
+// Manager owns the agent's connection to the intake server. It dials,
+// drains the spool into the connection, and redials with backoff whenever
+// the connection drops. Readers and the heartbeat only ever talk to the
+// spool, so they keep running across reconnects.
+type Manager struct {
+	addr        string
+	tls         *tls.Config
+	spool       *spool.Spool
+	backoff     Backoff
+	compression []string
+	legacy      bool // fall back to the legacy stream when the server doesn't answer the handshake
+	hello       func() protocol.Hello
+	onProfile   func(protocol.Profile)
+
+	negotiated bool // a server negotiated a version with us, so it's never an old one
+	hungUp     bool // the server hung up without a welcome, as old servers can
+}
+
+// NewManager creates a connection manager for the server at addr.
+// hello is called on every connect, so the server sees the current targets,
+// and onProfile with every profile the server sends.
+func NewManager(addr string, tlsConfig *tls.Config, sp *spool.Spool, cfg structs.ReconnectConfig, transport structs.TransportConfig, hello func() protocol.Hello, onProfile func(protocol.Profile)) *Manager {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(DefaultMaxBackoff, cfg.MinBackoff)
+	}
+
+	compression := transport.Compression
+	if len(compression) == 0 {
+		compression = protocol.Supported
+	}
+
+	return &Manager{
+		addr:        addr,
+		tls:         tlsConfig,
+		spool:       sp,
+		backoff:     Backoff{Min: cfg.MinBackoff, Max: cfg.MaxBackoff},
+		compression: compression,
+		legacy:      transport.Legacy,
+		hello:       hello,
+		onProfile:   onProfile,
+	}
+}
+
+// Run keeps the agent connected until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		conn, err := m.dial(ctx)
+		if err != nil {
+			m.wait(ctx, err)
+			continue
+		}
+		log.Printf("Connected to %s via TLS\n", m.addr)
+
+		sess, err := handshake(conn, m.hello(), m.compression, m.legacyPolicy())
+		if err != nil {
+			conn.Close()
+			if errors.Is(err, errNoWelcome) {
+				m.hungUp = true
+			}
+			m.wait(ctx, err)
+			continue
+		}
+		if sess.version >= protocol.MinVersion {
+			m.negotiated = true
+		}
+		stats.Transport.SetCodec(sess.codec)
+
+		connected := time.Now()
+		if sess.version >= protocol.AckedVersion {
+			log.Printf("Sending acknowledged batches with %s compression\n", sess.codec)
+			err = utils.TransmitBatches(ctx, conn, sess.acks, m.spool, sess.codec, sess.version, m.onProfile)
+		} else {
+			// older servers can't ack, so logs count as delivered once flushed
+			log.Printf("Streaming logs with %s compression to an older server\n", sess.codec)
+			err = utils.TransmitJson(ctx, conn, m.spool, sess.codec)
+		}
+		conn.Close()
+		if ctx.Err() != nil {
+			return
+		}
+
+		// anything handed out but not committed (or acked) gets replayed on the next connection
+		if rerr := m.spool.Rewind(); rerr != nil {
+			log.Println("Error rewinding spool:", rerr)
+		}
+
+		// a connection that stayed up for a while was healthy, so start the delays over
+		if time.Since(connected) >= m.backoff.Max {
+			m.backoff.Reset()
+		}
+		m.wait(ctx, fmt.Errorf("lost connection to server: %w", err))
+	}
+}
+
+// legacyPolicy picks when the next handshake may fall back to the legacy
+// stream. Once a server has negotiated with us, a slow or broken handshake is
+// never taken for an old server, since falling back would lose logs.
+func (m *Manager) legacyPolicy() legacyPolicy {
+	switch {
+	case m.negotiated:
+		return legacyNever
+	case m.legacy || m.hungUp:
+		return legacyOnTimeout
+	default:
+		return legacyOnReply
+	}
+}
+
+// dial opens a TCP connection and runs the TLS handshake up front,
+// so handshake failures are retried like any other dial error
+func (m *Manager) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second},
+		Config:    m.tls,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", m.addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %w", err)
+	}
+	return conn, nil
+}
+
+// wait logs why we're reconnecting and sleeps for the next backoff delay,
+// returning early if ctx is done
+func (m *Manager) wait(ctx context.Context, reason error) {
+	if ctx.Err() != nil {
+		return
+	}
+	delay := m.backoff.Next()
+	log.Printf("%v (retrying in %v)", reason, delay.Round(time.Millisecond))
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+}
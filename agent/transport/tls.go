@@ -0,0 +1,111 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// TLSConfig builds the agent's TLS config. The server is verified against
+// the CA bundle (or the system roots), and, if any pins are set, its
+// certificate must also match one of them. Pins alone are enough to trust a
+// self-signed server. skipVerify only applies when neither is configured.
+func TLSConfig(cfg structs.TLSConfig, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{ServerName: cfg.ServerName}
+
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CABundle)
+		}
+	}
+
+	if cfg.Cert != "" || cfg.Key != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	var pins [][]byte
+	for _, p := range cfg.PinnedSHA256 {
+		pin, err := ParsePin(p)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+
+	switch {
+	case len(pins) > 0:
+		// the standard verification can't be made to accept a pinned self-signed
+		// certificate, so turn it off and do it ourselves
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyServer(cs, config.RootCAs, cfg.CABundle != "", pins)
+		}
+	case cfg.CABundle != "":
+		if skipVerify {
+			log.Println("A CA bundle is configured, verifying the server certificate anyway")
+		}
+	case skipVerify:
+		log.Println("Not verifying the server certificate, configure TLS.ca_bundle or TLS.pinned_sha256 instead")
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// verifyServer checks the server's certificate against the pins and,
+// when checkChain is set, against roots
+func verifyServer(cs tls.ConnectionState, roots *x509.CertPool, checkChain bool, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+
+	if checkChain {
+		intermediates := x509.NewCertPool()
+		for _, c := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		}); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256(leaf.Raw)
+	for _, pin := range pins {
+		if bytes.Equal(sum[:], pin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("server certificate %s matches no pinned fingerprint", hex.EncodeToString(sum[:]))
+}
+
+// ParsePin decodes a SHA-256 certificate fingerprint, with or without the
+// colons openssl prints between bytes
+func ParsePin(pin string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid pinned_sha256 %q, expected 64 hex characters", pin)
+	}
+	return b, nil
+}
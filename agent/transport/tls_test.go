@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// selfSigned makes a throwaway server certificate for 127.0.0.1
+func selfSigned(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "logcrunch-test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// dialWith runs a TLS handshake against a server using cert
+func dialWith(t *testing.T, cert tls.Certificate, config *tls.Config) error {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), config)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestPinnedCertificateIsTrusted(t *testing.T) {
+	cert := selfSigned(t)
+	sum := sha256.Sum256(cert.Certificate[0])
+
+	// openssl prints fingerprints as colon separated upper case hex
+	var parts []string
+	for _, b := range sum {
+		parts = append(parts, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	config, err := TLSConfig(structs.TLSConfig{PinnedSHA256: []string{strings.Join(parts, ":")}}, false)
+	if err != nil {
+		t.Fatalf("TLSConfig failed: %v", err)
+	}
+	if err := dialWith(t, cert, config); err != nil {
+		t.Errorf("Expected the pinned certificate to be accepted, got %v", err)
+	}
+}
+
+func TestUnpinnedCertificateIsRejected(t *testing.T) {
+	cert := selfSigned(t)
+	other := sha256.Sum256([]byte("some other certificate"))
+
+	config, err := TLSConfig(structs.TLSConfig{PinnedSHA256: []string{hex.EncodeToString(other[:])}}, true)
+	if err != nil {
+		t.Fatalf("TLSConfig failed: %v", err)
+	}
+	if err := dialWith(t, cert, config); err == nil {
+		t.Error("Expected a certificate matching no pin to be rejected, even with skipVerify")
+	}
+}
+
+func TestSelfSignedRejectedWithoutPins(t *testing.T) {
+	config, err := TLSConfig(structs.TLSConfig{}, false)
+	if err != nil {
+		t.Fatalf("TLSConfig failed: %v", err)
+	}
+	if err := dialWith(t, selfSigned(t), config); err == nil {
+		t.Error("Expected an untrusted self-signed certificate to be rejected")
+	}
+}
+
+func TestParsePinRejectsGarbage(t *testing.T) {
+	for _, pin := range []string{"", "abcd", strings.Repeat("zz", 32)} {
+		if _, err := ParsePin(pin); err == nil {
+			t.Errorf("Expected %q to be rejected", pin)
+		}
+	}
+}
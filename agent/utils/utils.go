@@ -1,11 +1,31 @@
 package utils
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/TLop503/LogCrunch/structs"
+	"io"
+	"log"
 	"net"
 	"os"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/spool"
+	"github.com/TLop503/LogCrunch/agent/stats"
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+const (
+	// how long a single write to the server may take before the connection is considered dead
+	writeTimeout = 30 * time.Second
+	// how long to wait for more logs before flushing the ones already compressed
+	flushDelay = 100 * time.Millisecond
+	// flush at least this often while the spool keeps producing
+	flushEvery = 256
+	// how long the server may take to store a batch before the connection is considered dead
+	ackTimeout = 30 * time.Second
 )
 
 // GetHostName is a wrapper to handle the error-case of os.Hostname
@@ -18,13 +38,207 @@ func GetHostName() string {
 	return hostname
 }
 
-// TransmitJson encodes json over a connection, reading inputs from a channel
-func TransmitJson(conn net.Conn, logChan <-chan structs.Log) {
-	for log := range logChan {
-		err := json.NewEncoder(conn).Encode(log)
+// SpoolLogs moves logs from the channel onto the disk spool, so nothing
+// produced while the server is unreachable is lost
+func SpoolLogs(logChan <-chan structs.Log, sp *spool.Spool) {
+	for l := range logChan {
+		err := sp.Put(l)
+		if errors.Is(err, spool.ErrFull) {
+			log.Printf("Spool full, dropping log from %s", l.Path)
+		} else if err != nil {
+			log.Println("Error writing log to spool:", err)
+		}
+	}
+}
+
+// TransmitJson encodes json over a connection, reading inputs from the spool
+// and compressing the stream with codec. It is used with servers that don't
+// ack batches yet. Logs are flushed to the connection
+// whenever the spool runs dry (or every flushEvery logs) and only committed
+// once flushed. It returns when the connection fails or ctx is done; anything
+// not yet flushed is left in the spool for the next connection.
+func TransmitJson(ctx context.Context, conn net.Conn, sp *spool.Spool, codec string) error {
+	zw, err := protocol.NewWriter(protocol.CountWriter(conn, &stats.Transport.Wire), codec)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+	encoder := json.NewEncoder(protocol.CountWriter(zw, &stats.Transport.Raw))
+
+	unflushed := 0
+	flush := func() error {
+		// a server that vanished without closing the socket would block us forever
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := zw.Flush(); err != nil {
+			return fmt.Errorf("error flushing to server: %w", err)
+		}
+		unflushed = 0
+		if err := sp.Commit(); err != nil {
+			log.Println("Error committing spool cursor:", err)
+		}
+		return nil
+	}
+
+	for {
+		// with logs waiting to be flushed, only wait briefly for more
+		nextCtx, cancel := ctx, context.CancelFunc(func() {})
+		if unflushed > 0 {
+			nextCtx, cancel = context.WithTimeout(ctx, flushDelay)
+		}
+		l, err := sp.Next(nextCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
 		if err != nil {
-			fmt.Println("Error marshaling JSON:", err)
+			return fmt.Errorf("error reading from spool: %w", err)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := encoder.Encode(l); err != nil {
+			return fmt.Errorf("error marshaling JSON: %w", err)
+		}
+		unflushed++
+		if unflushed >= flushEvery {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// TransmitBatches sends logs from the spool in numbered batches, compressed
+// with codec, and reads the server's acks from acks. A batch is sent once
+// the spool runs dry or flushEvery logs are waiting, and only committed once
+// the server acks it, so one batch is in flight at a time. From protocol
+// version 4 on, the server also sends profiles there whenever the agent's
+// changes, which are passed to onProfile. It returns when the connection
+// fails or ctx is done; the unacked batch is left in the spool and resent on
+// the next connection, where the server drops the duplicates.
+func TransmitBatches(ctx context.Context, conn net.Conn, acks io.Reader, sp *spool.Spool, codec string, version int, onProfile func(protocol.Profile)) error {
+	zw, err := protocol.NewWriter(protocol.CountWriter(conn, &stats.Transport.Wire), codec)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+	encoder := json.NewEncoder(protocol.CountWriter(zw, &stats.Transport.Raw))
+
+	// the server can send a profile at any time, so its side of the
+	// connection is read all along. Once reading fails, so does sending.
+	ctx, fail := context.WithCancelCause(ctx)
+	defer fail(nil)
+	acked := make(chan protocol.Ack)
+	go readDownlink(ctx, acks, version >= protocol.ProfileVersion, acked, onProfile, fail)
+
+	// don't sit out the ack timeout on shutdown
+	stopWatching := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stopWatching()
+
+	var seq uint64
+	batch := make([]structs.Log, 0, flushEvery)
+	send := func() error {
+		seq++
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := encoder.Encode(protocol.Batch{Seq: seq, Logs: batch}); err != nil {
+			return fmt.Errorf("error sending batch: %w", err)
+		}
+		if err := zw.Flush(); err != nil {
+			return fmt.Errorf("error flushing to server: %w", err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(ackTimeout))
+		var ack protocol.Ack
+		select {
+		case ack = <-acked:
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for ack of batch %d: %w", seq, context.Cause(ctx))
+		}
+		// between batches the server only sends profiles, which may be a while
+		conn.SetReadDeadline(time.Time{})
+		if ack.Seq != seq {
+			return fmt.Errorf("server acked batch %d, expected %d", ack.Seq, seq)
+		}
+		if ack.Rejected > 0 {
+			log.Printf("Server couldn't store %d of the %d logs in batch %d and kept them as dead letters", ack.Rejected, len(batch), seq)
+		}
+		if n := len(batch) - ack.Stored - ack.Rejected; n > 0 {
+			log.Printf("Server already had %d of the %d logs in batch %d", n, len(batch), seq)
+		}
+
+		batch = batch[:0]
+		if err := sp.Commit(); err != nil {
+			log.Println("Error committing spool cursor:", err)
+		}
+		return nil
+	}
+
+	for {
+		// with a batch started, only wait briefly for more
+		nextCtx, cancel := ctx, context.CancelFunc(func() {})
+		if len(batch) > 0 {
+			nextCtx, cancel = context.WithTimeout(ctx, flushDelay)
+		}
+		l, err := sp.Next(nextCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			if err := send(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading from spool: %w", err)
+		}
+
+		batch = append(batch, l)
+		if len(batch) >= flushEvery {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readDownlink reads what the server sends until it fails or ctx is done,
+// passing acks to acked and profiles to onProfile. Servers before protocol
+// version 4 send bare acks rather than wrapped ones. Why reading stopped is
+// reported through fail.
+func readDownlink(ctx context.Context, r io.Reader, wrapped bool, acked chan<- protocol.Ack, onProfile func(protocol.Profile), fail context.CancelCauseFunc) {
+	decoder := json.NewDecoder(r)
+	for {
+		var msg protocol.Downlink
+		var err error
+		if wrapped {
+			err = decoder.Decode(&msg)
+		} else {
+			msg.Ack = new(protocol.Ack)
+			err = decoder.Decode(msg.Ack)
+		}
+		if err != nil {
+			fail(fmt.Errorf("error reading from server: %w", err))
 			return
 		}
+
+		if msg.Profile != nil && onProfile != nil {
+			onProfile(*msg.Profile)
+		}
+		if msg.Ack != nil {
+			select {
+			case acked <- *msg.Ack:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}
 }
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/agent/spool"
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// fakeServer reads batches from conn, acking them while ack returns true,
+// and passes every batch it sees to got
+func fakeServer(conn net.Conn, ack func(protocol.Batch) bool, got chan<- protocol.Batch) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	for {
+		var batch protocol.Batch
+		if err := decoder.Decode(&batch); err != nil {
+			return
+		}
+		got <- batch
+		if !ack(batch) {
+			return
+		}
+		json.NewEncoder(conn).Encode(protocol.Ack{Seq: batch.Seq, Stored: len(batch.Logs)})
+	}
+}
+
+func TestTransmitBatchesResendsUnackedBatch(t *testing.T) {
+	sp, err := spool.Open(structs.SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer sp.Close()
+	for i := 0; i < 3; i++ {
+		sp.Put(structs.Log{Name: "test", Raw: "line " + strconv.Itoa(i)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the first server goes away before acking anything
+	agent, server := net.Pipe()
+	got := make(chan protocol.Batch, 4)
+	go fakeServer(server, func(protocol.Batch) bool { return false }, got)
+	if err := TransmitBatches(ctx, agent, agent, sp, protocol.None, protocol.AckedVersion, nil); err == nil {
+		t.Fatal("Expected an error when the server hangs up")
+	}
+	agent.Close()
+	lost := <-got
+	if lost.Seq != 1 || len(lost.Logs) != 3 {
+		t.Fatalf("Expected batch 1 with 3 logs, got %d with %d", lost.Seq, len(lost.Logs))
+	}
+	sp.Rewind()
+
+	// the next connection gets the same logs again and acks them
+	agent, server = net.Pipe()
+	defer agent.Close()
+	go fakeServer(server, func(protocol.Batch) bool { return true }, got)
+	sendCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- TransmitBatches(sendCtx, agent, agent, sp, protocol.None, protocol.AckedVersion, nil) }()
+
+	resent := <-got
+	if len(resent.Logs) != 3 {
+		t.Fatalf("Expected the 3 logs to be resent, got %d", len(resent.Logs))
+	}
+	for i, l := range resent.Logs {
+		if l.ID != lost.Logs[i].ID {
+			t.Errorf("Expected resent log %d to keep ID %q, got %q", i, lost.Logs[i].ID, l.ID)
+		}
+	}
+
+	// once acked, the logs are committed
+	deadline := time.Now().Add(time.Second)
+	for {
+		if pending, _, _ := sp.Stats(); pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the acked batch to be committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled on shutdown, got %v", err)
+	}
+}
+
+func TestTransmitBatchesTakesProfilesBetweenAcks(t *testing.T) {
+	sp, err := spool.Open(structs.SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer sp.Close()
+
+	agent, server := net.Pipe()
+	defer agent.Close()
+	profiles := make(chan protocol.Profile, 2)
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- TransmitBatches(ctx, agent, agent, sp, protocol.None, protocol.ProfileVersion, func(p protocol.Profile) { profiles <- p })
+	}()
+
+	// a profile arrives while the agent has nothing to send
+	downlink := json.NewEncoder(server)
+	downlink.Encode(protocol.Downlink{Profile: &protocol.Profile{Name: "web", Version: 1}})
+	select {
+	case p := <-profiles:
+		if p.Label() != "web@1" {
+			t.Errorf("Expected profile web@1, got %q", p.Label())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timed out waiting for the profile")
+	}
+
+	// acks come wrapped too
+	sp.Put(structs.Log{Name: "test", Raw: "line"})
+	var batch protocol.Batch
+	if err := json.NewDecoder(server).Decode(&batch); err != nil {
+		t.Fatalf("Reading batch failed: %v", err)
+	}
+	downlink.Encode(protocol.Downlink{Ack: &protocol.Ack{Seq: batch.Seq, Stored: 1}})
+	deadline := time.Now().Add(time.Second)
+	for {
+		if pending, _, _ := sp.Stats(); pending == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the acked batch to be committed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a server that hangs up is noticed without waiting for the next batch
+	server.Close()
+	select {
+	case err := <-done:
+		if err == nil || errors.Is(err, context.Canceled) {
+			t.Errorf("Expected a read error, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected TransmitBatches to return once the server hung up")
+	}
+	stop()
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"encoding/json"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// Batch is a group of logs sent as one frame on the (compressed) stream.
+// Seq numbers the batches on a connection, starting at 1.
+type Batch struct {
+	Seq  uint64        `json:"seq"`
+	Logs []structs.Log `json:"logs"`
+}
+
+// Ack is sent back uncompressed once every log in batch Seq is stored.
+// Stored leaves out logs the server already had from an earlier attempt, and
+// Rejected counts logs it couldn't store and kept aside as dead letters.
+type Ack struct {
+	Seq      uint64 `json:"seq"`
+	Stored   int    `json:"stored"`
+	Rejected int    `json:"rejected,omitempty"`
+}
+
+// BadLog is a log in a batch that couldn't be decoded
+type BadLog struct {
+	Raw json.RawMessage
+	Err error
+}
+
+// DecodeBatch decodes a batch frame, setting aside the logs in it that don't
+// decode so the rest can still be stored. It fails only when the frame itself
+// is malformed.
+func DecodeBatch(frame []byte) (Batch, []BadLog, error) {
+	var raw struct {
+		Seq  uint64            `json:"seq"`
+		Logs []json.RawMessage `json:"logs"`
+	}
+	if err := json.Unmarshal(frame, &raw); err != nil {
+		return Batch{}, nil, err
+	}
+
+	batch := Batch{Seq: raw.Seq, Logs: make([]structs.Log, 0, len(raw.Logs))}
+	var bad []BadLog
+	for _, r := range raw.Logs {
+		var l structs.Log
+		if err := json.Unmarshal(r, &l); err != nil {
+			bad = append(bad, BadLog{Raw: r, Err: err})
+			continue
+		}
+		batch.Logs = append(batch.Logs, l)
+	}
+	return batch, bad, nil
+}
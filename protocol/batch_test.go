@@ -0,0 +1,21 @@
+package protocol
+
+import "testing"
+
+func TestDecodeBatchSetsAsideBadLogs(t *testing.T) {
+	frame := []byte(`{"seq":7,"logs":[{"name":"auth","raw":"ok"},{"name":"auth","timestamp":"yesterday"},{"name":"auth","raw":"also ok"}]}`)
+	batch, bad, err := DecodeBatch(frame)
+	if err != nil {
+		t.Fatalf("DecodeBatch failed: %v", err)
+	}
+	if batch.Seq != 7 || len(batch.Logs) != 2 || batch.Logs[1].Raw != "also ok" {
+		t.Errorf("Expected the two good logs of batch 7, got %+v", batch)
+	}
+	if len(bad) != 1 || bad[0].Err == nil || string(bad[0].Raw) != `{"name":"auth","timestamp":"yesterday"}` {
+		t.Errorf("Expected the log with a bad timestamp set aside, got %+v", bad)
+	}
+
+	if _, _, err := DecodeBatch([]byte(`{"seq":8,"logs":[{"name":`)); err == nil {
+		t.Error("Expected a truncated frame to fail")
+	}
+}
@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// codecs
+const (
+	None = "none"
+	Zstd = "zstd"
+	Gzip = "gzip"
+)
+
+// Supported lists the codecs this build can speak, preferred first
+var Supported = []string{Zstd, Gzip}
+
+// Choose picks the first offered codec we support, or None
+func Choose(offered []string) string {
+	for _, codec := range offered {
+		switch codec {
+		case Zstd, Gzip, None:
+			return codec
+		}
+	}
+	return None
+}
+
+// Valid reports whether codec is one we know
+func Valid(codec string) bool {
+	switch codec {
+	case Zstd, Gzip, None:
+		return true
+	}
+	return false
+}
+
+// Writer compresses a stream. Flush pushes everything written so far to the
+// underlying writer, so the other side can decode it without waiting for more.
+type Writer interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// NewWriter wraps w in a compressor for codec
+func NewWriter(w io.Writer, codec string) (Writer, error) {
+	switch codec {
+	case Zstd:
+		// one goroutine is plenty for a log stream, and keeps flushes cheap
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case None, "":
+		return nopWriter{w}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+}
+
+// NewReader wraps r in a decompressor for codec
+func NewReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case None, "":
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+}
+
+// nopWriter is the uncompressed Writer
+type nopWriter struct {
+	io.Writer
+}
+
+func (nopWriter) Flush() error { return nil }
+func (nopWriter) Close() error { return nil }
+
+// countingWriter adds the number of bytes written to n
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+// CountWriter returns a writer that adds every byte written through it to n
+func CountWriter(w io.Writer, n *atomic.Int64) io.Writer {
+	return countingWriter{w: w, n: n}
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	written, err := c.w.Write(p)
+	c.n.Add(int64(written))
+	return written, err
+}
+
+// countingReader adds the number of bytes read to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+// CountReader returns a reader that adds every byte read through it to n
+func CountReader(r io.Reader, n *atomic.Int64) io.Reader {
+	return countingReader{r: r, n: n}
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	read, err := c.r.Read(p)
+	c.n.Add(int64(read))
+	return read, err
+}
+
+// Ratio is raw bytes over wire bytes, or 0 before anything was sent
+func Ratio(raw, wire int64) float64 {
+	if wire == 0 {
+		return 0
+	}
+	return float64(raw) / float64(wire)
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlushedLogsDecodeWithoutClosing(t *testing.T) {
+	for _, codec := range []string{Zstd, Gzip, None} {
+		pr, pw := io.Pipe()
+
+		var raw, wire atomic.Int64
+		zw, err := NewWriter(CountWriter(pw, &wire), codec)
+		if err != nil {
+			t.Fatalf("%s: NewWriter failed: %v", codec, err)
+		}
+		enc := json.NewEncoder(CountWriter(zw, &raw))
+
+		type msg struct{ Raw string }
+		decoded := make(chan msg, 1)
+		errs := make(chan error, 1)
+		go func() {
+			zr, err := NewReader(pr, codec)
+			if err != nil {
+				errs <- err
+				return
+			}
+			var m msg
+			if err := json.NewDecoder(zr).Decode(&m); err != nil {
+				errs <- err
+				return
+			}
+			decoded <- m
+		}()
+
+		line := strings.Repeat("sshd[42]: Accepted publickey for root ", 20)
+		go func() {
+			enc.Encode(msg{Raw: line})
+			zw.Flush()
+		}()
+
+		select {
+		case m := <-decoded:
+			if m.Raw != line {
+				t.Errorf("%s: got %q", codec, m.Raw)
+			}
+		case err := <-errs:
+			t.Errorf("%s: decode failed: %v", codec, err)
+		case <-time.After(3 * time.Second):
+			t.Errorf("%s: flushed log never arrived", codec)
+		}
+		pw.Close()
+
+		if codec != None && wire.Load() >= raw.Load() {
+			t.Errorf("%s: expected repetitive JSON to shrink, %d raw vs %d wire", codec, raw.Load(), wire.Load())
+		}
+	}
+}
+
+func TestChoose(t *testing.T) {
+	if got := Choose([]string{"brotli", Gzip, Zstd}); got != Gzip {
+		t.Errorf("Expected the first supported codec, got %s", got)
+	}
+	if got := Choose(nil); got != None {
+		t.Errorf("Expected none without an offer, got %s", got)
+	}
+}
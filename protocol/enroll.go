@@ -0,0 +1,20 @@
+package protocol
+
+// EnrollPath is where the server's web UI takes enrollment requests
+const EnrollPath = "/api/enroll"
+
+// EnrollRequest asks the server to sign an agent's certificate request,
+// using a one-time token an admin created in the web UI
+type EnrollRequest struct {
+	Token string `json:"token"`
+	Name  string `json:"name"` // becomes the agent's identity, usually its hostname
+	CSR   string `json:"csr"`  // PEM certificate request
+}
+
+// EnrollResponse carries the signed client certificate and the CA that
+// signed it, which also signed the intake certificate
+type EnrollResponse struct {
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+	Error       string `json:"error,omitempty"`
+}
@@ -0,0 +1,85 @@
+// Package protocol holds what the agent and the server agree on: the
+// intake connection's handshake, stream compression and batch framing,
+// and the enrollment API.
+package protocol
+
+import (
+	"fmt"
+	"time"
+)
+
+// Version of the intake protocol spoken after the handshake.
+// Both sides speak the lower of the two versions in the Hello and Welcome.
+const Version = 4
+
+// MinVersion is the oldest version this build can still speak. Peers that
+// can't meet it are turned away during the handshake.
+const MinVersion = 1
+
+// AckedVersion is the first version where logs are sent in batches that
+// the server acknowledges. Before it, logs were streamed one at a time.
+const AckedVersion = 2
+
+// Capabilities an agent can announce in its Hello
+const (
+	CapBatches     = "batches"     // acknowledged batches
+	CapCompression = "compression" // zstd/gzip stream compression
+	CapJournal     = "journal"     // reads the systemd journal
+	CapFilters     = "filters"     // drops logs by rule before sending
+	CapRedaction   = "redaction"   // masks secrets before sending
+	CapProfiles    = "profiles"    // runs config profiles the server pushes
+)
+
+// Hello is the first message an agent sends after connecting.
+// Agents from before the handshake existed start sending logs right away.
+type Hello struct {
+	Version     int      `json:"version"`
+	MinVersion  int      `json:"min_version,omitempty"` // oldest version the agent can fall back to
+	Compression []string `json:"compression,omitempty"` // codecs the agent can send, preferred first
+
+	// who the agent is, from version 3 on
+	AgentID      string   `json:"agent_id,omitempty"` // random UUID the agent keeps across restarts
+	AgentVersion string   `json:"agent_version,omitempty"`
+	Hostname     string   `json:"hostname,omitempty"`
+	OS           string   `json:"os,omitempty"`
+	Kernel       string   `json:"kernel,omitempty"`
+	Targets      []string `json:"targets,omitempty"` // names of the configured targets
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// the Label of the profile the agent runs, empty for its own config, and
+	// why it rejected the last profile it was sent, from version 4 on
+	ConfigVersion string `json:"config_version,omitempty"`
+	ConfigError   string `json:"config_error,omitempty"`
+
+	// how often targets should produce a log, keyed by the name their logs carry
+	Expect map[string]time.Duration `json:"expect,omitempty"`
+}
+
+// Welcome is the server's answer to a Hello, naming the codec the agent's
+// stream is compressed with from then on and the version both sides speak.
+// A server turning the agent away only sets Error, then hangs up.
+type Welcome struct {
+	Version     int    `json:"version"`
+	Compression string `json:"compression"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Handshake wraps handshake messages on the wire. A log from an old agent
+// decodes into a Handshake with every field nil.
+type Handshake struct {
+	Hello   *Hello   `json:"hello,omitempty"`
+	Welcome *Welcome `json:"welcome,omitempty"`
+}
+
+// Negotiate returns the version spoken with a peer that speaks versions
+// minVersion through version, or an error if the ranges don't overlap.
+// A minVersion of 0 means the peer didn't say, so only version counts.
+func Negotiate(version, minVersion int) (int, error) {
+	if version < MinVersion {
+		return 0, fmt.Errorf("peer speaks protocol v%d, but this build needs v%d or newer", version, MinVersion)
+	}
+	if minVersion > Version {
+		return 0, fmt.Errorf("peer needs protocol v%d or newer, but this build speaks up to v%d", minVersion, Version)
+	}
+	return min(version, Version), nil
+}
@@ -0,0 +1,24 @@
+package protocol
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		version, minVersion int
+		want                int
+		ok                  bool
+	}{
+		{Version, MinVersion, Version, true},
+		{Version + 5, 0, Version, true},       // a newer peer that can fall back
+		{Version + 5, Version, Version, true}, // ...just far enough
+		{Version + 5, Version + 1, 0, false},  // a newer peer that can't
+		{MinVersion, 0, MinVersion, true},     // the oldest peer we still speak to
+		{MinVersion - 1, 0, 0, false},         // one too old
+	}
+	for _, c := range cases {
+		got, err := Negotiate(c.version, c.minVersion)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("Negotiate(%d, %d) = %d, %v; want %d, ok=%v", c.version, c.minVersion, got, err, c.want, c.ok)
+		}
+	}
+}
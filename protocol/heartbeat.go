@@ -0,0 +1,43 @@
+package protocol
+
+// HeartbeatModule is the module of the log an agent sends every minute as proof of life
+const HeartbeatModule = "Heartbeat"
+
+// Heartbeat is the parsed field of a heartbeat log: how the agent is doing.
+// Agents from before telemetry only send Seq, Filtered, and Transport.
+type Heartbeat struct {
+	Seq          int64   `json:"seq"`
+	Version      string  `json:"version,omitempty"`
+	Uptime       int64   `json:"uptime,omitempty"` // seconds since the agent started
+	RSS          int64   `json:"rss,omitempty"`    // resident memory in bytes
+	CPU          float64 `json:"cpu,omitempty"`    // percent of one core since the previous heartbeat
+	QueueDepth   int     `json:"queue_depth"`      // logs spooled but not yet acknowledged
+	SpoolBytes   int64   `json:"spool_bytes"`
+	SpoolDropped uint64  `json:"spool_dropped"` // logs lost because the spool was full
+	ConfigHash   string  `json:"config_hash,omitempty"`
+	// the profile the agent runs and why it rejected the last one, as in the Hello
+	ConfigVersion string `json:"config_version,omitempty"`
+	ConfigError   string `json:"config_error,omitempty"`
+
+	Targets   map[string]TargetStats `json:"targets,omitempty"`  // by target or service name
+	Filtered  map[string]uint64      `json:"filtered,omitempty"` // same as Targets' Dropped, kept for older servers
+	Transport TransportStats         `json:"transport"`
+}
+
+// TargetStats counts what happened to one target's logs since the agent started
+type TargetStats struct {
+	Read          uint64 `json:"read"`
+	Parsed        uint64 `json:"parsed"`
+	Failed        uint64 `json:"failed"`  // the module couldn't parse them, they were sent raw
+	Dropped       uint64 `json:"dropped"` // by filter rules
+	LastError     string `json:"last_error,omitempty"`
+	LastErrorTime int64  `json:"last_error_time,omitempty"`
+}
+
+// TransportStats is what has been sent to the server since the agent started
+type TransportStats struct {
+	Compression string  `json:"compression"`
+	RawBytes    int64   `json:"raw_bytes"`
+	WireBytes   int64   `json:"wire_bytes"`
+	Ratio       float64 `json:"ratio"`
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/TLop503/LogCrunch/structs"
+	"gopkg.in/yaml.v3"
+)
+
+// ProfileVersion is the first version where the server pushes config
+// profiles, wrapping everything it sends after the welcome in a Downlink
+const ProfileVersion = 4
+
+// Profile is a config the server assigns an agent: the Targets, Services and
+// Redact sections of an agent config, in YAML, which replace the ones in the
+// agent's own config file. A Profile without a Name takes the agent's profile
+// away, and it goes back to its own config.
+type Profile struct {
+	Name    string `json:"name,omitempty"`
+	Version int64  `json:"version,omitempty"` // goes up every time the profile is saved
+	Config  string `json:"config,omitempty"`
+}
+
+// Label names the profile and its version, e.g. "web@3", the way agents
+// report the config they run. It is empty without a profile.
+func (p Profile) Label() string {
+	if p.Name == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s@%d", p.Name, p.Version)
+}
+
+// ProfileConfig is what a profile can set
+type ProfileConfig struct {
+	Targets  []structs.Target     `yaml:"Targets"`
+	Services []structs.Service    `yaml:"Services"`
+	Redact   []structs.RedactRule `yaml:"Redact,omitempty"`
+}
+
+// Parse decodes the profile's config. Sections a profile can't set and
+// misspelled keys are errors, so they aren't silently ignored on every agent.
+func (p Profile) Parse() (ProfileConfig, error) {
+	var cfg ProfileConfig
+	dec := yaml.NewDecoder(strings.NewReader(p.Config))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return ProfileConfig{}, fmt.Errorf("profile %s: %w", p.Name, err)
+	}
+	return cfg, nil
+}
+
+// Downlink wraps what the server sends an agent after the welcome, from
+// ProfileVersion on: an ack, or the agent's profile when it connects and
+// whenever it changes
+type Downlink struct {
+	Ack     *Ack     `json:"ack,omitempty"`
+	Profile *Profile `json:"profile,omitempty"`
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import "testing"
+
+func TestProfileParse(t *testing.T) {
+	p := Profile{Name: "web", Version: 3, Config: `
+Targets:
+  - name: nginx
+    path: /var/log/nginx/access.log
+    module: apache
+Redact:
+  - preset: password
+`}
+	cfg, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(cfg.Targets) != 1 || cfg.Targets[0].Module != "apache" || len(cfg.Redact) != 1 {
+		t.Errorf("Unexpected config: %+v", cfg)
+	}
+	if p.Label() != "web@3" || (Profile{}).Label() != "" {
+		t.Errorf("Unexpected labels %q and %q", p.Label(), Profile{}.Label())
+	}
+
+	for _, config := range []string{
+		"Spool:\n  dir: /tmp\n",                // not something a profile sets
+		"Targets:\n  - name: a\n    pth: /x\n", // misspelled
+		"Targets: [",                           // not YAML
+	} {
+		if _, err := (Profile{Name: "bad", Config: config}).Parse(); err == nil {
+			t.Errorf("Expected %q to be rejected", config)
+		}
+	}
+	if cfg, err := (Profile{Name: "empty"}).Parse(); err != nil || len(cfg.Targets) != 0 {
+		t.Errorf("Expected an empty profile to parse, got %+v (%v)", cfg, err)
+	}
+}
@@ -0,0 +1,254 @@
+package agents
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned for agents that have never connected
+var ErrNotFound = errors.New("no such agent")
+
+// ErrIdentityMismatch is returned when an agent connects with an ID that is
+// already on record for a different client certificate
+var ErrIdentityMismatch = errors.New("agent ID belongs to another certificate")
+
+// Agent is everything the server remembers about an agent between restarts
+type Agent struct {
+	ID              string
+	Hostname        string
+	Alias           string
+	Identity        string // name on the agent's client certificate
+	RemoteAddr      string // the address it last connected from
+	Addresses       []string
+	AgentVersion    string
+	OS              string
+	Kernel          string
+	Targets         []string
+	ProtocolVersion int
+	FirstSeen       time.Time
+	LastSeen        time.Time
+	HeartbeatSeq    int64
+	HeartbeatAt     time.Time // zero until the first heartbeat
+	Offline         bool      // missed too many heartbeats
+	Tags            []string  // set in the web UI, for assigning profiles
+	ConfigVersion   string    // Label of the profile the agent runs, empty for its own config
+	ConfigError     string    // why it rejected the last profile it was sent
+}
+
+// Connected records that an agent connected at a.LastSeen, adding it to the
+// inventory the first time. Empty details don't overwrite ones already known,
+// so an agent that restarts without a certificate keeps its old identity on record.
+// An ID first seen with one certificate can't be taken by another: that
+// returns ErrIdentityMismatch and records nothing.
+func Connected(db *sql.DB, a Agent) error {
+	targets, err := json.Marshal(a.Targets)
+	if err != nil {
+		return fmt.Errorf("failed to encode targets: %w", err)
+	}
+	if a.Targets == nil {
+		targets = []byte("[]")
+	}
+	seen := a.LastSeen.Unix()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+	INSERT INTO agents (id, hostname, identity, remote_addr, agent_version, os, kernel, targets, protocol_version, first_seen, last_seen)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+		hostname = CASE WHEN excluded.hostname != '' THEN excluded.hostname ELSE hostname END,
+		identity = CASE WHEN excluded.identity != '' THEN excluded.identity ELSE identity END,
+		remote_addr = excluded.remote_addr,
+		agent_version = CASE WHEN excluded.agent_version != '' THEN excluded.agent_version ELSE agent_version END,
+		os = CASE WHEN excluded.os != '' THEN excluded.os ELSE os END,
+		kernel = CASE WHEN excluded.kernel != '' THEN excluded.kernel ELSE kernel END,
+		targets = excluded.targets,
+		protocol_version = excluded.protocol_version,
+		last_seen = excluded.last_seen
+	WHERE agents.identity = '' OR excluded.identity = '' OR agents.identity = excluded.identity
+	`, a.ID, a.Hostname, a.Identity, a.RemoteAddr, a.AgentVersion, a.OS, a.Kernel, string(targets), a.ProtocolVersion, seen, seen)
+	if err != nil {
+		return fmt.Errorf("failed to record agent: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to record agent: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("agent %s as %q: %w", a.ID, a.Identity, ErrIdentityMismatch)
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO agent_addresses (agent_id, address, first_seen, last_seen)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT (agent_id, address) DO UPDATE SET last_seen = excluded.last_seen
+	`, a.ID, a.RemoteAddr, seen, seen)
+	if err != nil {
+		return fmt.Errorf("failed to record agent address: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit agent: %w", err)
+	}
+	return nil
+}
+
+// Seen updates when an agent was last heard from, and its hostname if it is known now
+func Seen(db *sql.DB, id, hostname string, at time.Time) error {
+	_, err := db.Exec(`
+	UPDATE agents SET
+		last_seen = MAX(last_seen, ?),
+		hostname = CASE WHEN ? != '' THEN ? ELSE hostname END
+	WHERE id = ?
+	`, at.Unix(), hostname, hostname, id)
+	if err != nil {
+		return fmt.Errorf("failed to update agent: %w", err)
+	}
+	return nil
+}
+
+// Heartbeat records the sequence number of an agent's latest heartbeat
+func Heartbeat(db *sql.DB, id string, seq int64, at time.Time) error {
+	_, err := db.Exec(`
+	UPDATE agents SET heartbeat_seq = ?, heartbeat_at = ?, last_seen = MAX(last_seen, ?)
+	WHERE id = ?
+	`, seq, at.Unix(), at.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+	return nil
+}
+
+// SetOffline records whether the watchdog considers an agent offline
+func SetOffline(db *sql.DB, id string, offline bool) error {
+	_, err := db.Exec(`UPDATE agents SET offline = ? WHERE id = ?`, offline, id)
+	if err != nil {
+		return fmt.Errorf("failed to update agent status: %w", err)
+	}
+	return nil
+}
+
+// SetAlias names an agent for display, or clears the name if alias is empty
+func SetAlias(db *sql.DB, id, alias string) error {
+	res, err := db.Exec(`UPDATE agents SET alias = ? WHERE id = ?`, alias, id)
+	if err != nil {
+		return fmt.Errorf("failed to set alias: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetTags replaces an agent's tags
+func SetTags(db *sql.DB, id string, tags []string) error {
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("failed to encode tags: %w", err)
+	}
+	if tags == nil {
+		data = []byte("[]")
+	}
+	res, err := db.Exec(`UPDATE agents SET tags = ? WHERE id = ?`, string(data), id)
+	if err != nil {
+		return fmt.Errorf("failed to set tags: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetConfigStatus records the profile an agent reports running, and why it
+// rejected the last one it was sent
+func SetConfigStatus(db *sql.DB, id, version, configErr string) error {
+	_, err := db.Exec(`UPDATE agents SET config_version = ?, config_error = ? WHERE id = ?`, version, configErr, id)
+	if err != nil {
+		return fmt.Errorf("failed to record config status: %w", err)
+	}
+	return nil
+}
+
+const selectAgents = `
+SELECT id, hostname, alias, identity, remote_addr, agent_version, os, kernel, targets,
+	protocol_version, first_seen, last_seen, heartbeat_seq, heartbeat_at, offline,
+	tags, config_version, config_error
+FROM agents
+`
+
+// Get returns one agent, with every address it has connected from
+func Get(db *sql.DB, id string) (Agent, error) {
+	rows, err := db.Query(selectAgents+`WHERE id = ?`, id)
+	if err != nil {
+		return Agent{}, fmt.Errorf("failed to look up agent: %w", err)
+	}
+	list, err := scanAgents(rows)
+	if err != nil {
+		return Agent{}, err
+	}
+	if len(list) == 0 {
+		return Agent{}, ErrNotFound
+	}
+	a := list[0]
+
+	addrs, err := db.Query(`
+	SELECT address FROM agent_addresses WHERE agent_id = ? ORDER BY last_seen DESC
+	`, id)
+	if err != nil {
+		return Agent{}, fmt.Errorf("failed to list agent addresses: %w", err)
+	}
+	defer addrs.Close()
+	for addrs.Next() {
+		var addr string
+		if err := addrs.Scan(&addr); err != nil {
+			return Agent{}, fmt.Errorf("failed to scan agent address: %w", err)
+		}
+		a.Addresses = append(a.Addresses, addr)
+	}
+	return a, addrs.Err()
+}
+
+// List returns every agent ever seen, most recently seen first
+func List(db *sql.DB) ([]Agent, error) {
+	rows, err := db.Query(selectAgents + `ORDER BY last_seen DESC, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agents: %w", err)
+	}
+	return scanAgents(rows)
+}
+
+// scanAgents reads and closes rows from selectAgents
+func scanAgents(rows *sql.Rows) ([]Agent, error) {
+	defer rows.Close()
+
+	var list []Agent
+	for rows.Next() {
+		var a Agent
+		var targets, tags string
+		var first, last int64
+		var seq, beat sql.NullInt64
+		err := rows.Scan(&a.ID, &a.Hostname, &a.Alias, &a.Identity, &a.RemoteAddr, &a.AgentVersion, &a.OS, &a.Kernel,
+			&targets, &a.ProtocolVersion, &first, &last, &seq, &beat, &a.Offline,
+			&tags, &a.ConfigVersion, &a.ConfigError)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan agent: %w", err)
+		}
+		if err := json.Unmarshal([]byte(targets), &a.Targets); err != nil {
+			return nil, fmt.Errorf("failed to decode targets of agent %s: %w", a.ID, err)
+		}
+		if err := json.Unmarshal([]byte(tags), &a.Tags); err != nil {
+			return nil, fmt.Errorf("failed to decode tags of agent %s: %w", a.ID, err)
+		}
+		a.FirstSeen, a.LastSeen = time.Unix(first, 0), time.Unix(last, 0)
+		if beat.Valid {
+			a.HeartbeatSeq, a.HeartbeatAt = seq.Int64, time.Unix(beat.Int64, 0)
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,250 @@
+package agents_test
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/server/db/agents"
+)
+
+func TestInventorySurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agents.sqlite")
+	db, err := agents.InitAgentDB(path)
+	if err != nil {
+		t.Fatalf("InitAgentDB failed: %v", err)
+	}
+
+	first := time.Unix(1_700_000_000, 0)
+	err = agents.Connected(db, agents.Agent{
+		ID: "abc", Hostname: "web01", Identity: "web01", RemoteAddr: "10.0.0.5",
+		AgentVersion: "1.0", Targets: []string{"syslog"}, ProtocolVersion: 3, LastSeen: first,
+	})
+	if err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+	if err := agents.SetAlias(db, "abc", "frontend"); err != nil {
+		t.Fatalf("SetAlias failed: %v", err)
+	}
+	if err := agents.SetAlias(db, "nope", "x"); !errors.Is(err, agents.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown agent, got %v", err)
+	}
+
+	// reconnect from a new address, without a certificate this time
+	later := first.Add(time.Hour)
+	err = agents.Connected(db, agents.Agent{ID: "abc", RemoteAddr: "10.0.0.6", AgentVersion: "1.1", LastSeen: later})
+	if err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+	if err := agents.Heartbeat(db, "abc", 7, later.Add(time.Minute)); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	if err := agents.SetOffline(db, "abc", true); err != nil {
+		t.Fatalf("SetOffline failed: %v", err)
+	}
+	db.Close()
+
+	db, err = agents.InitAgentDB(path)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	defer db.Close()
+
+	a, err := agents.Get(db, "abc")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if a.Alias != "frontend" || a.Hostname != "web01" || a.Identity != "web01" || a.AgentVersion != "1.1" {
+		t.Errorf("Unexpected details after reconnect: %+v", a)
+	}
+	if !a.FirstSeen.Equal(first) || !a.LastSeen.Equal(later.Add(time.Minute)) {
+		t.Errorf("Expected first/last seen %v/%v, got %v/%v", first, later.Add(time.Minute), a.FirstSeen, a.LastSeen)
+	}
+	if a.RemoteAddr != "10.0.0.6" || !slices.Equal(a.Addresses, []string{"10.0.0.6", "10.0.0.5"}) {
+		t.Errorf("Unexpected addresses: %q %v", a.RemoteAddr, a.Addresses)
+	}
+	if a.HeartbeatSeq != 7 || a.HeartbeatAt.IsZero() {
+		t.Errorf("Expected heartbeat 7, got %d at %v", a.HeartbeatSeq, a.HeartbeatAt)
+	}
+	if !a.Offline {
+		t.Error("Expected the agent to still be offline after reopening")
+	}
+
+	list, err := agents.List(db)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Expected one agent, got %d (%v)", len(list), err)
+	}
+	if _, err := agents.Get(db, "nope"); !errors.Is(err, agents.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTelemetryIsKeptAsATimeSeries(t *testing.T) {
+	db, err := agents.InitAgentDB(filepath.Join(t.TempDir(), "agents.sqlite"))
+	if err != nil {
+		t.Fatalf("InitAgentDB failed: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Unix(1_700_000_000, 0)
+	if err := agents.Connected(db, agents.Agent{ID: "abc", RemoteAddr: "10.0.0.5", LastSeen: start}); err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+	for i := range 3 {
+		hb := protocol.Heartbeat{
+			Seq: int64(i),
+			RSS: 1 << 20,
+			Targets: map[string]protocol.TargetStats{
+				"auth": {Read: uint64(10 * i), Failed: uint64(i), LastError: "no match"},
+			},
+		}
+		if err := agents.AddTelemetry(db, "abc", start.Add(time.Duration(i)*time.Minute), hb); err != nil {
+			t.Fatalf("AddTelemetry failed: %v", err)
+		}
+	}
+
+	list, err := agents.ListTelemetry(db, "abc", start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("ListTelemetry failed: %v", err)
+	}
+	if len(list) != 2 || list[0].Seq != 2 || list[1].Seq != 1 {
+		t.Fatalf("Expected heartbeats 2 and 1, newest first, got %+v", list)
+	}
+	if auth := list[0].Targets["auth"]; auth.Read != 20 || auth.Failed != 2 || auth.LastError != "no match" {
+		t.Errorf("Unexpected target stats: %+v", auth)
+	}
+
+	n, err := agents.PruneTelemetry(db, start.Add(2*time.Minute))
+	if err != nil || n != 2 {
+		t.Errorf("Expected 2 heartbeats pruned, got %d (%v)", n, err)
+	}
+}
+
+func TestProfilesAreAssignedByIDAliasAndTag(t *testing.T) {
+	db, err := agents.InitAgentDB(filepath.Join(t.TempDir(), "agents.sqlite"))
+	if err != nil {
+		t.Fatalf("InitAgentDB failed: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Unix(1_700_000_000, 0)
+	if err := agents.Connected(db, agents.Agent{ID: "abc", RemoteAddr: "10.0.0.5", LastSeen: now}); err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+	if err := agents.SetTags(db, "abc", []string{"web", "eu"}); err != nil {
+		t.Fatalf("SetTags failed: %v", err)
+	}
+	for _, name := range []string{"base", "europe", "frontend", "special"} {
+		if _, err := agents.SaveProfile(db, name, "Targets: []\n"); err != nil {
+			t.Fatalf("SaveProfile failed: %v", err)
+		}
+	}
+	if p, err := agents.SaveProfile(db, "base", "Services: []\n"); err != nil || p.Version != 2 {
+		t.Fatalf("Expected saving again to bump the version to 2, got %+v (%v)", p, err)
+	}
+
+	profileFor := func() string {
+		t.Helper()
+		a, err := agents.Get(db, "abc")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		p, _, ok, err := agents.ProfileFor(db, a)
+		if err != nil {
+			t.Fatalf("ProfileFor failed: %v", err)
+		}
+		if !ok {
+			return ""
+		}
+		return p.Name
+	}
+
+	if got := profileFor(); got != "" {
+		t.Fatalf("Expected no profile yet, got %s", got)
+	}
+	assign := func(kind, value, profile string) {
+		t.Helper()
+		if err := agents.Assign(db, agents.Assignment{Kind: kind, Value: value, Profile: profile}); err != nil {
+			t.Fatalf("Assign failed: %v", err)
+		}
+	}
+	assign(agents.AssignTag, "web", "base")
+	assign(agents.AssignTag, "eu", "europe")
+	if got := profileFor(); got != "europe" {
+		t.Errorf("Expected the first tag alphabetically to win, got %s", got)
+	}
+	assign(agents.AssignAlias, "frontend", "frontend")
+	agents.SetAlias(db, "abc", "frontend")
+	if got := profileFor(); got != "frontend" {
+		t.Errorf("Expected the alias to win over tags, got %s", got)
+	}
+	assign(agents.AssignID, "abc", "special")
+	if got := profileFor(); got != "special" {
+		t.Errorf("Expected the ID to win over the alias, got %s", got)
+	}
+
+	if err := agents.DeleteProfile(db, "special"); err != nil {
+		t.Fatalf("DeleteProfile failed: %v", err)
+	}
+	if got := profileFor(); got != "frontend" {
+		t.Errorf("Expected deleting a profile to drop its assignments, got %s", got)
+	}
+	if err := agents.Assign(db, agents.Assignment{Kind: agents.AssignTag, Value: "x", Profile: "nope"}); !errors.Is(err, agents.ErrProfileNotFound) {
+		t.Errorf("Expected assigning a missing profile to fail, got %v", err)
+	}
+	if err := agents.Assign(db, agents.Assignment{Kind: "host", Value: "x", Profile: "base"}); err == nil {
+		t.Error("Expected an unknown assignment kind to fail")
+	}
+
+	if err := agents.SetConfigStatus(db, "abc", "frontend@1", ""); err != nil {
+		t.Fatalf("SetConfigStatus failed: %v", err)
+	}
+	a, _ := agents.Get(db, "abc")
+	if a.ConfigVersion != "frontend@1" || !slices.Equal(a.Tags, []string{"web", "eu"}) {
+		t.Errorf("Unexpected agent: %+v", a)
+	}
+}
+
+func TestIDStaysWithItsCertificate(t *testing.T) {
+	db, err := agents.InitAgentDB(filepath.Join(t.TempDir(), "agents.sqlite"))
+	if err != nil {
+		t.Fatalf("InitAgentDB failed: %v", err)
+	}
+	first := time.Unix(1_700_000_000, 0)
+	if err := agents.Connected(db, agents.Agent{ID: "abc", Identity: "web01", RemoteAddr: "10.0.0.5", LastSeen: first}); err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+
+	// another enrolled agent claiming the ID is turned away and changes nothing
+	err = agents.Connected(db, agents.Agent{ID: "abc", Identity: "db02", RemoteAddr: "10.0.0.9", LastSeen: first.Add(time.Minute)})
+	if !errors.Is(err, agents.ErrIdentityMismatch) {
+		t.Fatalf("Expected ErrIdentityMismatch, got %v", err)
+	}
+	a, err := agents.Get(db, "abc")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if a.Identity != "web01" || a.RemoteAddr != "10.0.0.5" || !a.LastSeen.Equal(first) {
+		t.Errorf("Impostor changed the agent: %+v", a)
+	}
+	if slices.Contains(a.Addresses, "10.0.0.9") {
+		t.Errorf("Impostor's address was recorded: %v", a.Addresses)
+	}
+
+	// the same certificate, and agents without one, still connect
+	for _, identity := range []string{"web01", ""} {
+		if err := agents.Connected(db, agents.Agent{ID: "abc", Identity: identity, RemoteAddr: "10.0.0.6", LastSeen: first.Add(time.Hour)}); err != nil {
+			t.Errorf("Connected as %q failed: %v", identity, err)
+		}
+	}
+	// an agent first seen without a certificate takes the first one it shows
+	if err := agents.Connected(db, agents.Agent{ID: "new", RemoteAddr: "10.0.0.7", LastSeen: first}); err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+	if err := agents.Connected(db, agents.Agent{ID: "new", Identity: "app03", RemoteAddr: "10.0.0.7", LastSeen: first}); err != nil {
+		t.Errorf("Connected with a first certificate failed: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package agents
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/TLop503/LogCrunch/server/db/core"
+)
+
+// agents are keyed by the ID from their hello, or by IP for agents that predate it
+const createAgentsTable = `
+CREATE TABLE IF NOT EXISTS agents (
+    id               TEXT PRIMARY KEY,
+    hostname         TEXT NOT NULL DEFAULT '',
+    alias            TEXT NOT NULL DEFAULT '',
+    identity         TEXT NOT NULL DEFAULT '',
+    remote_addr      TEXT NOT NULL DEFAULT '',
+    agent_version    TEXT NOT NULL DEFAULT '',
+    os               TEXT NOT NULL DEFAULT '',
+    kernel           TEXT NOT NULL DEFAULT '',
+    targets          TEXT NOT NULL DEFAULT '[]',
+    protocol_version INTEGER NOT NULL DEFAULT 0,
+    first_seen       INTEGER NOT NULL,
+    last_seen        INTEGER NOT NULL,
+    heartbeat_seq    INTEGER,
+    heartbeat_at     INTEGER
+);`
+
+// every address an agent has connected from
+const createAddressesTable = `
+CREATE TABLE IF NOT EXISTS agent_addresses (
+    agent_id   TEXT NOT NULL,
+    address    TEXT NOT NULL,
+    first_seen INTEGER NOT NULL,
+    last_seen  INTEGER NOT NULL,
+    PRIMARY KEY (agent_id, address),
+    FOREIGN KEY (agent_id) REFERENCES agents(id) ON DELETE CASCADE
+);`
+
+// one row per heartbeat, with the agent's full report
+const createHeartbeatsTable = `
+CREATE TABLE IF NOT EXISTS heartbeats (
+    agent_id    TEXT NOT NULL,
+    time        INTEGER NOT NULL,
+    seq         INTEGER NOT NULL,
+    rss         INTEGER NOT NULL DEFAULT 0,
+    cpu         REAL NOT NULL DEFAULT 0,
+    queue_depth INTEGER NOT NULL DEFAULT 0,
+    spool_bytes INTEGER NOT NULL DEFAULT 0,
+    config_hash TEXT NOT NULL DEFAULT '',
+    report      JSON NOT NULL,
+    FOREIGN KEY (agent_id) REFERENCES agents(id) ON DELETE CASCADE
+);`
+
+// config profiles pushed to agents, see protocol.Profile
+const createProfilesTable = `
+CREATE TABLE IF NOT EXISTS profiles (
+    name       TEXT PRIMARY KEY,
+    config     TEXT NOT NULL,
+    version    INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);`
+
+// which agents run which profile: kind is id, alias or tag, and value the
+// agent ID, alias or tag it matches
+const createAssignmentsTable = `
+CREATE TABLE IF NOT EXISTS profile_assignments (
+    kind    TEXT NOT NULL,
+    value   TEXT NOT NULL,
+    profile TEXT NOT NULL,
+    PRIMARY KEY (kind, value),
+    FOREIGN KEY (profile) REFERENCES profiles(name) ON DELETE CASCADE
+);`
+
+const createIndexes = `
+CREATE INDEX IF NOT EXISTS idx_agents_last_seen ON agents(last_seen);
+CREATE INDEX IF NOT EXISTS idx_heartbeats_agent_time ON heartbeats(agent_id, time);
+CREATE INDEX IF NOT EXISTS idx_heartbeats_time ON heartbeats(time);
+`
+
+const enableForeignKeys = `PRAGMA foreign_keys = ON;`
+
+// agentStatements contains all DDL statements needed for the agent inventory
+var agentStatements = []string{
+	enableForeignKeys,
+	createAgentsTable,
+	createAddressesTable,
+	createHeartbeatsTable,
+	createProfilesTable,
+	createAssignmentsTable,
+	createIndexes,
+}
+
+// agentMigrations are columns added after the agents table was first released
+var agentMigrations = []struct {
+	table, column, definition string
+}{
+	{"agents", "offline", "INTEGER NOT NULL DEFAULT 0"}, // set by the watchdog after missed heartbeats
+	{"agents", "tags", "TEXT NOT NULL DEFAULT '[]'"},
+	{"agents", "config_version", "TEXT NOT NULL DEFAULT ''"}, // Label of the profile the agent reports running
+	{"agents", "config_error", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// InitAgentDB initializes the agent inventory SQLite database with tables and indexes.
+// dbPath is the path to the .sqlite file.
+func InitAgentDB(dbPath string) (*sql.DB, error) {
+	db, err := core.InitDB(dbPath, agentStatements)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize agent database: %w", err)
+	}
+
+	for _, m := range agentMigrations {
+		if err := core.AddColumnIfMissing(db, m.table, m.column, m.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to migrate agent database: %w", err)
+		}
+	}
+	return db, nil
+}
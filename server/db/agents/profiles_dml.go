@@ -0,0 +1,219 @@
+package agents
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+)
+
+// Assignment kinds. An agent runs the profile assigned to its ID, else to its
+// alias, else to the first of its tags (alphabetically) that has one.
+const (
+	AssignID    = "id"
+	AssignAlias = "alias"
+	AssignTag   = "tag"
+)
+
+// ErrProfileNotFound is returned for profiles that don't exist
+var ErrProfileNotFound = errors.New("no such profile")
+
+// Profile is a config profile as stored. Version goes up on every save.
+type Profile struct {
+	Name      string
+	Config    string
+	Version   int64
+	UpdatedAt time.Time
+}
+
+// Protocol returns the profile as it is sent to agents
+func (p Profile) Protocol() protocol.Profile {
+	return protocol.Profile{Name: p.Name, Version: p.Version, Config: p.Config}
+}
+
+// Assignment gives the agents whose ID, alias or tag is Value a profile
+type Assignment struct {
+	Kind    string
+	Value   string
+	Profile string
+}
+
+// SaveProfile creates a profile or replaces its config, bumping its version
+func SaveProfile(db *sql.DB, name, config string) (Profile, error) {
+	_, err := db.Exec(`
+	INSERT INTO profiles (name, config, version, updated_at)
+	VALUES (?, ?, 1, ?)
+	ON CONFLICT (name) DO UPDATE SET
+		config = excluded.config,
+		version = version + 1,
+		updated_at = excluded.updated_at
+	`, name, config, time.Now().Unix())
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to save profile %s: %w", name, err)
+	}
+	return GetProfile(db, name)
+}
+
+// GetProfile returns one profile
+func GetProfile(db *sql.DB, name string) (Profile, error) {
+	row := db.QueryRow(`SELECT name, config, version, updated_at FROM profiles WHERE name = ?`, name)
+	p, err := scanProfile(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, ErrProfileNotFound
+	}
+	return p, err
+}
+
+// ListProfiles returns every profile, by name
+func ListProfiles(db *sql.DB) ([]Profile, error) {
+	rows, err := db.Query(`SELECT name, config, version, updated_at FROM profiles ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list profiles: %w", err)
+	}
+	defer rows.Close()
+
+	var list []Profile
+	for rows.Next() {
+		p, err := scanProfile(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// scanProfile reads a profile from a row
+func scanProfile(row interface{ Scan(...any) error }) (Profile, error) {
+	var p Profile
+	var updated int64
+	if err := row.Scan(&p.Name, &p.Config, &p.Version, &updated); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return p, err
+		}
+		return p, fmt.Errorf("failed to scan profile: %w", err)
+	}
+	p.UpdatedAt = time.Unix(updated, 0)
+	return p, nil
+}
+
+// DeleteProfile deletes a profile and its assignments
+func DeleteProfile(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// foreign keys are only enforced on the connection that turned them on
+	if _, err := tx.Exec(`DELETE FROM profile_assignments WHERE profile = ?`, name); err != nil {
+		return fmt.Errorf("failed to delete assignments of profile %s: %w", name, err)
+	}
+	res, err := tx.Exec(`DELETE FROM profiles WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete profile %s: %w", name, err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrProfileNotFound
+	}
+	return tx.Commit()
+}
+
+// Assign gives a profile to the agents an assignment matches, replacing the
+// profile it gave them before
+func Assign(db *sql.DB, a Assignment) error {
+	switch a.Kind {
+	case AssignID, AssignAlias, AssignTag:
+	default:
+		return fmt.Errorf("unknown assignment kind %q, expected id, alias or tag", a.Kind)
+	}
+	if a.Value == "" {
+		return fmt.Errorf("assignment needs a %s to match", a.Kind)
+	}
+	if _, err := GetProfile(db, a.Profile); err != nil {
+		return err
+	}
+
+	_, err := db.Exec(`
+	INSERT INTO profile_assignments (kind, value, profile) VALUES (?, ?, ?)
+	ON CONFLICT (kind, value) DO UPDATE SET profile = excluded.profile
+	`, a.Kind, a.Value, a.Profile)
+	if err != nil {
+		return fmt.Errorf("failed to assign profile %s: %w", a.Profile, err)
+	}
+	return nil
+}
+
+// Unassign removes the assignment for an ID, alias or tag
+func Unassign(db *sql.DB, kind, value string) error {
+	_, err := db.Exec(`DELETE FROM profile_assignments WHERE kind = ? AND value = ?`, kind, value)
+	if err != nil {
+		return fmt.Errorf("failed to remove assignment: %w", err)
+	}
+	return nil
+}
+
+// ListAssignments returns every assignment, by profile
+func ListAssignments(db *sql.DB) ([]Assignment, error) {
+	rows, err := db.Query(`SELECT kind, value, profile FROM profile_assignments ORDER BY profile, kind, value`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list assignments: %w", err)
+	}
+	defer rows.Close()
+
+	var list []Assignment
+	for rows.Next() {
+		var a Assignment
+		if err := rows.Scan(&a.Kind, &a.Value, &a.Profile); err != nil {
+			return nil, fmt.Errorf("failed to scan assignment: %w", err)
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// ProfileFor returns the profile an agent should run and the assignment that
+// gave it. ok is false for agents no assignment matches.
+func ProfileFor(db *sql.DB, agent Agent) (p Profile, via Assignment, ok bool, err error) {
+	list, err := ListAssignments(db)
+	if err != nil {
+		return p, via, false, err
+	}
+	via, ok = Match(list, agent)
+	if !ok {
+		return p, via, false, nil
+	}
+	p, err = GetProfile(db, via.Profile)
+	return p, via, err == nil, err
+}
+
+// Match picks the assignment that applies to an agent, see AssignID
+func Match(list []Assignment, agent Agent) (Assignment, bool) {
+	find := func(kind, value string) (Assignment, bool) {
+		i := slices.IndexFunc(list, func(a Assignment) bool { return a.Kind == kind && a.Value == value })
+		if i < 0 {
+			return Assignment{}, false
+		}
+		return list[i], true
+	}
+
+	if a, ok := find(AssignID, agent.ID); ok {
+		return a, true
+	}
+	if agent.Alias != "" {
+		if a, ok := find(AssignAlias, agent.Alias); ok {
+			return a, true
+		}
+	}
+	tags := slices.Clone(agent.Tags)
+	slices.Sort(tags)
+	for _, tag := range tags {
+		if a, ok := find(AssignTag, tag); ok {
+			return a, true
+		}
+	}
+	return Assignment{}, false
+}
@@ -0,0 +1,70 @@
+package agents
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+)
+
+// Telemetry is one heartbeat report, as received at Time
+type Telemetry struct {
+	Time time.Time
+	protocol.Heartbeat
+}
+
+// AddTelemetry stores a heartbeat report from an agent
+func AddTelemetry(db *sql.DB, id string, at time.Time, hb protocol.Heartbeat) error {
+	report, err := json.Marshal(hb)
+	if err != nil {
+		return fmt.Errorf("failed to encode heartbeat: %w", err)
+	}
+	_, err = db.Exec(`
+	INSERT INTO heartbeats (agent_id, time, seq, rss, cpu, queue_depth, spool_bytes, config_hash, report)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, id, at.Unix(), hb.Seq, hb.RSS, hb.CPU, hb.QueueDepth, hb.SpoolBytes, hb.ConfigHash, string(report))
+	if err != nil {
+		return fmt.Errorf("failed to store heartbeat: %w", err)
+	}
+	return nil
+}
+
+// ListTelemetry returns an agent's heartbeat reports since a time, newest first
+func ListTelemetry(db *sql.DB, id string, since time.Time) ([]Telemetry, error) {
+	rows, err := db.Query(`
+	SELECT time, report FROM heartbeats
+	WHERE agent_id = ? AND time >= ?
+	ORDER BY time DESC, rowid DESC
+	`, id, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list heartbeats: %w", err)
+	}
+	defer rows.Close()
+
+	var list []Telemetry
+	for rows.Next() {
+		var t Telemetry
+		var ts int64
+		var report string
+		if err := rows.Scan(&ts, &report); err != nil {
+			return nil, fmt.Errorf("failed to scan heartbeat: %w", err)
+		}
+		if err := json.Unmarshal([]byte(report), &t.Heartbeat); err != nil {
+			return nil, fmt.Errorf("failed to decode heartbeat: %w", err)
+		}
+		t.Time = time.Unix(ts, 0)
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// PruneTelemetry deletes heartbeat reports older than before, returning how many went
+func PruneTelemetry(db *sql.DB, before time.Time) (int64, error) {
+	res, err := db.Exec(`DELETE FROM heartbeats WHERE time < ?`, before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune heartbeats: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -32,3 +32,23 @@ func InitDB(dbPath string, statements []string) (*sql.DB, error) {
 
 	return db, nil
 }
+
+// AddColumnIfMissing adds a column to an existing table, so databases created
+// before the column existed pick it up. definition is everything after the
+// column name in an ALTER TABLE ... ADD COLUMN statement.
+func AddColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)
+	if _, err := db.Exec(stmt); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
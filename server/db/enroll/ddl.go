@@ -0,0 +1,51 @@
+package enroll
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/TLop503/LogCrunch/server/db/core"
+)
+
+// tokens are stored hashed, so a leaked DB can't be used to enroll agents
+const createTokensTable = `
+CREATE TABLE IF NOT EXISTS enrollment_tokens (
+    token_hash TEXT PRIMARY KEY,
+    note       TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL,
+    used_at    INTEGER
+);`
+
+const createEnrollmentsTable = `
+CREATE TABLE IF NOT EXISTS enrollments (
+    id          INTEGER PRIMARY KEY AUTOINCREMENT,
+    name        TEXT NOT NULL,
+    serial      TEXT NOT NULL UNIQUE,
+    fingerprint TEXT NOT NULL,
+    remote_addr TEXT NOT NULL,
+    status      TEXT NOT NULL DEFAULT 'pending',
+    enrolled_at INTEGER NOT NULL,
+    expires_at  INTEGER NOT NULL
+);`
+
+const createIndexes = `
+CREATE INDEX IF NOT EXISTS idx_enrollments_status ON enrollments(status);
+`
+
+// enrollStatements contains all DDL statements needed for the enrollment database
+var enrollStatements = []string{
+	createTokensTable,
+	createEnrollmentsTable,
+	createIndexes,
+}
+
+// InitEnrollDB initializes the enrollment SQLite database with tables and indexes.
+// dbPath is the path to the .sqlite file.
+func InitEnrollDB(dbPath string) (*sql.DB, error) {
+	db, err := core.InitDB(dbPath, enrollStatements)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize enrollment database: %w", err)
+	}
+	return db, nil
+}
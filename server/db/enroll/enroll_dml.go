@@ -0,0 +1,182 @@
+package enroll
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Enrollment statuses. Agents start out pending until an admin approves them.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRevoked  = "revoked"
+)
+
+// ErrInvalidToken is returned for tokens that are unknown, used, or expired
+var ErrInvalidToken = errors.New("invalid or expired enrollment token")
+
+// Enrollment is a client certificate issued to an agent
+type Enrollment struct {
+	ID          int64
+	Name        string
+	Serial      string
+	Fingerprint string
+	RemoteAddr  string
+	Status      string
+	EnrolledAt  time.Time
+	ExpiresAt   time.Time
+}
+
+// Token is an outstanding enrollment token. The token itself is only shown when it is created.
+type Token struct {
+	Note      string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// hashToken is how a token is looked up in the DB
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateToken mints a one-time enrollment token valid for ttl
+func CreateToken(db *sql.DB, note string, ttl time.Duration) (string, error) {
+	bytes := make([]byte, 24)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := hex.EncodeToString(bytes)
+
+	now := time.Now()
+	_, err := db.Exec(`
+	INSERT INTO enrollment_tokens (token_hash, note, created_at, expires_at)
+	VALUES (?, ?, ?, ?)
+	`, hashToken(token), note, now.Unix(), now.Add(ttl).Unix())
+	if err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, nil
+}
+
+// RedeemToken uses up a token, returning ErrInvalidToken if it can't be used
+func RedeemToken(db *sql.DB, token string) error {
+	now := time.Now().Unix()
+	res, err := db.Exec(`
+	UPDATE enrollment_tokens SET used_at = ?
+	WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?
+	`, now, hashToken(token), now)
+	if err != nil {
+		return fmt.Errorf("failed to redeem token: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// OpenTokens lists tokens that can still be redeemed, newest first
+func OpenTokens(db *sql.DB) ([]Token, error) {
+	rows, err := db.Query(`
+	SELECT note, created_at, expires_at
+	FROM enrollment_tokens
+	WHERE used_at IS NULL AND expires_at > ?
+	ORDER BY created_at DESC
+	`, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		var t Token
+		var created, expires int64
+		if err := rows.Scan(&t.Note, &created, &expires); err != nil {
+			return nil, fmt.Errorf("failed to scan token: %w", err)
+		}
+		t.CreatedAt, t.ExpiresAt = time.Unix(created, 0), time.Unix(expires, 0)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// AddEnrollment records a newly issued certificate as pending
+func AddEnrollment(db *sql.DB, e Enrollment) error {
+	_, err := db.Exec(`
+	INSERT INTO enrollments (name, serial, fingerprint, remote_addr, status, enrolled_at, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, e.Name, e.Serial, e.Fingerprint, e.RemoteAddr, StatusPending, e.EnrolledAt.Unix(), e.ExpiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to add enrollment: %w", err)
+	}
+	return nil
+}
+
+// ListEnrollments returns every enrollment, newest first
+func ListEnrollments(db *sql.DB) ([]Enrollment, error) {
+	rows, err := db.Query(`
+	SELECT id, name, serial, fingerprint, remote_addr, status, enrolled_at, expires_at
+	FROM enrollments
+	ORDER BY enrolled_at DESC, id DESC
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enrollments: %w", err)
+	}
+	defer rows.Close()
+
+	var list []Enrollment
+	for rows.Next() {
+		var e Enrollment
+		var enrolled, expires int64
+		if err := rows.Scan(&e.ID, &e.Name, &e.Serial, &e.Fingerprint, &e.RemoteAddr, &e.Status, &enrolled, &expires); err != nil {
+			return nil, fmt.Errorf("failed to scan enrollment: %w", err)
+		}
+		e.EnrolledAt, e.ExpiresAt = time.Unix(enrolled, 0), time.Unix(expires, 0)
+		list = append(list, e)
+	}
+	return list, rows.Err()
+}
+
+// SetStatus approves or revokes an enrollment, returning its certificate serial.
+// Revoked enrollments stay revoked.
+func SetStatus(db *sql.DB, id int64, status string) (string, error) {
+	switch status {
+	case StatusApproved, StatusRevoked:
+	default:
+		return "", fmt.Errorf("unknown enrollment status %q", status)
+	}
+
+	var serial string
+	err := db.QueryRow(`
+	UPDATE enrollments SET status = ?
+	WHERE id = ? AND status != ?
+	RETURNING serial
+	`, status, id, StatusRevoked).Scan(&serial)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("no enrollment %d that isn't revoked", id)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to update enrollment: %w", err)
+	}
+	return serial, nil
+}
+
+// CertStatus returns the status of the enrollment that issued the certificate
+// with serial, or "" if it wasn't issued through enrollment
+func CertStatus(db *sql.DB, serial string) (string, error) {
+	var status string
+	err := db.QueryRow(`SELECT status FROM enrollments WHERE serial = ?`, serial).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up certificate: %w", err)
+	}
+	return status, nil
+}
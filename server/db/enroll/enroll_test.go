@@ -0,0 +1,82 @@
+package enroll_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/server/db/enroll"
+)
+
+func TestTokensAreSingleUse(t *testing.T) {
+	db, err := enroll.InitEnrollDB(filepath.Join(t.TempDir(), "enroll.sqlite"))
+	if err != nil {
+		t.Fatalf("InitEnrollDB failed: %v", err)
+	}
+	defer db.Close()
+
+	token, err := enroll.CreateToken(db, "web01", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateToken failed: %v", err)
+	}
+	open, err := enroll.OpenTokens(db)
+	if err != nil || len(open) != 1 || open[0].Note != "web01" {
+		t.Fatalf("Expected one open token, got %+v (%v)", open, err)
+	}
+
+	if err := enroll.RedeemToken(db, token); err != nil {
+		t.Fatalf("RedeemToken failed: %v", err)
+	}
+	if err := enroll.RedeemToken(db, token); !errors.Is(err, enroll.ErrInvalidToken) {
+		t.Errorf("Expected a used token to be rejected, got %v", err)
+	}
+	if err := enroll.RedeemToken(db, "made-up"); !errors.Is(err, enroll.ErrInvalidToken) {
+		t.Errorf("Expected an unknown token to be rejected, got %v", err)
+	}
+
+	expired, _ := enroll.CreateToken(db, "", -time.Minute)
+	if err := enroll.RedeemToken(db, expired); !errors.Is(err, enroll.ErrInvalidToken) {
+		t.Errorf("Expected an expired token to be rejected, got %v", err)
+	}
+}
+
+func TestRevokedEnrollmentsStayRevoked(t *testing.T) {
+	db, err := enroll.InitEnrollDB(filepath.Join(t.TempDir(), "enroll.sqlite"))
+	if err != nil {
+		t.Fatalf("InitEnrollDB failed: %v", err)
+	}
+	defer db.Close()
+
+	err = enroll.AddEnrollment(db, enroll.Enrollment{
+		Name: "web01", Serial: "abc", Fingerprint: "f", RemoteAddr: "10.0.0.5",
+		EnrolledAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("AddEnrollment failed: %v", err)
+	}
+	if status, _ := enroll.CertStatus(db, "abc"); status != enroll.StatusPending {
+		t.Errorf("Expected a new enrollment to be pending, got %q", status)
+	}
+
+	list, _ := enroll.ListEnrollments(db)
+	if len(list) != 1 {
+		t.Fatalf("Expected one enrollment, got %d", len(list))
+	}
+	id := list[0].ID
+	if _, err := enroll.SetStatus(db, id, enroll.StatusApproved); err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+	if serial, err := enroll.SetStatus(db, id, enroll.StatusRevoked); err != nil || serial != "abc" {
+		t.Fatalf("Expected to revoke serial abc, got %q (%v)", serial, err)
+	}
+	if _, err := enroll.SetStatus(db, id, enroll.StatusApproved); err == nil {
+		t.Error("Expected approving a revoked enrollment to fail")
+	}
+	if status, _ := enroll.CertStatus(db, "abc"); status != enroll.StatusRevoked {
+		t.Errorf("Expected revoked, got %q", status)
+	}
+	if status, _ := enroll.CertStatus(db, "unknown"); status != "" {
+		t.Errorf("Expected no status for a certificate we didn't issue, got %q", status)
+	}
+}
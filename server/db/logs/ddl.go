@@ -11,8 +11,10 @@ const createModulesTable = `
 CREATE TABLE IF NOT EXISTS modules (
     module_id   INTEGER PRIMARY KEY AUTOINCREMENT,
     module      TEXT NOT NULL UNIQUE,
+    regex       TEXT NOT NULL DEFAULT '',
     schema_json JSON NOT NULL,
-    created_at  INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+    created_at  INTEGER NOT NULL DEFAULT (strftime('%s','now')),
+    updated_at  INTEGER NOT NULL DEFAULT 0
 );`
 
 const createLogsTable = `
@@ -25,25 +27,74 @@ CREATE TABLE IF NOT EXISTS logs (
     module     TEXT NOT NULL,
     raw        TEXT NOT NULL,
     parsed     JSON NOT NULL,
+    severity   INTEGER NOT NULL DEFAULT 0,
+    ingest_time INTEGER NOT NULL DEFAULT 0,
+    log_uid    TEXT,
+    raw_only   INTEGER NOT NULL DEFAULT 0,
     FOREIGN KEY (module) REFERENCES modules(module)
 );`
 
+// events are what the server notices about agents, rather than what they log
+const createEventsTable = `
+CREATE TABLE IF NOT EXISTS events (
+    event_id  INTEGER PRIMARY KEY AUTOINCREMENT,
+    time      INTEGER NOT NULL,
+    agent_id  TEXT NOT NULL,
+    host      TEXT NOT NULL,
+    kind      TEXT NOT NULL,
+    target    TEXT NOT NULL DEFAULT '',
+    message   TEXT NOT NULL,
+    severity  INTEGER NOT NULL DEFAULT 0
+);`
+
+// dead letters are what couldn't be stored or decoded, kept for a person to look at
+const createDeadLettersTable = `
+CREATE TABLE IF NOT EXISTS dead_letters (
+    dead_letter_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time           INTEGER NOT NULL,
+    agent_id       TEXT NOT NULL,
+    remote_addr    TEXT NOT NULL,
+    kind           TEXT NOT NULL,
+    error          TEXT NOT NULL,
+    payload        TEXT NOT NULL
+);`
+
 const createIndexes = `
 CREATE INDEX IF NOT EXISTS idx_logs_timestamp ON logs(timestamp);
 CREATE INDEX IF NOT EXISTS idx_logs_type ON logs(name);
 CREATE INDEX IF NOT EXISTS idx_logs_host ON logs(host);
+CREATE INDEX IF NOT EXISTS idx_logs_severity ON logs(severity);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_logs_uid ON logs(log_uid);
+CREATE INDEX IF NOT EXISTS idx_events_time ON events(time);
+CREATE INDEX IF NOT EXISTS idx_events_agent ON events(agent_id);
+CREATE INDEX IF NOT EXISTS idx_dead_letters_time ON dead_letters(time);
 `
 
 const enableForeignKeys = `PRAGMA foreign_keys = ON;`
 
-// logStatements contains all DDL statements needed for the logs database
+// logStatements contains all DDL statements needed for the logs database.
+// Indexes are created separately, after migrations have added their columns.
 var logStatements = []string{
 	createModulesTable,
 	createLogsTable,
-	createIndexes,
+	createEventsTable,
+	createDeadLettersTable,
 	enableForeignKeys,
 }
 
+// logMigrations are columns added after the logs table was first released.
+// Databases created before them get the columns on startup.
+var logMigrations = []struct {
+	table, column, definition string
+}{
+	{"logs", "severity", "INTEGER NOT NULL DEFAULT 0"},
+	{"logs", "ingest_time", "INTEGER NOT NULL DEFAULT 0"},
+	{"logs", "log_uid", "TEXT"},                        // NULL for logs from agents that don't send IDs
+	{"logs", "raw_only", "INTEGER NOT NULL DEFAULT 0"}, // 1 for logs the server parses, not the agent
+	{"modules", "regex", "TEXT NOT NULL DEFAULT ''"},
+	{"modules", "updated_at", "INTEGER NOT NULL DEFAULT 0"},
+}
+
 // InitLogDB initializes the logs SQLite database with tables and indexes.
 // dbPath is the path to the .sqlite file.
 func InitLogDB(dbPath string) (*sql.DB, *sql.DB, error) {
@@ -52,6 +103,21 @@ func InitLogDB(dbPath string) (*sql.DB, *sql.DB, error) {
 		return nil, nil, fmt.Errorf("failed to initialize log database: %w", err)
 	}
 
+	for _, m := range logMigrations {
+		if err := core.AddColumnIfMissing(db, m.table, m.column, m.definition); err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("failed to migrate log database: %w", err)
+		}
+	}
+	if _, err := db.Exec(createIndexes); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("failed to create indexes: %w", err)
+	}
+
+	// writers take turns on one connection rather than failing with SQLITE_BUSY
+	// when ingestion, the watchdog and re-parsing write at once
+	db.SetMaxOpenConns(1)
+
 	// load parsing modules from registry to DB
 	err = loadModulesFromRegistry(db)
 	if err != nil {
@@ -63,6 +129,6 @@ func InitLogDB(dbPath string) (*sql.DB, *sql.DB, error) {
 	if err != nil {
 		return db, nil, fmt.Errorf("failed to open log database: %w", err)
 	}
-	
+
 	return db, roDB, nil
 }
@@ -3,6 +3,7 @@ package logs_test
 import (
 	"database/sql"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/TLop503/LogCrunch/server/db/logs"
@@ -36,11 +37,26 @@ func TestInitLogDB(t *testing.T) {
 		t.Error("logs table does not exist")
 	}
 
+	// Verify that the events table exists
+	if !tableExists(sqlDB, "events") {
+		t.Error("events table does not exist")
+	}
+
+	// Verify that the dead letters table exists
+	if !tableExists(sqlDB, "dead_letters") {
+		t.Error("dead_letters table does not exist")
+	}
+
 	// Verify that indexes exist
 	expectedIndexes := []string{
 		"idx_logs_timestamp",
 		"idx_logs_type",
 		"idx_logs_host",
+		"idx_logs_severity",
+		"idx_logs_uid",
+		"idx_events_time",
+		"idx_events_agent",
+		"idx_dead_letters_time",
 	}
 
 	for _, idx := range expectedIndexes {
@@ -50,6 +66,74 @@ func TestInitLogDB(t *testing.T) {
 	}
 }
 
+func TestInitLogDBMigratesOldSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.sqlite")
+
+	// a logs table from before the severity column existed
+	old, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	_, err = old.Exec(`
+		CREATE TABLE modules (
+			module_id   INTEGER PRIMARY KEY AUTOINCREMENT,
+			module      TEXT NOT NULL UNIQUE,
+			schema_json JSON NOT NULL,
+			created_at  INTEGER NOT NULL DEFAULT (strftime('%s','now'))
+		);
+		CREATE TABLE logs (
+			log_id    INTEGER PRIMARY KEY AUTOINCREMENT,
+			name      TEXT NOT NULL,
+			path      TEXT NOT NULL,
+			host      TEXT NOT NULL,
+			timestamp INTEGER NOT NULL,
+			module    TEXT NOT NULL,
+			raw       TEXT NOT NULL,
+			parsed    JSON NOT NULL
+		);
+		INSERT INTO logs (name, path, host, timestamp, module, raw, parsed)
+		VALUES ('old', '/var/log/old.log', 'h', 1, 'syslog', 'old line', '{}');
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	sqlDB, _, err := logs.InitLogDB(dbPath)
+	if err != nil {
+		t.Fatalf("InitLogDB failed on old schema: %v", err)
+	}
+	defer sqlDB.Close()
+
+	var severity int
+	if err := sqlDB.QueryRow(`SELECT severity FROM logs WHERE name = 'old'`).Scan(&severity); err != nil {
+		t.Fatalf("Expected severity column after migration: %v", err)
+	}
+	if severity != 0 {
+		t.Errorf("Expected existing rows to default to 0, got %d", severity)
+	}
+	var ingest int64
+	if err := sqlDB.QueryRow(`SELECT ingest_time FROM logs WHERE name = 'old'`).Scan(&ingest); err != nil {
+		t.Fatalf("Expected ingest_time column after migration: %v", err)
+	}
+	var rawOnly int
+	if err := sqlDB.QueryRow(`SELECT raw_only FROM logs WHERE name = 'old'`).Scan(&rawOnly); err != nil || rawOnly != 0 {
+		t.Errorf("Expected old logs marked as parsed by the agent, got %d, %v", rawOnly, err)
+	}
+	for _, idx := range []string{"idx_logs_severity", "idx_logs_uid"} {
+		if !indexExists(sqlDB, idx) {
+			t.Errorf("Index %s does not exist", idx)
+		}
+	}
+
+	// running again must not try to add the column twice
+	again, _, err := logs.InitLogDB(dbPath)
+	if err != nil {
+		t.Fatalf("InitLogDB failed on second run: %v", err)
+	}
+	again.Close()
+}
+
 // tableExists checks if a table exists in the SQLite database
 func tableExists(db *sql.DB, tableName string) bool {
 	var name string
@@ -0,0 +1,105 @@
+package logs
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Dead letter kinds
+const (
+	DeadInsert = "insert" // a log that failed to be stored
+	DeadDecode = "decode" // a frame or log that failed to be decoded
+)
+
+// ErrDeadLetterNotFound is returned for a dead letter that doesn't exist
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is something an agent sent that couldn't be stored, with why
+type DeadLetter struct {
+	ID         int64
+	Time       time.Time
+	AgentID    string
+	RemoteAddr string
+	Kind       string
+	Error      string
+	Payload    string // the log as JSON, or the frame as received
+}
+
+// InsertDeadLetter stores a dead letter
+func InsertDeadLetter(db *sql.DB, d DeadLetter) error {
+	_, err := db.Exec(`
+	INSERT INTO dead_letters (time, agent_id, remote_addr, kind, error, payload)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`, d.Time.Unix(), d.AgentID, d.RemoteAddr, d.Kind, d.Error, d.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to insert dead letter: %w", err)
+	}
+	return nil
+}
+
+// ListDeadLetters returns the newest dead letters, and how many there are in all
+func ListDeadLetters(db *sql.DB, limit int) ([]DeadLetter, int, error) {
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM dead_letters`).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count dead letters: %w", err)
+	}
+
+	rows, err := db.Query(`
+	SELECT dead_letter_id, time, agent_id, remote_addr, kind, error, payload
+	FROM dead_letters
+	ORDER BY time DESC, dead_letter_id DESC
+	LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var list []DeadLetter
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, d)
+	}
+	return list, total, rows.Err()
+}
+
+// GetDeadLetter returns one dead letter
+func GetDeadLetter(db *sql.DB, id int64) (DeadLetter, error) {
+	row := db.QueryRow(`
+	SELECT dead_letter_id, time, agent_id, remote_addr, kind, error, payload
+	FROM dead_letters WHERE dead_letter_id = ?
+	`, id)
+	d, err := scanDeadLetter(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, ErrDeadLetterNotFound
+	}
+	return d, err
+}
+
+// DeleteDeadLetter removes a dead letter that was discarded or re-ingested
+func DeleteDeadLetter(db *sql.DB, id int64) error {
+	res, err := db.Exec(`DELETE FROM dead_letters WHERE dead_letter_id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete dead letter: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// scanDeadLetter reads a dead letter from a row
+func scanDeadLetter(row interface{ Scan(...any) error }) (DeadLetter, error) {
+	var d DeadLetter
+	var ts int64
+	if err := row.Scan(&d.ID, &ts, &d.AgentID, &d.RemoteAddr, &d.Kind, &d.Error, &d.Payload); err != nil {
+		return d, fmt.Errorf("failed to scan dead letter: %w", err)
+	}
+	d.Time = time.Unix(ts, 0)
+	return d, nil
+}
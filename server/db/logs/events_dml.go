@@ -0,0 +1,60 @@
+package logs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// Event is something the server noticed about an agent, like it going offline
+type Event struct {
+	ID       int64
+	Time     time.Time
+	AgentID  string
+	Host     string
+	Kind     string
+	Target   string // the target it concerns, if any
+	Message  string
+	Severity structs.Severity
+}
+
+// InsertEvent stores an event
+func InsertEvent(db *sql.DB, e Event) error {
+	_, err := db.Exec(`
+	INSERT INTO events (time, agent_id, host, kind, target, message, severity)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, e.Time.Unix(), e.AgentID, e.Host, e.Kind, e.Target, e.Message, e.Severity)
+	if err != nil {
+		return fmt.Errorf("failed to insert event: %w", err)
+	}
+	return nil
+}
+
+// RecentEvents returns the newest events, for every agent if agentID is empty
+func RecentEvents(db *sql.DB, agentID string, limit int) ([]Event, error) {
+	rows, err := db.Query(`
+	SELECT event_id, time, agent_id, host, kind, target, message, severity
+	FROM events
+	WHERE ? = '' OR agent_id = ?
+	ORDER BY time DESC, event_id DESC
+	LIMIT ?
+	`, agentID, agentID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("RecentEvents: query failed: %w", err)
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		var ts int64
+		if err := rows.Scan(&e.ID, &ts, &e.AgentID, &e.Host, &e.Kind, &e.Target, &e.Message, &e.Severity); err != nil {
+			return nil, fmt.Errorf("RecentEvents: scan failed: %w", err)
+		}
+		e.Time = time.Unix(ts, 0)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
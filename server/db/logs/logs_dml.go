@@ -8,6 +8,14 @@ import (
 	"github.com/TLop503/LogCrunch/structs"
 )
 
+// insertLog skips logs whose ID is already stored, so an agent resending
+// a batch it never got an ack for doesn't create duplicates
+const insertLog = `
+	INSERT INTO logs (name, path, host, timestamp, module, raw, parsed, severity, ingest_time, log_uid, raw_only)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT DO NOTHING
+`
+
 // InsertLog inserts a single log entry, allowing FKs to not necessarily exist yet
 func InsertLog(db *sql.DB, l structs.Log) error {
 	parsedJSON, err := json.Marshal(l.Parsed)
@@ -20,10 +28,7 @@ func InsertLog(db *sql.DB, l structs.Log) error {
 		return fmt.Errorf("failed to ensure module exists: %w", err)
 	}
 
-	_, err = db.Exec(`
-		INSERT INTO logs (name, path, host, timestamp, module, raw, parsed)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`,
+	_, err = db.Exec(insertLog,
 		l.Name,
 		l.Path,
 		l.Host,
@@ -31,54 +36,61 @@ func InsertLog(db *sql.DB, l structs.Log) error {
 		l.Module,
 		l.Raw,
 		string(parsedJSON),
+		l.Severity,
+		l.IngestTime,
+		logUID(l),
+		l.RawOnly,
 	)
 
 	return err
 }
 
-// InsertLogsBatch inserts many logs at a time in batches for high-throughput
-func InsertLogsBatch(db *sql.DB, logs []structs.Log) error {
+// InsertLogsBatch inserts many logs in one transaction for high-throughput.
+// Only modules the cache doesn't know yet are upserted; a nil cache upserts
+// every module in the batch. stored[i] reports whether logs[i] was stored,
+// as opposed to duplicating a stored log.
+func InsertLogsBatch(db *sql.DB, logs []structs.Log, modules *ModuleCache) (stored []bool, err error) {
 	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
 	// Always enable FKs per connection
 	if _, err := tx.Exec(`PRAGMA foreign_keys = ON;`); err != nil {
-		return err
+		return nil, err
 	}
 
-	// 1. Collect unique modules
-	modules := make(map[string]struct{})
+	// 1. Collect modules the cache hasn't seen
+	added := make(map[string]struct{})
 	for _, l := range logs {
-		modules[l.Module] = struct{}{}
+		if !modules.known(l.Module) {
+			added[l.Module] = struct{}{}
+		}
 	}
 
-	// 2. Ensure all modules exist
-	for module := range modules {
+	// 2. Ensure they exist
+	for module := range added {
 		if err := ensureModuleExists(tx, module, []byte(`{}`)); err != nil {
-			return fmt.Errorf("failed to ensure module %q exists: %w", module, err)
+			return nil, fmt.Errorf("failed to ensure module %q exists: %w", module, err)
 		}
 	}
 
 	// 3. Insert logs
-	stmt, err := tx.Prepare(`
-		INSERT INTO logs (name, path, host, timestamp, module, raw, parsed)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`)
+	stmt, err := tx.Prepare(insertLog)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer stmt.Close()
 
-	for _, l := range logs {
+	stored = make([]bool, len(logs))
+	for i, l := range logs {
 		parsedJSON, err := json.Marshal(l.Parsed)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		if _, err := stmt.Exec(
+		res, err := stmt.Exec(
 			l.Name,
 			l.Path,
 			l.Host,
@@ -86,12 +98,34 @@ func InsertLogsBatch(db *sql.DB, logs []structs.Log) error {
 			l.Module,
 			l.Raw,
 			string(parsedJSON),
-		); err != nil {
-			return err
+			l.Severity,
+			l.IngestTime,
+			logUID(l),
+			l.RawOnly,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			stored[i] = n > 0
 		}
 	}
 
-	return tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for module := range added {
+		modules.add(module)
+	}
+	return stored, nil
+}
+
+// logUID is the value stored for a log's ID, NULL when the agent didn't send one
+func logUID(l structs.Log) any {
+	if l.ID == "" {
+		return nil
+	}
+	return l.ID
 }
 
 // execer middleman to distinguish batch/solo workers
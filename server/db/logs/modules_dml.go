@@ -3,32 +3,200 @@ package logs
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/TLop503/LogCrunch/structs"
 )
 
-// DBModule represents a parser module and its schema
+// DBModule represents a parser module and its schema. Modules agents declare
+// without telling the server how to parse them have no regex.
 type DBModule struct {
-	Name   string
-	Schema string // JSON string
+	Name      string
+	Regex     string
+	Schema    string // JSON string
+	CreatedAt time.Time
+	UpdatedAt time.Time // when it was last edited in the web UI, zero if never
 }
 
-// InsertModule inserts a module into the database, replacing it if it already exists
+// ErrModuleNotFound is returned for a module that doesn't exist
+var ErrModuleNotFound = errors.New("module not found")
+
+// ModuleCache remembers which modules are in the modules table, so batches
+// only upsert modules they introduce. A nil *ModuleCache remembers nothing.
+type ModuleCache struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+// NewModuleCache returns an empty cache
+func NewModuleCache() *ModuleCache {
+	return &ModuleCache{names: make(map[string]struct{})}
+}
+
+// known reports whether module is in the table
+func (c *ModuleCache) known(module string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.names[module]
+	return ok
+}
+
+// add remembers that module is in the table
+func (c *ModuleCache) add(module string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names[module] = struct{}{}
+}
+
+// InsertModule inserts a built-in module into the database, refreshing it if it
+// already exists unless it was edited since
 func InsertModule(db *sql.DB, m DBModule) error {
 	stmt := `
-	INSERT INTO modules (module, schema_json, created_at)
-	VALUES (?, ?, ?)
+	INSERT INTO modules (module, regex, schema_json, created_at)
+	VALUES (?, ?, ?, ?)
 	ON CONFLICT(module) DO UPDATE SET
+		regex=excluded.regex,
 		schema_json=excluded.schema_json,
-		created_at=excluded.created_at;
+		created_at=excluded.created_at
+	WHERE modules.updated_at = 0;
 	`
 
-	_, err := db.Exec(stmt, m.Name, m.Schema, time.Now().Unix())
+	_, err := db.Exec(stmt, m.Name, m.Regex, m.Schema, time.Now().Unix())
 	return err
 }
 
+// SaveModule creates or replaces a module edited in the web UI
+func SaveModule(db *sql.DB, m DBModule) error {
+	now := time.Now().Unix()
+	_, err := db.Exec(`
+	INSERT INTO modules (module, regex, schema_json, created_at, updated_at)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(module) DO UPDATE SET
+		regex=excluded.regex,
+		schema_json=excluded.schema_json,
+		updated_at=excluded.updated_at;
+	`, m.Name, m.Regex, m.Schema, now, now)
+	if err != nil {
+		return fmt.Errorf("failed to save module %s: %w", m.Name, err)
+	}
+	return nil
+}
+
+// ListModules returns every module, by name
+func ListModules(db *sql.DB) ([]DBModule, error) {
+	rows, err := db.Query(`
+	SELECT module, regex, schema_json, created_at, updated_at
+	FROM modules ORDER BY module
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list modules: %w", err)
+	}
+	defer rows.Close()
+
+	var list []DBModule
+	for rows.Next() {
+		m, err := scanModule(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// GetModule returns one module
+func GetModule(db *sql.DB, name string) (DBModule, error) {
+	row := db.QueryRow(`
+	SELECT module, regex, schema_json, created_at, updated_at
+	FROM modules WHERE module = ?
+	`, name)
+	m, err := scanModule(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, ErrModuleNotFound
+	}
+	return m, err
+}
+
+// scanModule reads a module from a row
+func scanModule(row interface{ Scan(...any) error }) (DBModule, error) {
+	var m DBModule
+	var created, updated int64
+	if err := row.Scan(&m.Name, &m.Regex, &m.Schema, &created, &updated); err != nil {
+		return m, fmt.Errorf("failed to scan module: %w", err)
+	}
+	m.CreatedAt = time.Unix(created, 0)
+	if updated != 0 {
+		m.UpdatedAt = time.Unix(updated, 0)
+	}
+	return m, nil
+}
+
+// RawLog is a stored log's raw line, for parsing it again
+type RawLog struct {
+	ID  int64
+	Raw string
+}
+
+// RawLogs returns up to limit logs of a module with IDs after afterID, in ID
+// order. Only logs the server parsed are returned; the agent's parsing is left alone.
+func RawLogs(db *sql.DB, module string, afterID int64, limit int) ([]RawLog, error) {
+	rows, err := db.Query(`
+	SELECT log_id, raw FROM logs
+	WHERE module = ? AND raw_only = 1 AND log_id > ?
+	ORDER BY log_id
+	LIMIT ?
+	`, module, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read logs of %s: %w", module, err)
+	}
+	defer rows.Close()
+
+	var list []RawLog
+	for rows.Next() {
+		var l RawLog
+		if err := rows.Scan(&l.ID, &l.Raw); err != nil {
+			return nil, fmt.Errorf("failed to scan log: %w", err)
+		}
+		list = append(list, l)
+	}
+	return list, rows.Err()
+}
+
+// SetParsed replaces the parsed fields of stored logs, keyed by log ID, in one transaction
+func SetParsed(db *sql.DB, parsed map[int64]any) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE logs SET parsed = ? WHERE log_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for id, fields := range parsed {
+		parsedJSON, err := json.Marshal(fields)
+		if err != nil {
+			return fmt.Errorf("failed to marshal parsed field of log %d: %w", id, err)
+		}
+		if _, err := stmt.Exec(string(parsedJSON), id); err != nil {
+			return fmt.Errorf("failed to update log %d: %w", id, err)
+		}
+	}
+	return tx.Commit()
+}
+
 // loadModulesFromRegistry adds the contents of the metaparser registry
 // to the database
 func loadModulesFromRegistry(db *sql.DB) error {
@@ -39,7 +207,7 @@ func loadModulesFromRegistry(db *sql.DB) error {
 			return fmt.Errorf("failed to marshal schema for module %s: %s", name, schemaJson)
 		}
 
-		err = InsertModule(db, DBModule{Name: name, Schema: string(schemaJson)})
+		err = InsertModule(db, DBModule{Name: name, Regex: entry.Regex.String(), Schema: string(schemaJson)})
 		if err != nil {
 			return fmt.Errorf("error inserting module to db: %w", err)
 		}
@@ -2,6 +2,7 @@ package logs
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 
 	"github.com/TLop503/LogCrunch/structs"
@@ -10,70 +11,120 @@ import (
 
 // MostRecent50 debugger
 func MostRecent50(db *sql.DB) ([]structs.Log, error) {
+	return RecentLogs(db, structs.SeverityUnknown, 50)
+}
+
+// RecentLogs returns the newest logs at or above minSeverity.
+// SeverityUnknown means no filter.
+func RecentLogs(db *sql.DB, minSeverity structs.Severity, limit int) ([]structs.Log, error) {
 	stmt := `
-	SELECT timestamp, name, host, parsed, raw
+	SELECT timestamp, name, host, parsed, raw, severity, ingest_time
 	FROM logs
+	WHERE severity >= ?
 	ORDER BY timestamp DESC
-	LIMIT 50
+	LIMIT ?
 	`
 
-	rows, err := db.Query(stmt)
+	rows, err := db.Query(stmt, minSeverity, limit)
+	if err != nil {
+		return nil, fmt.Errorf("RecentLogs: query failed: %w", err)
+	}
+	defer rows.Close()
+
+	logs, err := scanLogs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("RecentLogs: %w", err)
+	}
+	return logs, nil
+}
+
+// RunQuery executes a custom query and returns log entries.
+// Columns are matched to log fields by name, so any subset of the logs
+// table's columns (or SELECT *) works; other columns are ignored.
+func RunQuery(db *sql.DB, query string) ([]structs.Log, error) {
+	rows, err := db.Query(query)
 	if err != nil {
-		return nil, fmt.Errorf("MostRecent50: query failed: %w", err)
+		return nil, err
 	}
 	defer rows.Close()
 
+	return scanLogs(rows)
+}
+
+// scanLogs reads every row into a log, matching columns by name
+func scanLogs(rows *sql.Rows) ([]structs.Log, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
 	var logs []structs.Log
 	rowNum := 0
-
 	for rows.Next() {
 		rowNum++
 
 		var (
 			log       structs.Log
 			parsedRaw any
+			uid       sql.NullString
 		)
-
-		if err := rows.Scan(
-			&log.Timestamp,
-			&log.Name,
-			&log.Host,
-			&parsedRaw,
-			&log.Raw,
-		); err != nil {
-			return nil, fmt.Errorf(
-				"MostRecent50: scan failed on row %d: %w",
-				rowNum, err,
-			)
+		dest := make([]any, len(cols))
+		for i, col := range cols {
+			switch col {
+			case "name":
+				dest[i] = &log.Name
+			case "path":
+				dest[i] = &log.Path
+			case "host":
+				dest[i] = &log.Host
+			case "timestamp":
+				dest[i] = &log.Timestamp
+			case "module":
+				dest[i] = &log.Module
+			case "raw":
+				dest[i] = &log.Raw
+			case "parsed":
+				dest[i] = &parsedRaw
+			case "severity":
+				dest[i] = &log.Severity
+			case "ingest_time":
+				dest[i] = &log.IngestTime
+			case "log_uid":
+				dest[i] = &uid
+			default:
+				dest[i] = new(any)
+			}
 		}
 
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("scan failed on row %d: %w", rowNum, err)
+		}
+		log.Parsed = decodeParsed(parsedRaw)
+		log.ID = uid.String
 		logs = append(logs, log)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("MostRecent50: row iteration failed: %w", err)
+		return nil, fmt.Errorf("row iteration failed: %w", err)
 	}
-
 	return logs, nil
 }
 
-// RunQuery executes a custom query and returns log entries
-func RunQuery(db *sql.DB, query string) ([]structs.Log, error) {
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, err
+// decodeParsed turns the stored parsed JSON back into a value,
+// leaving it as-is if it isn't valid JSON
+func decodeParsed(v any) any {
+	var text []byte
+	switch p := v.(type) {
+	case string:
+		text = []byte(p)
+	case []byte:
+		text = p
+	default:
+		return v
 	}
-	defer rows.Close()
-
-	var logs []structs.Log
-	for rows.Next() {
-		var log structs.Log
-		err = rows.Scan(&log.Timestamp, &log.Name, &log.Host, &log.Parsed, &log.Raw)
-		if err != nil {
-			return nil, err
-		}
-		logs = append(logs, log)
+	var out any
+	if err := json.Unmarshal(text, &out); err != nil {
+		return string(text)
 	}
-
-	return logs, rows.Err()
+	return out
 }
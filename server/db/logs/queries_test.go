@@ -0,0 +1,153 @@
+package logs_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+func TestRecentLogsFiltersBySeverity(t *testing.T) {
+	db, _, err := logs.InitLogDB(filepath.Join(t.TempDir(), "logs.sqlite"))
+	if err != nil {
+		t.Fatalf("InitLogDB failed: %v", err)
+	}
+	defer db.Close()
+
+	batch := []structs.Log{
+		{Name: "a", Path: "/a", Host: "h", Timestamp: 1, Module: "syslog", Raw: "debug", Severity: structs.SeverityDebug},
+		{Name: "a", Path: "/a", Host: "h", Timestamp: 2, Module: "syslog", Raw: "warn", Severity: structs.SeverityWarning},
+		{Name: "a", Path: "/a", Host: "h", Timestamp: 3, Module: "syslog", Raw: "crit", Severity: structs.SeverityCritical},
+	}
+	if _, err := logs.InsertLogsBatch(db, batch, nil); err != nil {
+		t.Fatalf("InsertLogsBatch failed: %v", err)
+	}
+
+	got, err := logs.RecentLogs(db, structs.SeverityWarning, 50)
+	if err != nil {
+		t.Fatalf("RecentLogs failed: %v", err)
+	}
+	if len(got) != 2 || got[0].Raw != "crit" || got[1].Raw != "warn" {
+		t.Fatalf("Expected crit and warn, got %+v", got)
+	}
+	if got[0].Severity != structs.SeverityCritical {
+		t.Errorf("Expected critical severity, got %v", got[0].Severity)
+	}
+
+	all, err := logs.MostRecent50(db)
+	if err != nil {
+		t.Fatalf("MostRecent50 failed: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("Expected 3 logs without a filter, got %d", len(all))
+	}
+}
+
+func TestRunQueryMatchesColumnsByName(t *testing.T) {
+	db, _, err := logs.InitLogDB(filepath.Join(t.TempDir(), "logs.sqlite"))
+	if err != nil {
+		t.Fatalf("InitLogDB failed: %v", err)
+	}
+	defer db.Close()
+
+	err = logs.InsertLog(db, structs.Log{
+		Name: "auth", Path: "/var/log/auth.log", Host: "h", Timestamp: 10,
+		Module: "syslog", Raw: "line", Parsed: map[string]string{"process": "sshd"},
+		Severity: structs.SeverityError,
+	})
+	if err != nil {
+		t.Fatalf("InsertLog failed: %v", err)
+	}
+
+	got, err := logs.RunQuery(db, `SELECT * FROM logs`)
+	if err != nil {
+		t.Fatalf("RunQuery failed: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Expected 1 log, got %d", len(got))
+	}
+	l := got[0]
+	if l.Path != "/var/log/auth.log" || l.Severity != structs.SeverityError || l.Raw != "line" {
+		t.Errorf("Unexpected log: %+v", l)
+	}
+	if parsed, ok := l.Parsed.(map[string]any); !ok || parsed["process"] != "sshd" {
+		t.Errorf("Expected parsed JSON to be decoded, got %#v", l.Parsed)
+	}
+}
+
+func TestInsertLogsBatchSkipsResentLogs(t *testing.T) {
+	db, _, err := logs.InitLogDB(filepath.Join(t.TempDir(), "logs.sqlite"))
+	if err != nil {
+		t.Fatalf("InitLogDB failed: %v", err)
+	}
+	defer db.Close()
+
+	batch := []structs.Log{
+		{ID: "one", Name: "a", Path: "/a", Host: "h", Timestamp: 1, Module: "syslog", Raw: "first"},
+		{ID: "two", Name: "a", Path: "/a", Host: "h", Timestamp: 2, Module: "syslog", Raw: "second"},
+		{Name: "a", Path: "/a", Host: "h", Timestamp: 3, Module: "syslog", Raw: "no id"},
+	}
+	cache := logs.NewModuleCache()
+	if stored, err := logs.InsertLogsBatch(db, batch, cache); err != nil || count(stored) != 3 {
+		t.Fatalf("Expected 3 logs stored, got %v (%v)", stored, err)
+	}
+
+	// an agent that never saw the ack sends the same batch again
+	stored, err := logs.InsertLogsBatch(db, batch, cache)
+	if err != nil {
+		t.Fatalf("InsertLogsBatch failed on resend: %v", err)
+	}
+	if count(stored) != 1 || !stored[2] {
+		t.Errorf("Expected only the log without an ID to be stored again, got %v", stored)
+	}
+
+	got, err := logs.RunQuery(db, `SELECT * FROM logs WHERE log_uid = 'two'`)
+	if err != nil {
+		t.Fatalf("RunQuery failed: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "two" || got[0].Raw != "second" {
+		t.Errorf("Expected one copy of log two, got %+v", got)
+	}
+}
+
+// count returns how many logs InsertLogsBatch stored
+func count(stored []bool) int {
+	n := 0
+	for _, ok := range stored {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestEditedModulesSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs.sqlite")
+	db, _, err := logs.InitLogDB(path)
+	if err != nil {
+		t.Fatalf("InitLogDB failed: %v", err)
+	}
+	if m, err := logs.GetModule(db, "syslog"); err != nil || m.Regex == "" || !m.UpdatedAt.IsZero() {
+		t.Fatalf("Expected the built-in syslog module with its regex, got %+v (%v)", m, err)
+	}
+	edited := logs.DBModule{Name: "syslog", Regex: `^(?P<message>.*)$`, Schema: `{"message":"string"}`}
+	if err := logs.SaveModule(db, edited); err != nil {
+		t.Fatalf("SaveModule failed: %v", err)
+	}
+	db.Close()
+
+	// the built-in modules are loaded again on startup
+	db, _, err = logs.InitLogDB(path)
+	if err != nil {
+		t.Fatalf("InitLogDB failed on reopening: %v", err)
+	}
+	defer db.Close()
+	m, err := logs.GetModule(db, "syslog")
+	if err != nil || m.Regex != edited.Regex || m.UpdatedAt.IsZero() {
+		t.Errorf("Expected the edited syslog module to be kept, got %+v (%v)", m, err)
+	}
+	if _, err := logs.GetModule(db, "nope"); err != logs.ErrModuleNotFound {
+		t.Errorf("Expected ErrModuleNotFound, got %v", err)
+	}
+}
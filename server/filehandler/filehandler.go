@@ -3,6 +3,7 @@ package filehandler
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -68,28 +69,37 @@ func WriteToFile(path string, create bool, append bool, payload interface{}) err
 // filePath is the original file, rotationDestination is the new or existing file to write to
 // append defines whether to append (true) or overwrite (false) any potentially existing data
 // by default if the rotationDestination does not exist it will be created.
+// The contents are streamed, so files of any size can be rotated.
 // Note! if file to rotate does not exist, this function just does nothing w/o error
 func RotateFile(filePath string, rotationDestination string, append bool) error {
-	// Check if the file exists
-	_, err := os.Stat(filePath)
-
+	src, err := os.Open(filePath)
 	if os.IsNotExist(err) {
 		log.Printf("File (%s) to rotate does not exist!", filePath)
 		return nil
 	}
-
-	contents, err := os.ReadFile(filePath)
 	if err != nil {
 		return fmt.Errorf("error reading file (%s): %w", filePath, err)
 	}
+	defer src.Close()
 
-	err = WriteToFile(rotationDestination, true, append, string(contents))
+	if err := Create_if_needed(rotationDestination, os.ModePerm, 0o644); err != nil {
+		return fmt.Errorf("file/path creation error: %w", err)
+	}
+	flags := os.O_WRONLY
+	if append {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	dst, err := os.OpenFile(rotationDestination, flags, 0644)
 	if err != nil {
-		// since WriteToFile has verbose errors, we can just pass it upstream
-		return fmt.Errorf("func WriteToFile error from RotateFile: %w", err)
+		return fmt.Errorf("error opening file: %w", err)
 	}
-
-	return nil
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return fmt.Errorf("error copying %s to %s: %w", filePath, rotationDestination, err)
+	}
+	return dst.Close()
 }
 
 // Create_if_needed creates an empty file at a given path to aid in DB or filehandler operations
@@ -0,0 +1,384 @@
+package filehandler
+
+import (
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveTime stamps archives in UTC, so they sort by name in the order they were rotated
+const archiveTime = "20060102T150405.000Z"
+
+// RotateConfig says when the firehose is rotated and how long archives are kept
+type RotateConfig struct {
+	MaxSize     int64         // rotate once the file is this big, 0 to never rotate by size
+	MaxAge      time.Duration // rotate files this old, 0 to never rotate by age
+	Compression string        // "gzip", "zstd", or "none" to archive files as they are
+	Keep        int           // archives kept, 0 to keep any number
+	KeepFor     time.Duration // archives older than this are deleted, 0 to keep them forever
+	CheckEvery  time.Duration // how often Run checks the file's age and prunes archives
+}
+
+// DefaultRotateConfig rotates daily or at 100 MiB, and keeps two weeks of gzipped archives
+func DefaultRotateConfig() RotateConfig {
+	return RotateConfig{
+		MaxSize:     100 << 20,
+		MaxAge:      24 * time.Hour,
+		Compression: "gzip",
+		Keep:        14,
+		KeepFor:     14 * 24 * time.Hour,
+		CheckEvery:  time.Minute,
+	}
+}
+
+// Firehose appends every log received to a file, rotating it into
+// timestamped archives next to it: firehose.log becomes
+// firehose-20260102T150405.000Z.log.gz. Archives are compressed in the
+// background, streaming, so rotating never holds up writes.
+type Firehose struct {
+	path string
+	cfg  RotateConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time // when the current file was opened
+
+	archiving sync.WaitGroup
+}
+
+// OpenFirehose archives what the last run left at path and starts a new file
+func OpenFirehose(path string, cfg RotateConfig) (*Firehose, error) {
+	switch cfg.Compression {
+	case "gzip", "zstd", "none":
+	default:
+		return nil, fmt.Errorf("unknown firehose compression %q", cfg.Compression)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	f := &Firehose{path: path, cfg: cfg}
+	if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+		if err := f.archive(info.ModTime()); err != nil {
+			return nil, err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to stat firehose: %w", err)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends payload as one line, rotating the file first if it is due.
+// payload can be a string or any value that can be marshaled to JSON.
+func (f *Firehose) Write(payload interface{}) error {
+	var line []byte
+	switch v := payload.(type) {
+	case string:
+		line = []byte(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload to JSON: %w", err)
+		}
+		line = data
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return fmt.Errorf("firehose is closed")
+	}
+	if f.due(int64(len(line))) {
+		if err := f.rotate(); err != nil {
+			if f.file == nil {
+				return err
+			}
+			log.Printf("Error rotating firehose, still writing to it: %v", err)
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing to firehose: %w", err)
+	}
+	return nil
+}
+
+// Rotate archives the current file and starts a new one
+func (f *Firehose) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return fmt.Errorf("firehose is closed")
+	}
+	return f.rotate()
+}
+
+// Run rotates the file once it is too old, even if nothing is written,
+// and prunes old archives, until ctx is done
+func (f *Firehose) Run(ctx context.Context) {
+	if f.cfg.CheckEvery <= 0 {
+		return
+	}
+	ticker := time.NewTicker(f.cfg.CheckEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		f.mu.Lock()
+		var err error
+		if f.file != nil && f.size > 0 && f.due(0) {
+			err = f.rotate()
+		}
+		f.mu.Unlock()
+		if err != nil {
+			log.Printf("Error rotating firehose: %v", err)
+		}
+		if err := f.prune(time.Now()); err != nil {
+			log.Printf("Error pruning firehose archives: %v", err)
+		}
+	}
+}
+
+// Close closes the file and waits for archives being compressed
+func (f *Firehose) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+	f.archiving.Wait()
+	return err
+}
+
+// due reports whether the file must be rotated before writing n more bytes.
+// The caller holds mu.
+func (f *Firehose) due(n int64) bool {
+	if f.size == 0 {
+		return false // a single line larger than MaxSize still has to go somewhere
+	}
+	if f.cfg.MaxSize > 0 && f.size+n > f.cfg.MaxSize {
+		return true
+	}
+	return f.cfg.MaxAge > 0 && time.Since(f.started) >= f.cfg.MaxAge
+}
+
+// rotate closes the file, archives it, and opens a new one. The caller holds mu.
+func (f *Firehose) rotate() error {
+	if err := f.file.Close(); err != nil {
+		log.Printf("Error closing firehose: %v", err)
+	}
+	f.file = nil
+	if err := f.archive(time.Now()); err != nil {
+		// keep writing to the same file rather than losing logs
+		if openErr := f.open(); openErr != nil {
+			return fmt.Errorf("%w, and reopening it failed: %v", err, openErr)
+		}
+		return err
+	}
+	return f.open()
+}
+
+// open starts an empty file at path
+func (f *Firehose) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening firehose: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat firehose: %w", err)
+	}
+	f.file, f.size, f.started = file, info.Size(), time.Now()
+	return nil
+}
+
+// archive moves the file at path aside under a name stamped with at, then
+// compresses it and prunes old archives in the background
+func (f *Firehose) archive(at time.Time) error {
+	name, err := f.archiveName(at)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, name); err != nil {
+		return fmt.Errorf("error moving firehose to %s: %w", name, err)
+	}
+
+	f.archiving.Add(1)
+	go func() {
+		defer f.archiving.Done()
+		if f.cfg.Compression != "none" {
+			if err := compressFile(name, f.cfg.Compression); err != nil {
+				log.Printf("Error compressing %s, keeping it uncompressed: %v", name, err)
+			}
+		}
+		if err := f.prune(time.Now()); err != nil {
+			log.Printf("Error pruning firehose archives: %v", err)
+		}
+	}()
+	return nil
+}
+
+// archiveName picks an unused archive name for a file rotated at at
+func (f *Firehose) archiveName(at time.Time) (string, error) {
+	dir, stem, ext := f.split()
+	stamp := at.UTC().Format(archiveTime)
+	for i := 0; i < 100; i++ {
+		name := filepath.Join(dir, stem+"-"+stamp+ext)
+		if i > 0 {
+			name = filepath.Join(dir, fmt.Sprintf("%s-%s.%d%s", stem, stamp, i, ext))
+		}
+		if !exists(name) && !exists(name+".gz") && !exists(name+".zst") {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("too many firehose archives stamped %s", stamp)
+}
+
+// split breaks path into its directory, its name without extension, and its extension
+func (f *Firehose) split() (dir, stem, ext string) {
+	dir, base := filepath.Split(f.path)
+	ext = filepath.Ext(base)
+	return dir, strings.TrimSuffix(base, ext), ext
+}
+
+// Archives returns the paths of the archives, oldest first
+func (f *Firehose) Archives() ([]string, error) {
+	dir, stem, _ := f.split()
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list firehose archives: %w", err)
+	}
+	found := make(map[string]bool)
+	for _, e := range entries {
+		found[e.Name()] = true
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		// skip what compressFile is still writing
+		if e.IsDir() || !strings.HasPrefix(name, stem+"-") || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		if _, err := time.Parse(archiveTime, stampOf(strings.TrimPrefix(name, stem+"-"))); err != nil {
+			continue
+		}
+		// compressFile deletes the original once the compressed copy is done
+		if found[name+".gz"] || found[name+".zst"] {
+			continue
+		}
+		names = append(names, filepath.Join(dir, name))
+	}
+	// archives rotated within the same millisecond are numbered after the stamp
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(
+			strings.Compare(stampOf(filepath.Base(a)[len(stem)+1:]), stampOf(filepath.Base(b)[len(stem)+1:])),
+			cmp.Compare(len(a), len(b)),
+			strings.Compare(a, b),
+		)
+	})
+	return names, nil
+}
+
+// stampOf returns the timestamp an archive name starts with
+func stampOf(name string) string {
+	if len(name) < len(archiveTime) {
+		return ""
+	}
+	return name[:len(archiveTime)]
+}
+
+// prune deletes archives beyond Keep and older than KeepFor
+func (f *Firehose) prune(now time.Time) error {
+	names, err := f.Archives()
+	if err != nil {
+		return err
+	}
+	_, stem, _ := f.split()
+	for i, name := range names {
+		tooMany := f.cfg.Keep > 0 && i < len(names)-f.cfg.Keep
+		stamp, _ := time.Parse(archiveTime, stampOf(strings.TrimPrefix(filepath.Base(name), stem+"-")))
+		tooOld := f.cfg.KeepFor > 0 && now.Sub(stamp) > f.cfg.KeepFor
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete %s: %w", name, err)
+		}
+		log.Printf("Deleted firehose archive %s", name)
+	}
+	return nil
+}
+
+// compressFile streams name into name.gz or name.zst and deletes name
+func compressFile(name, compression string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	ext := map[string]string{"gzip": ".gz", "zstd": ".zst"}[compression]
+	tmp := name + ext + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // only still there if something failed
+
+	var w io.WriteCloser
+	if compression == "zstd" {
+		if w, err = zstd.NewWriter(dst); err != nil {
+			dst.Close()
+			return err
+		}
+	} else {
+		w = gzip.NewWriter(dst)
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		dst.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name+ext); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// exists reports whether anything is at path
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,150 @@
+package filehandler
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// readArchive returns an archive's contents, decompressed
+func readArchive(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch filepath.Ext(name) {
+	case ".gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gz
+	case ".zst":
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestFirehoseRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firehose.log")
+	cfg := RotateConfig{MaxSize: 20, Compression: "gzip"}
+	f, err := OpenFirehose(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first line", "second line", "third line"} {
+		if err := f.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archives, err := f.Archives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 2 {
+		t.Fatalf("archives = %v, want 2", archives)
+	}
+	var got []string
+	for _, name := range archives {
+		if !strings.HasSuffix(name, ".log.gz") {
+			t.Errorf("archive %s is not gzipped", name)
+		}
+		got = append(got, readArchive(t, name))
+	}
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, string(current))
+	if want := []string{"first line\n", "second line\n", "third line\n"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("files hold %q, want %q", got, want)
+	}
+}
+
+func TestOpenFirehoseArchivesLastRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "firehose.log")
+	if err := os.WriteFile(path, []byte("from the last run\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFirehose(path, RotateConfig{Compression: "zstd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Write(map[string]string{"Raw": "new"}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	archives, _ := f.Archives()
+	if len(archives) != 1 || !strings.HasSuffix(archives[0], ".log.zst") {
+		t.Fatalf("archives = %v, want one zstd archive", archives)
+	}
+	if got := readArchive(t, archives[0]); got != "from the last run\n" {
+		t.Errorf("archive holds %q", got)
+	}
+	if got, _ := os.ReadFile(path); string(got) != `{"Raw":"new"}`+"\n" {
+		t.Errorf("firehose holds %q", got)
+	}
+}
+
+func TestFirehosePrunesArchives(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "firehose.log")
+	old := filepath.Join(dir, "firehose-"+time.Now().Add(-30*24*time.Hour).UTC().Format(archiveTime)+".log.gz")
+	unrelated := filepath.Join(dir, "firehose-notes.txt")
+	for _, name := range []string{old, unrelated} {
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := OpenFirehose(path, RotateConfig{Compression: "none", Keep: 2, KeepFor: 7 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := f.Write("line"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if err := f.prune(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	archives, _ := f.Archives()
+	if len(archives) != 2 {
+		t.Errorf("archives = %v, want the 2 newest", archives)
+	}
+	if exists(old) {
+		t.Error("archive older than KeepFor was kept")
+	}
+	if !exists(unrelated) {
+		t.Error("file that isn't an archive was deleted")
+	}
+}
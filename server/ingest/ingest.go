@@ -0,0 +1,418 @@
+// Package ingest writes the logs of every agent connection to the logs DB.
+// Connections queue logs on a bounded channel, and a single writer flushes
+// them through InsertLogsBatch once enough have built up or the oldest has
+// waited long enough, so many agents share each transaction.
+// Logs that can't be stored are kept as dead letters rather than lost.
+package ingest
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/server/parser"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// statsWindow is how far back throughput and latency are averaged
+const statsWindow = time.Minute
+
+// Config sets how the pipeline buffers logs
+type Config struct {
+	QueueSize  int           // submissions that can wait before Submit blocks
+	BatchSize  int           // logs that are flushed without waiting any longer
+	FlushEvery time.Duration // longest a submission waits for others to join its batch
+}
+
+// DefaultConfig suits agents that send up to 256 logs at a time and wait for an ack
+func DefaultConfig() Config {
+	return Config{
+		QueueSize:  256,
+		BatchSize:  2048,
+		FlushEvery: 50 * time.Millisecond,
+	}
+}
+
+// Source is where logs came from, kept with any that become dead letters
+type Source struct {
+	AgentID    string
+	RemoteAddr string
+}
+
+// Result is the outcome of writing one submission.
+// Stored leaves out logs that duplicated stored ones, and DeadLettered counts
+// logs that failed to be stored and were kept as dead letters. Err is only set
+// when logs could be neither stored nor dead-lettered.
+type Result struct {
+	Stored       int
+	DeadLettered int
+	Err          error
+}
+
+// request is one submission waiting in the queue
+type request struct {
+	src    Source
+	logs   []structs.Log
+	queued time.Time
+	done   func(Result)
+}
+
+// flush is what the stats remember about one written batch
+type flush struct {
+	at       time.Time
+	logs     int
+	latency  time.Duration // summed over the batch's logs
+	maxWait  time.Duration
+	duration time.Duration
+}
+
+// Pipeline buffers logs and writes them in batches
+type Pipeline struct {
+	cfg     Config
+	db      *sql.DB
+	modules *logdb.ModuleCache
+	parser  *parser.Parser
+	queue   chan request
+	stopped chan struct{}
+	started time.Time
+
+	queuedLogs atomic.Int64
+	received   atomic.Uint64
+
+	mu           sync.Mutex
+	written      uint64
+	duplicates   uint64
+	deadLettered uint64
+	failed       uint64
+	batches      uint64
+	recent       []flush // flushes within statsWindow, oldest first
+}
+
+// New creates a pipeline writing to db, which also holds the dead letters.
+// Logs agents left to the server are parsed with logParser, which may be nil.
+// Start it with Run.
+func New(db *sql.DB, logParser *parser.Parser, cfg Config) *Pipeline {
+	return &Pipeline{
+		cfg:     cfg,
+		db:      db,
+		modules: logdb.NewModuleCache(),
+		parser:  logParser,
+		queue:   make(chan request, cfg.QueueSize),
+		stopped: make(chan struct{}),
+		started: time.Now(),
+	}
+}
+
+// Submit queues logs to be written, blocking while the queue is full.
+// It gives up with ctx's error if ctx is done first. Once queued, the logs are
+// written even if ctx ends, and done, if not nil, is called from the writer
+// with the outcome. Submit must not be called after Close.
+func (p *Pipeline) Submit(ctx context.Context, src Source, logs []structs.Log, done func(Result)) error {
+	// parse here rather than in the writer, which every agent waits on
+	for i := range logs {
+		p.parser.Parse(&logs[i])
+	}
+	req := request{src: src, logs: logs, queued: time.Now(), done: done}
+	p.queuedLogs.Add(int64(len(logs)))
+	select {
+	case p.queue <- req:
+		p.received.Add(uint64(len(logs)))
+		return nil
+	case <-ctx.Done():
+		p.queuedLogs.Add(-int64(len(logs)))
+		return ctx.Err()
+	}
+}
+
+// Write queues logs and waits until they are written
+func (p *Pipeline) Write(ctx context.Context, src Source, logs []structs.Log) (Result, error) {
+	results := make(chan Result, 1)
+	if err := p.Submit(ctx, src, logs, func(r Result) { results <- r }); err != nil {
+		return Result{}, err
+	}
+	r := <-results
+	return r, r.Err
+}
+
+// Run writes queued logs until Close is called and the queue is drained
+func (p *Pipeline) Run() {
+	defer close(p.stopped)
+	for {
+		first, ok := <-p.queue
+		if !ok {
+			return
+		}
+		batch := []request{first}
+		size := len(first.logs)
+
+		// take whatever is already waiting, then wait out the rest of
+		// FlushEvery for more
+		timer := time.NewTimer(time.Until(first.queued.Add(p.cfg.FlushEvery)))
+	collect:
+		for size < p.cfg.BatchSize {
+			var req request
+			select {
+			case req, ok = <-p.queue:
+			default:
+				select {
+				case req, ok = <-p.queue:
+				case <-timer.C:
+					break collect
+				}
+			}
+			if !ok {
+				break collect
+			}
+			batch = append(batch, req)
+			size += len(req.logs)
+		}
+		timer.Stop()
+		p.flush(batch)
+	}
+}
+
+// Close stops taking logs and waits for the queued ones to be written.
+// Every Submit must have returned, and Run must be running.
+func (p *Pipeline) Close() {
+	close(p.queue)
+	<-p.stopped
+}
+
+// flush writes a batch of submissions in one transaction and reports back to each
+func (p *Pipeline) flush(batch []request) {
+	var logs []structs.Log
+	for _, req := range batch {
+		logs = append(logs, req.logs...)
+	}
+
+	start := time.Now()
+	stored, err := logdb.InsertLogsBatch(p.db, logs, p.modules)
+	if err != nil && len(batch) > 1 {
+		// one bad submission shouldn't fail everyone else's
+		log.Printf("Error writing %d logs from %d submissions, retrying them one at a time: %v", len(logs), len(batch), err)
+		for _, req := range batch {
+			p.flush([]request{req})
+		}
+		return
+	}
+	results := make([]Result, len(batch))
+	if err != nil {
+		results[0] = p.salvage(batch[0], err)
+	} else {
+		i := 0
+		for n, req := range batch {
+			for range req.logs {
+				if stored[i] {
+					results[n].Stored++
+				}
+				i++
+			}
+		}
+	}
+	end := time.Now()
+	p.queuedLogs.Add(-int64(len(logs)))
+
+	f := flush{at: end, logs: len(logs), duration: end.Sub(start)}
+	for _, req := range batch {
+		wait := end.Sub(req.queued)
+		f.latency += wait * time.Duration(len(req.logs))
+		f.maxWait = max(f.maxWait, wait)
+	}
+	p.record(f, batch, results)
+
+	for n, req := range batch {
+		if req.done != nil {
+			req.done(results[n])
+		} else if results[n].Err != nil {
+			log.Printf("Error writing %d logs from agent %s: %v", len(req.logs), req.src.AgentID, results[n].Err)
+		}
+	}
+}
+
+// salvage stores what it can of a submission that failed as a whole, one log
+// at a time, and keeps the logs that still fail as dead letters
+func (p *Pipeline) salvage(req request, err error) Result {
+	var r Result
+	for _, l := range req.logs {
+		if len(req.logs) > 1 {
+			var stored []bool
+			if stored, err = logdb.InsertLogsBatch(p.db, []structs.Log{l}, p.modules); err == nil {
+				if stored[0] {
+					r.Stored++
+				}
+				continue
+			}
+		}
+
+		payload, jsonErr := json.Marshal(l)
+		if jsonErr != nil {
+			// the log can't even be encoded, so keep what it says
+			payload = []byte(fmt.Sprintf("%+v", l))
+		}
+		if dlErr := p.DeadLetter(req.src, logdb.DeadInsert, err, payload); dlErr != nil {
+			r.Err = fmt.Errorf("failed to store log (%v) or dead letter: %w", err, dlErr)
+			return r
+		}
+		r.DeadLettered++
+	}
+	return r
+}
+
+// DeadLetter keeps something an agent sent that couldn't be stored or decoded
+func (p *Pipeline) DeadLetter(src Source, kind string, err error, payload []byte) error {
+	log.Printf("Keeping a dead letter from agent %s at %s (%s): %v", src.AgentID, src.RemoteAddr, kind, err)
+	return logdb.InsertDeadLetter(p.db, logdb.DeadLetter{
+		Time:       time.Now(),
+		AgentID:    src.AgentID,
+		RemoteAddr: src.RemoteAddr,
+		Kind:       kind,
+		Error:      err.Error(),
+		Payload:    string(payload),
+	})
+}
+
+// Reingest puts a dead letter's logs back through the pipeline and removes it.
+// Logs that fail again become new dead letters.
+func (p *Pipeline) Reingest(ctx context.Context, id int64) (Result, error) {
+	d, err := logdb.GetDeadLetter(p.db, id)
+	if err != nil {
+		return Result{}, err
+	}
+	logs, err := decodePayload(d.Payload)
+	if err != nil {
+		return Result{}, fmt.Errorf("dead letter %d still can't be decoded: %w", id, err)
+	}
+
+	r, err := p.Write(ctx, Source{AgentID: d.AgentID, RemoteAddr: d.RemoteAddr}, logs)
+	if err != nil {
+		return r, err
+	}
+	return r, logdb.DeleteDeadLetter(p.db, id)
+}
+
+// Discard deletes a dead letter
+func (p *Pipeline) Discard(id int64) error {
+	return logdb.DeleteDeadLetter(p.db, id)
+}
+
+// decodePayload reads the logs in a dead letter, which holds either one log
+// or a whole batch frame
+func decodePayload(payload string) ([]structs.Log, error) {
+	var probe struct {
+		Logs json.RawMessage `json:"logs"`
+	}
+	if err := json.Unmarshal([]byte(payload), &probe); err != nil {
+		return nil, err
+	}
+	if probe.Logs == nil {
+		var l structs.Log
+		if err := json.Unmarshal([]byte(payload), &l); err != nil {
+			return nil, err
+		}
+		return []structs.Log{l}, nil
+	}
+
+	batch, bad, err := protocol.DecodeBatch([]byte(payload))
+	if err != nil {
+		return nil, err
+	}
+	if len(bad) > 0 {
+		return nil, fmt.Errorf("%d of its logs: %w", len(bad), bad[0].Err)
+	}
+	return batch.Logs, nil
+}
+
+// record adds a flush to the stats
+func (p *Pipeline) record(f flush, batch []request, results []Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.batches++
+	for n, r := range results {
+		p.written += uint64(r.Stored)
+		p.deadLettered += uint64(r.DeadLettered)
+		rest := uint64(len(batch[n].logs) - r.Stored - r.DeadLettered)
+		if r.Err != nil {
+			p.failed += rest
+		} else {
+			p.duplicates += rest
+		}
+	}
+	p.recent = append(p.recent, f)
+	p.prune(f.at)
+}
+
+// prune forgets flushes that fell out of the stats window. Caller must hold p.mu.
+func (p *Pipeline) prune(now time.Time) {
+	i := 0
+	for i < len(p.recent) && now.Sub(p.recent[i].at) > statsWindow {
+		i++
+	}
+	p.recent = p.recent[i:]
+}
+
+// Stats describes the pipeline's load. Averages cover the last minute;
+// durations are in nanoseconds in JSON.
+type Stats struct {
+	QueueDepth int   `json:"queue_depth"` // submissions waiting to be written
+	QueueSize  int   `json:"queue_size"`
+	QueuedLogs int64 `json:"queued_logs"`
+
+	Received     uint64 `json:"received"` // logs queued since the server started
+	Written      uint64 `json:"written"`
+	Duplicates   uint64 `json:"duplicates"` // resent logs that were already stored
+	DeadLettered uint64 `json:"dead_lettered"`
+	Failed       uint64 `json:"failed"` // logs that couldn't be dead-lettered either
+	Batches      uint64 `json:"batches"`
+
+	Throughput float64       `json:"throughput"`  // logs ingested per second, duplicates included
+	AvgBatch   float64       `json:"avg_batch"`   // logs per batch
+	AvgLatency time.Duration `json:"avg_latency"` // from being queued to being written
+	MaxLatency time.Duration `json:"max_latency"`
+	AvgWrite   time.Duration `json:"avg_write"` // time spent in the insert, per batch
+}
+
+// Stats returns the pipeline's current load
+func (p *Pipeline) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.prune(now)
+
+	s := Stats{
+		QueueDepth:   len(p.queue),
+		QueueSize:    cap(p.queue),
+		QueuedLogs:   p.queuedLogs.Load(),
+		Received:     p.received.Load(),
+		Written:      p.written,
+		Duplicates:   p.duplicates,
+		DeadLettered: p.deadLettered,
+		Failed:       p.failed,
+		Batches:      p.batches,
+	}
+	if len(p.recent) == 0 {
+		return s
+	}
+
+	var logs int
+	var latency, write time.Duration
+	for _, f := range p.recent {
+		logs += f.logs
+		latency += f.latency
+		write += f.duration
+		s.MaxLatency = max(s.MaxLatency, f.maxWait)
+	}
+	s.Throughput = float64(logs) / min(statsWindow, now.Sub(p.started)).Seconds()
+	s.AvgBatch = float64(logs) / float64(len(p.recent))
+	if logs > 0 {
+		s.AvgLatency = latency / time.Duration(logs)
+	}
+	s.AvgWrite = write / time.Duration(len(p.recent))
+	return s
+}
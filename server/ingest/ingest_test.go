@@ -0,0 +1,174 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// newTestPipeline returns a running pipeline on a fresh logs DB
+func newTestPipeline(t *testing.T, cfg Config) *Pipeline {
+	t.Helper()
+	db, _, err := logdb.InitLogDB(filepath.Join(t.TempDir(), "logs.sqlite"))
+	if err != nil {
+		t.Fatalf("InitLogDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	p := New(db, nil, cfg)
+	go p.Run()
+	return p
+}
+
+// batchOf makes n logs from an agent, with IDs so resends are caught
+func batchOf(agent string, n int) []structs.Log {
+	logs := make([]structs.Log, n)
+	for i := range logs {
+		logs[i] = structs.Log{
+			ID: fmt.Sprintf("%s-%d", agent, i), Name: "auth", Path: "/var/log/auth.log",
+			Host: agent, Timestamp: int64(i), Module: "syslog", Raw: "line",
+		}
+	}
+	return logs
+}
+
+func TestPipelineBatchesAgentsTogether(t *testing.T) {
+	p := newTestPipeline(t, Config{QueueSize: 16, BatchSize: 1000, FlushEvery: 50 * time.Millisecond})
+
+	var wg sync.WaitGroup
+	for a := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent := fmt.Sprintf("agent%d", a)
+			src := Source{AgentID: agent}
+			if r, err := p.Write(context.Background(), src, batchOf(agent, 20)); err != nil || r.Stored != 20 {
+				t.Errorf("Expected %s's 20 logs stored, got %+v (%v)", agent, r, err)
+			}
+			// the agent missed the ack and resends, with one new log
+			if r, err := p.Write(context.Background(), src, batchOf(agent, 21)); err != nil || r.Stored != 1 {
+				t.Errorf("Expected only %s's new log stored, got %+v (%v)", agent, r, err)
+			}
+		}()
+	}
+	wg.Wait()
+	p.Close()
+
+	s := p.Stats()
+	if s.Received != 410 || s.Written != 210 || s.Duplicates != 200 || s.Failed != 0 {
+		t.Errorf("Unexpected counts: %+v", s)
+	}
+	if s.Batches >= 20 {
+		t.Errorf("Expected submissions to share batches, got %d batches for 20", s.Batches)
+	}
+	if s.QueuedLogs != 0 || s.Throughput <= 0 || s.AvgLatency <= 0 {
+		t.Errorf("Unexpected load: %+v", s)
+	}
+}
+
+func TestPipelineDeadLettersLogsThatFail(t *testing.T) {
+	p := newTestPipeline(t, Config{QueueSize: 16, BatchSize: 1000, FlushEvery: 100 * time.Millisecond})
+
+	bad := batchOf("bad", 3)
+	bad[1].Parsed = func() {} // can't be encoded
+
+	var badResult, goodResult Result
+	var badErr, goodErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		badResult, badErr = p.Write(context.Background(), Source{AgentID: "bad", RemoteAddr: "10.0.0.9"}, bad)
+	}()
+	go func() {
+		defer wg.Done()
+		goodResult, goodErr = p.Write(context.Background(), Source{AgentID: "good"}, batchOf("good", 5))
+	}()
+	wg.Wait()
+
+	if badErr != nil || badResult.Stored != 2 || badResult.DeadLettered != 1 {
+		t.Errorf("Expected the bad submission's good logs stored and one dead letter, got %+v (%v)", badResult, badErr)
+	}
+	if goodErr != nil || goodResult.Stored != 5 {
+		t.Errorf("Expected the good submission to be stored, got %+v (%v)", goodResult, goodErr)
+	}
+	if s := p.Stats(); s.DeadLettered != 1 || s.Written != 7 || s.Failed != 0 {
+		t.Errorf("Unexpected counts: %+v", s)
+	}
+
+	letters, total, err := logdb.ListDeadLetters(p.db, 10)
+	if err != nil || total != 1 {
+		t.Fatalf("Expected one dead letter, got %d (%v)", total, err)
+	}
+	d := letters[0]
+	if d.AgentID != "bad" || d.RemoteAddr != "10.0.0.9" || d.Kind != logdb.DeadInsert || d.Error == "" {
+		t.Errorf("Unexpected dead letter: %+v", d)
+	}
+	p.Close()
+}
+
+func TestReingestStoresDeadLetters(t *testing.T) {
+	p := newTestPipeline(t, Config{QueueSize: 16, BatchSize: 1000, FlushEvery: time.Millisecond})
+	defer p.Close()
+	src := Source{AgentID: "web01", RemoteAddr: "10.0.0.5"}
+
+	// a log and a frame whose logs were kept, and a frame that never decodes
+	p.DeadLetter(src, logdb.DeadInsert, errors.New("disk I/O error"), []byte(`{"id":"a","name":"auth","module":"syslog","raw":"one"}`))
+	p.DeadLetter(src, logdb.DeadDecode, errors.New("unexpected EOF"), []byte(`{"seq":3,"logs":[{"id":"b","raw":"two"},{"id":"c","raw":"three"}]}`))
+	p.DeadLetter(src, logdb.DeadDecode, errors.New("unexpected EOF"), []byte(`{"seq":4,"logs":[{"id":`))
+
+	letters, _, err := logdb.ListDeadLetters(p.db, 10)
+	if err != nil || len(letters) != 3 {
+		t.Fatalf("Expected 3 dead letters, got %d (%v)", len(letters), err)
+	}
+	stored := 0
+	for _, d := range letters {
+		r, err := p.Reingest(context.Background(), d.ID)
+		if d.Payload == `{"seq":4,"logs":[{"id":` {
+			if err == nil {
+				t.Error("Expected the truncated frame to fail again")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Reingest of %s failed: %v", d.Payload, err)
+		}
+		stored += r.Stored
+	}
+	if stored != 3 {
+		t.Errorf("Expected 3 logs stored, got %d", stored)
+	}
+
+	if _, total, _ := logdb.ListDeadLetters(p.db, 10); total != 1 {
+		t.Errorf("Expected only the truncated frame left, got %d dead letters", total)
+	}
+	if err := p.Discard(letters[0].ID); err != nil {
+		t.Errorf("Discard failed: %v", err)
+	}
+	if err := p.Discard(letters[0].ID); !errors.Is(err, logdb.ErrDeadLetterNotFound) {
+		t.Errorf("Expected discarding twice to fail, got %v", err)
+	}
+}
+
+func TestSubmitGivesUpWhenQueueIsFull(t *testing.T) {
+	p := New(nil, nil, Config{QueueSize: 1, BatchSize: 10, FlushEvery: time.Millisecond}) // not running
+	if err := p.Submit(context.Background(), Source{}, batchOf("a", 1), nil); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Submit(ctx, Source{}, batchOf("a", 1), nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected Submit to block until ctx ended, got %v", err)
+	}
+	if s := p.Stats(); s.QueueDepth != 1 || s.QueuedLogs != 1 {
+		t.Errorf("Expected one submission queued, got %+v", s)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/TLop503/LogCrunch/server/pki"
+)
+
+// initPKI handles `init-pki [dir] [host...]`, creating the CA agents enroll
+// against and a certificate for the intake listener
+func initPKI(args []string) {
+	dir := pki.DefaultDir
+	if len(args) > 0 {
+		dir, args = args[0], args[1:]
+	}
+	hosts := args
+	if len(hosts) == 0 {
+		name, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Error getting hostname, pass the hosts agents will connect to: %v", err)
+		}
+		hosts = []string{name, "localhost"}
+	}
+
+	if err := pki.Init(dir, hosts); err != nil {
+		log.Fatalf("Error creating PKI: %v", err)
+	}
+
+	fmt.Printf("Created a CA and an intake certificate for %v in %s\n", hosts, dir)
+	fmt.Println("Start the server with:")
+	fmt.Printf("  <log_host> <log_port> %s %s <http_host> <http_port> %s\n",
+		filepath.Join(dir, pki.ServerCert), filepath.Join(dir, pki.ServerKey), filepath.Join(dir, pki.CACert))
+	fmt.Println("then create enrollment tokens on the web UI's Enrollment page.")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/TLop503/LogCrunch/server/db/enroll"
+	"github.com/TLop503/LogCrunch/server/pki"
+)
+
+// intakeTLSConfig loads the intake certificate and, if clientCA is set,
+// requires every agent to present a certificate signed by it. Certificates
+// issued through enrollment are also refused until approved, and once revoked.
+func intakeTLSConfig(crt, key, clientCA string, enrollDB *sql.DB) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate and key: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", clientCA)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no client certificate")
+		}
+		status, err := enroll.CertStatus(enrollDB, pki.Serial(cs.PeerCertificates[0].SerialNumber))
+		if err != nil {
+			return err
+		}
+		switch status {
+		case enroll.StatusPending:
+			return errors.New("agent is enrolled but not approved yet")
+		case enroll.StatusRevoked:
+			return errors.New("agent certificate has been revoked")
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// agentCert is an agent's verified client certificate, or nil when the
+// listener doesn't require client certificates
+func agentCert(conn net.Conn) *x509.Certificate {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	chains := tc.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	return chains[0][0]
+}
+
+// agentIdentity is the name on an agent's certificate:
+// its first DNS SAN, or else its common name
+func agentIdentity(cert *x509.Certificate) string {
+	if cert == nil {
+		return ""
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.CommonName
+}
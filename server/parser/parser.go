@@ -0,0 +1,245 @@
+// Package parser parses the logs agents leave to the server, with the module
+// definitions in the modules table of the logs DB. Modules are edited through
+// it so stored logs can be parsed again with the new definition.
+package parser
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// reparseChunk is how many stored logs are parsed again per transaction
+const reparseChunk = 500
+
+// fieldTypes are the types a schema may give a field, as structs.ReflectSchema
+// names them. Only numbers are converted; the rest stay strings.
+var fieldTypes = map[string]bool{"string": true, "int": true, "float": true, "bool": true, "interface{}": true}
+
+// Progress is how far re-parsing a module's stored logs got
+type Progress struct {
+	Module   string
+	Started  time.Time
+	Finished time.Time // zero while running
+	Parsed   int
+	Failed   int // logs the module didn't match
+	Err      string
+}
+
+// Running reports whether the re-parse is still going
+func (p Progress) Running() bool {
+	return p.Finished.IsZero()
+}
+
+// Parser holds the compiled modules
+type Parser struct {
+	db      *sql.DB
+	mu      sync.RWMutex
+	modules map[string]structs.ParserModule
+	reparse map[string]*Progress
+}
+
+// New loads every module with a regex from db
+func New(db *sql.DB) (*Parser, error) {
+	list, err := logdb.ListModules(db)
+	if err != nil {
+		return nil, err
+	}
+	p := &Parser{
+		db:      db,
+		modules: make(map[string]structs.ParserModule),
+		reparse: make(map[string]*Progress),
+	}
+	for _, m := range list {
+		if m.Regex == "" {
+			continue
+		}
+		module, err := compile(m)
+		if err != nil {
+			log.Printf("Skipping module %s: %v", m.Name, err)
+			continue
+		}
+		p.modules[m.Name] = module
+	}
+	return p, nil
+}
+
+// compile checks a module's regex and schema and builds it
+func compile(m logdb.DBModule) (structs.ParserModule, error) {
+	re, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return structs.ParserModule{}, fmt.Errorf("invalid regex: %w", err)
+	}
+	schema := map[string]string{}
+	if m.Schema != "" {
+		if err := json.Unmarshal([]byte(m.Schema), &schema); err != nil {
+			return structs.ParserModule{}, fmt.Errorf("schema must be a JSON object of field types: %w", err)
+		}
+	}
+	for field, typ := range schema {
+		if !fieldTypes[typ] {
+			return structs.ParserModule{}, fmt.Errorf("field %s has unknown type %q", field, typ)
+		}
+	}
+	return structs.ParserModule{Regex: re, Schema: schema}, nil
+}
+
+// Parse fills in the parsed fields of a log the agent left to the server.
+// Logs of modules the server can't parse are left alone.
+func (p *Parser) Parse(l *structs.Log) {
+	if p == nil || !l.RawOnly {
+		return
+	}
+	p.mu.RLock()
+	module, ok := p.modules[l.Module]
+	p.mu.RUnlock()
+	if !ok {
+		return
+	}
+	l.Parsed = parse(module, l.Raw)
+}
+
+// parse returns a line's fields, or the reason the module didn't match it
+func parse(module structs.ParserModule, raw string) any {
+	fields, err := module.Parse(raw)
+	if err != nil {
+		return map[string]string{"Parsing error": err.Error()}
+	}
+	return fields
+}
+
+// Update validates and stores a module, and parses new logs with it.
+// An empty regex stops the server parsing the module.
+func (p *Parser) Update(m logdb.DBModule) error {
+	if m.Name == "" {
+		return fmt.Errorf("module needs a name")
+	}
+	var module structs.ParserModule
+	if m.Regex != "" {
+		var err error
+		if module, err = compile(m); err != nil {
+			return fmt.Errorf("module %s: %w", m.Name, err)
+		}
+	}
+	if err := logdb.SaveModule(p.db, m); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m.Regex == "" {
+		delete(p.modules, m.Name)
+	} else {
+		p.modules[m.Name] = module
+	}
+	return nil
+}
+
+// Reparse parses a module's stored logs again with its current definition.
+// It runs until done or ctx ends, and only one runs per module at a time.
+func (p *Parser) Reparse(ctx context.Context, name string) error {
+	module, prog, err := p.beginReparse(name)
+	if err != nil {
+		return err
+	}
+	return p.runReparse(ctx, name, module, prog)
+}
+
+// StartReparse is Reparse in the background. It only returns the errors that
+// keep the re-parse from starting; how it went shows in Progress.
+func (p *Parser) StartReparse(ctx context.Context, name string) error {
+	module, prog, err := p.beginReparse(name)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := p.runReparse(ctx, name, module, prog); err != nil {
+			log.Printf("Error re-parsing module %s: %v", name, err)
+		}
+	}()
+	return nil
+}
+
+// beginReparse records that a module's re-parse started, unless one is running
+func (p *Parser) beginReparse(name string) (structs.ParserModule, *Progress, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	module, ok := p.modules[name]
+	if !ok {
+		return module, nil, fmt.Errorf("module %s has no regex for the server to parse with", name)
+	}
+	if prog, ok := p.reparse[name]; ok && prog.Running() {
+		return module, nil, fmt.Errorf("module %s is already being re-parsed", name)
+	}
+	prog := &Progress{Module: name, Started: time.Now()}
+	p.reparse[name] = prog
+	return module, prog, nil
+}
+
+// runReparse re-parses the module's stored logs and records how it went
+func (p *Parser) runReparse(ctx context.Context, name string, module structs.ParserModule, prog *Progress) error {
+	err := p.reparseLogs(ctx, name, module, prog)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prog.Finished = time.Now()
+	if err != nil {
+		prog.Err = err.Error()
+	}
+	return err
+}
+
+// reparseLogs parses the module's stored logs in chunks, updating prog
+func (p *Parser) reparseLogs(ctx context.Context, name string, module structs.ParserModule, prog *Progress) error {
+	var after int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		raws, err := logdb.RawLogs(p.db, name, after, reparseChunk)
+		if err != nil {
+			return err
+		}
+		if len(raws) == 0 {
+			return nil
+		}
+
+		parsed := make(map[int64]any, len(raws))
+		failed := 0
+		for _, r := range raws {
+			fields := parse(module, r.Raw)
+			if _, bad := fields.(map[string]string); bad {
+				failed++
+			}
+			parsed[r.ID] = fields
+		}
+		if err := logdb.SetParsed(p.db, parsed); err != nil {
+			return err
+		}
+		after = raws[len(raws)-1].ID
+
+		p.mu.Lock()
+		prog.Parsed += len(raws) - failed
+		prog.Failed += failed
+		p.mu.Unlock()
+	}
+}
+
+// Progress returns the latest re-parse of every module that had one
+func (p *Parser) Progress() map[string]Progress {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]Progress, len(p.reparse))
+	for name, prog := range p.reparse {
+		out[name] = *prog
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package parser
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// newTestParser returns a parser on a fresh logs DB
+func newTestParser(t *testing.T) *Parser {
+	t.Helper()
+	db, _, err := logdb.InitLogDB(filepath.Join(t.TempDir(), "logs.sqlite"))
+	if err != nil {
+		t.Fatalf("InitLogDB failed: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	p, err := New(db)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	return p
+}
+
+// parsedOf returns the stored parsed field of a log
+func parsedOf(t *testing.T, db *sql.DB, id string) string {
+	t.Helper()
+	var parsed string
+	if err := db.QueryRow(`SELECT parsed FROM logs WHERE log_uid = ?`, id).Scan(&parsed); err != nil {
+		t.Fatalf("Reading log %s failed: %v", id, err)
+	}
+	return parsed
+}
+
+func TestParseRawOnlyLogs(t *testing.T) {
+	p := newTestParser(t)
+	err := p.Update(logdb.DBModule{Name: "app", Regex: `^(?P<level>\w+) took (?P<ms>\d+)ms$`, Schema: `{"level":"string","ms":"int"}`})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	l := structs.Log{Module: "app", Raw: "INFO took 12ms", RawOnly: true}
+	p.Parse(&l)
+	if fields, ok := l.Parsed.(map[string]interface{}); !ok || fields["level"] != "INFO" || fields["ms"] != 12 {
+		t.Errorf("Expected the line parsed with the app module, got %#v", l.Parsed)
+	}
+
+	l = structs.Log{Module: "app", Raw: "garbage", RawOnly: true}
+	p.Parse(&l)
+	if fields, ok := l.Parsed.(map[string]string); !ok || fields["Parsing error"] == "" {
+		t.Errorf("Expected a parsing error, got %#v", l.Parsed)
+	}
+
+	// the built-in modules are loaded from the DB too
+	l = structs.Log{Module: "syslog", Raw: "Oct 18 10:00:00 web01 sshd[42]: Accepted key", RawOnly: true}
+	p.Parse(&l)
+	if fields, ok := l.Parsed.(map[string]interface{}); !ok || fields["process"] != "sshd" {
+		t.Errorf("Expected the line parsed with the syslog module, got %#v", l.Parsed)
+	}
+
+	for _, l := range []structs.Log{
+		{Module: "app", Raw: "INFO took 12ms"},                    // parsed by the agent
+		{Module: "unknown", Raw: "INFO took 12ms", RawOnly: true}, // no definition
+	} {
+		p.Parse(&l)
+		if l.Parsed != nil {
+			t.Errorf("Expected %+v to be left alone, got %#v", l, l.Parsed)
+		}
+	}
+}
+
+func TestUpdateRejectsInvalidModules(t *testing.T) {
+	p := newTestParser(t)
+	for _, m := range []logdb.DBModule{
+		{Name: "", Regex: `(?P<a>.*)`},
+		{Name: "app", Regex: `(?P<a>.*`},
+		{Name: "app", Regex: `(?P<a>.*)`, Schema: `["a"]`},
+		{Name: "app", Regex: `(?P<a>.*)`, Schema: `{"a":"timestamp"}`},
+	} {
+		if err := p.Update(m); err == nil {
+			t.Errorf("Expected %+v to be rejected", m)
+		}
+	}
+	if _, err := logdb.GetModule(p.db, "app"); err != logdb.ErrModuleNotFound {
+		t.Errorf("Expected nothing saved, got %v", err)
+	}
+
+	// an empty regex stops the server parsing the module
+	if err := p.Update(logdb.DBModule{Name: "syslog", Schema: "{}"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	l := structs.Log{Module: "syslog", Raw: "Oct 18 10:00:00 web01 sshd[42]: Accepted key", RawOnly: true}
+	p.Parse(&l)
+	if l.Parsed != nil {
+		t.Errorf("Expected syslog to no longer be parsed, got %#v", l.Parsed)
+	}
+}
+
+func TestReparseStoredLogs(t *testing.T) {
+	p := newTestParser(t)
+	if err := p.Update(logdb.DBModule{Name: "app", Regex: `^(?P<msg>.*)$`, Schema: "{}"}); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	// more than one chunk, a few of which the new regex won't match
+	var logs []structs.Log
+	for i := range reparseChunk + 20 {
+		raw := fmt.Sprintf("user=u%d action=login", i)
+		if i%100 == 0 {
+			raw = "malformed"
+		}
+		l := structs.Log{ID: fmt.Sprint(i), Name: "app", Module: "app", Raw: raw, RawOnly: true}
+		p.Parse(&l)
+		logs = append(logs, l)
+	}
+	logs = append(logs, structs.Log{ID: "other", Module: "syslog", Raw: "user=x action=login"})
+	// an agent that parses the module itself, e.g. a multiline target keeping continuation lines
+	agentParsed := structs.Log{ID: "agent", Module: "app", Raw: "user=y action=login\n  at main", Parsed: map[string]string{"user": "y", "continuation": "  at main"}}
+	logs = append(logs, agentParsed)
+	if _, err := logdb.InsertLogsBatch(p.db, logs, nil); err != nil {
+		t.Fatalf("InsertLogsBatch failed: %v", err)
+	}
+
+	err := p.Update(logdb.DBModule{Name: "app", Regex: `^user=(?P<user>\S+) action=(?P<action>\S+)$`, Schema: `{"user":"string","action":"string"}`})
+	if err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if err := p.Reparse(context.Background(), "app"); err != nil {
+		t.Fatalf("Reparse failed: %v", err)
+	}
+
+	prog := p.Progress()["app"]
+	if prog.Running() || prog.Parsed != reparseChunk+14 || prog.Failed != 6 || prog.Err != "" {
+		t.Errorf("Unexpected progress: %+v", prog)
+	}
+	if got := parsedOf(t, p.db, "7"); got != `{"action":"login","user":"u7"}` {
+		t.Errorf("Expected log 7 parsed again, got %s", got)
+	}
+	if got := parsedOf(t, p.db, "other"); got != "null" {
+		t.Errorf("Expected other modules' logs left alone, got %s", got)
+	}
+	if got := parsedOf(t, p.db, "agent"); got != `{"continuation":"  at main","user":"y"}` {
+		t.Errorf("Expected logs the agent parsed left alone, got %s", got)
+	}
+
+	if err := p.Reparse(context.Background(), "unknown"); err == nil {
+		t.Error("Expected re-parsing a module without a regex to fail")
+	}
+}
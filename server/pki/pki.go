@@ -0,0 +1,238 @@
+// Package pki is the server's built-in certificate authority. It creates the
+// CA and the intake certificate on first install, and signs the client
+// certificates agents request when they enroll.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultDir = "/opt/LogCrunch/pki"
+
+	CACert     = "ca.crt"
+	CAKey      = "ca.key"
+	ServerCert = "server.crt"
+	ServerKey  = "server.key"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 2 * 365 * 24 * time.Hour
+	// AgentValidity is how long an enrolled agent's certificate lasts
+	AgentValidity = 365 * 24 * time.Hour
+)
+
+// CA signs certificates with the key created by Init
+type CA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+// Init creates a CA and an intake certificate for hosts (names or IPs) in dir.
+// It refuses to replace an existing CA, since every agent trusts it.
+func Init(dir string, hosts []string) error {
+	if _, err := os.Stat(filepath.Join(dir, CAKey)); err == nil {
+		return fmt.Errorf("a CA already exists in %s", dir)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create PKI directory: %w", err)
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	caTmpl, err := newTemplate("LogCrunch CA", caValidity)
+	if err != nil {
+		return err
+	}
+	caTmpl.IsCA = true
+	caTmpl.BasicConstraintsValid = true
+	caTmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate server key: %w", err)
+	}
+	name := "LogCrunch server"
+	if len(hosts) > 0 {
+		name = hosts[0]
+	}
+	serverTmpl, err := newTemplate(name, serverValidity)
+	if err != nil {
+		return err
+	}
+	serverTmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	serverTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			serverTmpl.IPAddresses = append(serverTmpl.IPAddresses, ip)
+		} else {
+			serverTmpl.DNSNames = append(serverTmpl.DNSNames, h)
+		}
+	}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTmpl, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create server certificate: %w", err)
+	}
+
+	if err := writeKey(filepath.Join(dir, CAKey), caKey); err != nil {
+		return err
+	}
+	if err := writeCert(filepath.Join(dir, CACert), caDER); err != nil {
+		return err
+	}
+	if err := writeKey(filepath.Join(dir, ServerKey), serverKey); err != nil {
+		return err
+	}
+	return writeCert(filepath.Join(dir, ServerCert), serverDER)
+}
+
+// Load reads the CA created by Init from dir
+func Load(dir string) (*CA, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, CACert))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("CA certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	keyPEM, err := os.ReadFile(filepath.Join(dir, CAKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA key: %w", err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("CA key is not PEM")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key can't sign")
+	}
+
+	return &CA{cert: cert, certPEM: certPEM, key: signer}, nil
+}
+
+// CertPEM is the CA certificate agents should trust
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Fingerprint is the CA certificate's SHA-256, for checking the copy an agent received
+func (ca *CA) Fingerprint() string {
+	return Fingerprint(ca.cert.Raw)
+}
+
+// Signed is a client certificate issued to an agent
+type Signed struct {
+	CertPEM     []byte
+	Serial      string
+	Fingerprint string
+	NotAfter    time.Time
+}
+
+// SignCSR issues a client certificate for the key in csrPEM. The certificate
+// is named name, whatever the request asked for, since the name becomes the
+// agent's identity on the intake connection.
+func (ca *CA) SignCSR(csrPEM []byte, name string) (Signed, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return Signed{}, errors.New("certificate request is not PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return Signed{}, fmt.Errorf("failed to parse certificate request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return Signed{}, fmt.Errorf("bad certificate request signature: %w", err)
+	}
+
+	tmpl, err := newTemplate(name, AgentValidity)
+	if err != nil {
+		return Signed{}, err
+	}
+	tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return Signed{}, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	return Signed{
+		CertPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Serial:      Serial(tmpl.SerialNumber),
+		Fingerprint: Fingerprint(der),
+		NotAfter:    tmpl.NotAfter,
+	}, nil
+}
+
+// Serial formats a certificate serial number the way it is stored
+func Serial(n *big.Int) string {
+	return n.Text(16)
+}
+
+// Fingerprint is the SHA-256 of a DER certificate, as the agent's pinned_sha256 expects
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// newTemplate starts a certificate with a random serial, valid from now
+func newTemplate(name string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-5 * time.Minute), // some slack for clocks that are a little behind
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode key: %w", err)
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+func writeCert(path string, der []byte) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
@@ -0,0 +1,78 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignedAgentCertChainsToCA(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir, []string{"siem.example.com", "10.0.0.1"}); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	if err := Init(dir, nil); err == nil {
+		t.Error("Expected Init to refuse replacing the CA")
+	}
+	ca, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "root"}, // asking for a name we shouldn't get
+	}, key)
+	if err != nil {
+		t.Fatalf("CreateCertificateRequest failed: %v", err)
+	}
+	signed, err := ca.SignCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), "web01")
+	if err != nil {
+		t.Fatalf("SignCSR failed: %v", err)
+	}
+
+	block, _ := pem.Decode(signed.CertPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+	if cert.Subject.CommonName != "web01" {
+		t.Errorf("Expected the certificate to be named web01, got %q", cert.Subject.CommonName)
+	}
+	if Serial(cert.SerialNumber) != signed.Serial {
+		t.Errorf("Expected serial %s, got %s", signed.Serial, Serial(cert.SerialNumber))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertPEM())
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Expected the agent certificate to verify as a client: %v", err)
+	}
+
+	// the intake certificate is usable as is
+	server, err := tls.LoadX509KeyPair(filepath.Join(dir, ServerCert), filepath.Join(dir, ServerKey))
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair failed: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(server.Certificate[0])
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "10.0.0.1"}); err != nil {
+		t.Errorf("Expected the server certificate to verify for its IP: %v", err)
+	}
+}
+
+func TestSignCSRRejectsGarbage(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(dir, nil); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	ca, _ := Load(dir)
+	if _, err := ca.SignCSR([]byte("not a csr"), "web01"); err == nil {
+		t.Error("Expected an error for a request that isn't PEM")
+	}
+}
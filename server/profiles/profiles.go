@@ -0,0 +1,105 @@
+// Package profiles pushes config profiles to connected agents: when they
+// connect, and whenever a profile, an assignment, or an agent's alias or tags
+// change. Profiles and assignments live in the agents DB.
+package profiles
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/server/db/agents"
+)
+
+// session is one connection of an agent that takes profiles
+type session struct {
+	agentID string
+	send    func(protocol.Profile) error
+
+	mu   sync.Mutex // held while sending, so pushes don't cross
+	sent string     // Label of what the agent runs or was last sent
+}
+
+// Distributor keeps track of the connected agents and sends them their profiles
+type Distributor struct {
+	db       *sql.DB
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+}
+
+// New creates a distributor reading profiles from the agents DB
+func New(agentDB *sql.DB) *Distributor {
+	return &Distributor{db: agentDB, sessions: make(map[*session]struct{})}
+}
+
+// Attach starts sending profiles to an agent's connection through send.
+// running is the Label of the profile the agent says it runs; it is sent its
+// profile straight away if that isn't it. The returned func stops sending.
+func (d *Distributor) Attach(agentID, running string, send func(protocol.Profile) error) (detach func()) {
+	s := &session{agentID: agentID, send: send, sent: running}
+	d.mu.Lock()
+	d.sessions[s] = struct{}{}
+	d.mu.Unlock()
+
+	d.push(s)
+	return func() {
+		d.mu.Lock()
+		delete(d.sessions, s)
+		d.mu.Unlock()
+	}
+}
+
+// Refresh sends every connected agent whose profile changed its new one
+func (d *Distributor) Refresh() {
+	d.mu.Lock()
+	list := make([]*session, 0, len(d.sessions))
+	for s := range d.sessions {
+		list = append(list, s)
+	}
+	d.mu.Unlock()
+
+	for _, s := range list {
+		d.push(s)
+	}
+}
+
+// push sends an agent its profile, or an empty one if it lost its profile,
+// unless it already has it
+func (d *Distributor) push(s *session) {
+	// looked up under the lock, so a slower push can't send an older profile
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	want, err := d.Profile(s.agentID)
+	if err != nil {
+		log.Printf("Error looking up the profile of agent %s: %v", s.agentID, err)
+		return
+	}
+	if want.Label() == s.sent {
+		return
+	}
+	if err := s.send(want); err != nil {
+		log.Printf("Error sending profile %s to agent %s: %v", want.Label(), s.agentID, err)
+		return
+	}
+	if want.Name == "" {
+		log.Printf("Told agent %s to go back to its own config", s.agentID)
+	} else {
+		log.Printf("Sent profile %s to agent %s", want.Label(), s.agentID)
+	}
+	s.sent = want.Label()
+}
+
+// Profile returns the profile an agent should run, which has no name if
+// none is assigned to it
+func (d *Distributor) Profile(agentID string) (protocol.Profile, error) {
+	agent, err := agents.Get(d.db, agentID)
+	if err != nil {
+		return protocol.Profile{}, err
+	}
+	p, _, ok, err := agents.ProfileFor(d.db, agent)
+	if err != nil || !ok {
+		return protocol.Profile{}, err
+	}
+	return p.Protocol(), nil
+}
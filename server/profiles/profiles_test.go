@@ -0,0 +1,66 @@
+package profiles
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/server/db/agents"
+)
+
+func TestDistributorPushesChanges(t *testing.T) {
+	db, err := agents.InitAgentDB(filepath.Join(t.TempDir(), "agents.sqlite"))
+	if err != nil {
+		t.Fatalf("InitAgentDB failed: %v", err)
+	}
+	defer db.Close()
+	if err := agents.Connected(db, agents.Agent{ID: "abc", RemoteAddr: "10.0.0.5", LastSeen: time.Now()}); err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+	if _, err := agents.SaveProfile(db, "web", "Targets: []\n"); err != nil {
+		t.Fatalf("SaveProfile failed: %v", err)
+	}
+	if err := agents.Assign(db, agents.Assignment{Kind: agents.AssignTag, Value: "web", Profile: "web"}); err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+
+	var got []string
+	d := New(db)
+	detach := d.Attach("abc", "", func(p protocol.Profile) error {
+		got = append(got, p.Label())
+		return nil
+	})
+	if len(got) != 0 {
+		t.Fatalf("Expected nothing sent to an agent without a profile, got %v", got)
+	}
+
+	agents.SetTags(db, "abc", []string{"web"})
+	d.Refresh()
+	d.Refresh() // already has it
+	agents.SaveProfile(db, "web", "Services: []\n")
+	d.Refresh()
+	agents.SetTags(db, "abc", nil)
+	d.Refresh()
+	if want := []string{"web@1", "web@2", ""}; !slices.Equal(got, want) {
+		t.Errorf("Expected %q sent, got %q", want, got)
+	}
+
+	detach()
+	agents.SetTags(db, "abc", []string{"web"})
+	d.Refresh()
+	if len(got) != 3 {
+		t.Errorf("Expected nothing sent after detaching, got %q", got)
+	}
+
+	// an agent that already runs its profile isn't sent it again on connect
+	got = nil
+	d.Attach("abc", "web@2", func(p protocol.Profile) error {
+		got = append(got, p.Label())
+		return nil
+	})
+	if len(got) != 0 {
+		t.Errorf("Expected nothing sent, got %q", got)
+	}
+}
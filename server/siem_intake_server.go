@@ -1,24 +1,58 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	userauth "github.com/TLop503/LogCrunch/server/user_auth"
 
+	"github.com/TLop503/LogCrunch/protocol"
+	agentdb "github.com/TLop503/LogCrunch/server/db/agents"
+	enrolldb "github.com/TLop503/LogCrunch/server/db/enroll"
 	logdb "github.com/TLop503/LogCrunch/server/db/logs"
 	"github.com/TLop503/LogCrunch/server/filehandler"
+	"github.com/TLop503/LogCrunch/server/ingest"
+	"github.com/TLop503/LogCrunch/server/parser"
+	"github.com/TLop503/LogCrunch/server/pki"
+	"github.com/TLop503/LogCrunch/server/profiles"
 	"github.com/TLop503/LogCrunch/server/self_logging"
+	"github.com/TLop503/LogCrunch/server/watchdog"
 	"github.com/TLop503/LogCrunch/server/webserver"
 	"github.com/TLop503/LogCrunch/structs"
 )
 
+const (
+	// how long shutdown waits for in-flight inserts before giving up
+	shutdownTimeout = 10 * time.Second
+	// how long an agent has to finish the TLS handshake
+	tlsHandshakeTimeout = 10 * time.Second
+
+	enrollDBPath = "/opt/LogCrunch/users/enrollment.db"
+	agentDBPath  = "/opt/LogCrunch/users/agents.db"
+
+	// how often a connected agent's last seen time is saved to the inventory
+	seenInterval = 30 * time.Second
+	// how long heartbeat reports are kept for the agent pages
+	telemetryRetention = 7 * 24 * time.Hour
+)
+
 func main() {
 
 	fmt.Println("\n __    _____  ___     ___  ____  __  __  _  _  ___  _   _ ")
@@ -26,11 +60,19 @@ func main() {
 	fmt.Println(" )(__  )(_)(( (_-.  ( (__  )   / )(__)(  )  (( (__  ) _ ( ")
 	fmt.Println("(____)(_____)\\___/   \\___)(_)\\_)(______)(_)\\_)\\___)(_) (_)")
 
+	if len(os.Args) >= 2 && os.Args[1] == "init-pki" {
+		initPKI(os.Args[2:])
+		return
+	}
+
 	if len(os.Args) < 5 {
-		fmt.Println("Usage: <log_host> <log_port> <cert_path> <key_path> [http_host] [http_port]")
+		fmt.Println("Usage: <log_host> <log_port> <cert_path> <key_path> [http_host] [http_port] [client_ca_path]")
 		fmt.Println("  log_host/log_port: Address for TLS log intake")
 		fmt.Println("  cert_path/key_path: TLS certificate and key files")
 		fmt.Println("  http_host/http_port: Address for webserver interface (optional, defaults to localhost:8080)")
+		fmt.Println("  client_ca_path: CA that agent certificates must be signed by (optional, without it any agent may connect)")
+		fmt.Println("   or: init-pki [dir] [host...]")
+		fmt.Println("  creates a CA and intake certificate for host in dir (defaults to " + pki.DefaultDir + ")")
 		return
 	}
 
@@ -51,14 +93,46 @@ func main() {
 		httpPort = os.Args[6]
 	}
 
+	clientCA := ""
+	if len(os.Args) >= 8 {
+		clientCA = os.Args[7]
+	}
+
 	httpAddr := httpHost + ":" + httpPort
 
-	// Load TLS certificate and key
-	cert, err := tls.LoadX509KeyPair(crt, key)
+	// enrolled agents and their one-time tokens
+	enrollDB, err := enrolldb.InitEnrollDB(enrollDBPath)
+	if err != nil {
+		log.Fatalf("Error initializing enrollment DB: %v", err)
+	}
+	defer enrollDB.Close()
+
+	// every agent that has ever connected, with its alias
+	agentDB, err := agentdb.InitAgentDB(agentDBPath)
+	if err != nil {
+		log.Fatalf("Error initializing agent DB: %v", err)
+	}
+	defer agentDB.Close()
+
+	// Load TLS certificate and key, and the CA agents must be signed by
+	config, err := intakeTLSConfig(crt, key, clientCA, enrollDB)
 	if err != nil {
-		log.Fatalf("Error loading TLS certificate and key: %v", err)
+		log.Fatal(err)
+	}
+	if clientCA == "" {
+		log.Println("No client CA given, accepting agents without certificates")
+	}
+
+	// agents can only enroll when the client CA is the one init-pki made, since we need its key
+	var ca *pki.CA
+	if clientCA != "" {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(clientCA), pki.CAKey)); err == nil {
+			if ca, err = pki.Load(filepath.Dir(clientCA)); err != nil {
+				log.Fatalf("Error loading CA for enrollment: %v", err)
+			}
+			log.Println("Agent enrollment enabled")
+		}
 	}
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
 	listener, err := tls.Listen("tcp", logHost+":"+logPort, config)
 	if err != nil {
 		log.Fatalf("Error starting TLS server: %v", err)
@@ -66,12 +140,6 @@ func main() {
 	defer listener.Close()
 
 	log.Printf("TLS server listening on %s:%s\n", logHost, logPort)
-	// log starting point
-	filehandler.RotateFile("/var/log/LogCrunch/firehose.log",
-		"/var/log/LogCrunch/old_firehose.log",
-		true,
-	)
-
 	// initialize log DBs
 	logDB, roDB, err := logdb.InitLogDB("/var/log/LogCrunch/logcrunch.logDB")
 	if err != nil {
@@ -84,35 +152,116 @@ func main() {
 	userDB, err := userauth.FirstTimeSetupCheck("/opt/LogCrunch/users/accounts.userDB", "/opt/LogCrunch/users/.setupCompleted")
 	defer userDB.Close()
 
-	// TODO: pull out to 1-liner in self_logging
-	startLog := self_logging.CreateStartLog(logHost, logPort)
-	err = filehandler.WriteToFile("/var/log/LogCrunch/firehose.log", true, false, startLog)
+	// SIGINT/SIGTERM cancel ctx, which stops intake and closes agent connections
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// every log received also goes to the firehose, archived when it gets big or old.
+	// what the last run left there is archived first, to start from the start log
+	firehose, err := filehandler.OpenFirehose(filehandler.LOG_INTAKE_DESTINATION, filehandler.DefaultRotateConfig())
 	if err != nil {
 		log.Fatalf("Error initializing firehose: %v", err)
 	}
+	defer firehose.Close()
+	// TODO: pull out to 1-liner in self_logging
+	if err := firehose.Write(self_logging.CreateStartLog(logHost, logPort)); err != nil {
+		log.Fatalf("Error initializing firehose: %v", err)
+	}
+	go firehose.Run(ctx)
 
-	// accept incoming transmissions indefinitely until we are killed
 	connList := structs.NewConnList()
+
+	// flag agents that stop sending heartbeats, and targets that stop logging
+	wd := watchdog.New(logDB, agentDB, watchdog.DefaultConfig())
+	if err := wd.Load(); err != nil {
+		log.Fatalf("Error starting watchdog: %v", err)
+	}
+	go wd.Run(ctx)
+	go pruneTelemetry(ctx, agentDB)
+
+	// logs agents leave to the server are parsed with the modules in the logs DB
+	logParser, err := parser.New(logDB)
+	if err != nil {
+		log.Fatalf("Error loading parser modules: %v", err)
+	}
+
+	// agents that take profiles are sent theirs, and again whenever they change
+	dist := profiles.New(agentDB)
+
+	// every connection's logs go through one batching writer
+	pipe := ingest.New(logDB, logParser, ingest.DefaultConfig())
+	go pipe.Run()
+
 	// start webserver server
-	webserver.StartRouter(httpAddr, connList, roDB, userDB) // use RO logDB connection!
+	httpServer := webserver.StartRouter(httpAddr, connList, roDB, userDB, enrollDB, agentDB, pipe, logParser, dist, ca) // use RO logDB connection!
 
+	// accept incoming transmissions until we are told to stop
+	var handlers sync.WaitGroup
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Errorf("Error accepting connection: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
-		connList.AddToConnList(conn)
-		go handleConnection(conn, connList, logDB)
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			handleConnection(ctx, conn, connList, pipe, firehose, agentDB, wd, dist)
+		}()
+	}
+
+	stop() // a second signal kills the server outright
+	log.Println("Shutting down, waiting for in-flight logs to be written")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down webserver: %v", err)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		pipe.Close()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		log.Println("All connections closed, closing databases")
+	case <-shutdownCtx.Done():
+		// closing the DBs under a running insert would block, so just leave
+		log.Printf("Connections still open after %v, exiting anyway", shutdownTimeout)
+		os.Exit(1)
 	}
 }
 
 // takes an active connection and a pointer to the list of connections
 // processes incoming logs (currently just writes to file)
 // and updates the connection in the list when it is closed.
-func handleConnection(conn net.Conn, connList *structs.ConnectionList, db *sql.DB) {
+// Agents open with a hello to negotiate compression; agents from before the
+// handshake existed are recognized by sending a log first, and stay uncompressed.
+// Once ctx is done, the log being inserted is finished and the connection is closed.
+// Frames that don't decode and logs that can't be stored are kept as dead letters.
+// Agents that take profiles get theirs from dist, on connect and as it changes.
+func handleConnection(ctx context.Context, conn net.Conn, connList *structs.ConnectionList, pipe *ingest.Pipeline, firehose *filehandler.Firehose, agentDB *sql.DB, wd *watchdog.Watchdog, dist *profiles.Distributor) {
 	defer conn.Close()
-	decoder := json.NewDecoder(conn)
+
+	var wireBytes, rawBytes atomic.Int64
+	wire := protocol.CountReader(conn, &wireBytes)
+	decoder := json.NewDecoder(wire)
+
+	// unblock the decoder on shutdown; the agent keeps anything unsent in its spool
+	stopWatching := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stopWatching()
 
 	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 	if err != nil {
@@ -120,44 +269,101 @@ func handleConnection(conn net.Conn, connList *structs.ConnectionList, db *sql.D
 		return
 	}
 
-	hostNameSet := false
-	hostname := ""
-
-	for {
-		var logEntry structs.Log
-		if err := decoder.Decode(&logEntry); err != nil {
-			if err.Error() == "EOF" {
-				log.Println("Connection closed by remote")
-			} else {
-				log.Println("Failed to decode JSON:", err)
-			}
+	// finish the TLS handshake up front, so agents without a valid
+	// certificate never make it into the connection list
+	if tc, ok := conn.(*tls.Conn); ok {
+		hsCtx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+		err := tc.HandshakeContext(hsCtx)
+		cancel()
+		if err != nil {
+			log.Printf("TLS handshake with %s failed: %v", host, err)
 			return
 		}
+	}
+
+	// with client certificates, the certificate says who the agent is, not its logs
+	cert := agentCert(conn)
+	identity := agentIdentity(cert)
+	warnedHost := false
+	codec := protocol.None
+	version := 0
+
+	// report how well the stream compressed once the agent is gone
+	defer func() {
+		raw, sent := rawBytes.Load(), wireBytes.Load()
+		if codec == protocol.None {
+			raw = sent
+		}
+		log.Printf("Connection from %s closed: %d bytes of logs in %d bytes on the wire (%s, %.1fx)",
+			host, raw, sent, codec, protocol.Ratio(raw, sent))
+	}()
+
+	// decodeErr logs why the stream ended
+	decodeErr := func(err error) {
+		if errors.Is(err, io.EOF) {
+			log.Println("Connection closed by remote")
+		} else if ctx.Err() != nil {
+			log.Println("Closing connection for shutdown")
+		} else {
+			log.Println("Failed to decode JSON:", err)
+		}
+	}
+
+	// trackedConn is this agent's entry in the connection list, added once it has said who it is
+	var trackedConn *structs.Connection
+	hostname := identity
+	hostNameSet := hostname != ""
 
+	var agentID string
+	var lastSaved time.Time
+
+	// track updates the connection info shown in the webui, and saves to the
+	// inventory when the agent was last heard from
+	track := func(logEntry structs.Log) {
 		// Set hostname from the first log if not already set
 		if !hostNameSet {
 			hostname = logEntry.Host
 			hostNameSet = true
+			lastSaved = time.Time{}
+		}
+		if time.Since(lastSaved) >= seenInterval {
+			lastSaved = time.Now()
+			if err := agentdb.Seen(agentDB, agentID, hostname, lastSaved); err != nil {
+				log.Printf("Error updating agent %s: %v", agentID, err)
+			}
 		}
 
-		// Update tracked connection info for webui
-		connList.RLock()
-		trackedConn, ok := connList.Connections[host]
-		connList.RUnlock()
-		if ok {
-			trackedConn.Lock()
-			trackedConn.LastSeen = time.Now()
-			trackedConn.Hostname = hostname
-			trackedConn.Unlock()
+		raw, sent := rawBytes.Load(), wireBytes.Load()
+		if codec == protocol.None {
+			raw = sent
+		}
+		trackedConn.Lock()
+		trackedConn.LastSeen = time.Now()
+		trackedConn.Hostname = hostname
+		trackedConn.Compression = codec
+		trackedConn.RawBytes = raw
+		trackedConn.WireBytes = sent
+		trackedConn.Unlock()
+	}
+
+	// prepare writes a log to the intake file and fills in what old agents leave out
+	prepare := func(logEntry structs.Log) structs.Log {
+		if identity != "" && logEntry.Host != identity {
+			if !warnedHost {
+				log.Printf("Agent %s reports its host as %q, using the certificate's name", identity, logEntry.Host)
+				warnedHost = true
+			}
+			logEntry.Host = identity
 		}
 
 		// Write raw JSON line to intake file
 		// Currently kept in for debugging, may be deprecated in future.
-		if err := filehandler.WriteToFile(filehandler.LOG_INTAKE_DESTINATION, true, true, logEntry); err != nil {
+		if err := firehose.Write(logEntry); err != nil {
 			log.Println("Error writing file uncaught by file handler:", err)
 		}
 
-		logStruct := structs.Log{
+		return structs.Log{
+			ID:        logEntry.ID,
 			Name:      logEntry.Name,
 			Path:      logEntry.Path,
 			Host:      logEntry.Host,
@@ -165,11 +371,333 @@ func handleConnection(conn net.Conn, connList *structs.ConnectionList, db *sql.D
 			Module:    logEntry.Module,
 			Parsed:    logEntry.Parsed,
 			Raw:       logEntry.Raw,
+			Severity:  logEntry.Severity,
+			// agents that predate event times stamped logs when they read them
+			IngestTime: cmp.Or(logEntry.IngestTime, logEntry.Timestamp),
+			RawOnly:    logEntry.RawOnly,
+		}
+	}
+
+	// watch tells the watchdog the agent and its targets are alive
+	watch := func(logEntry structs.Log) {
+		wd.Log(agentID, logEntry.Name)
+		if logEntry.Module != protocol.HeartbeatModule {
+			return
+		}
+		hb, err := decodeHeartbeat(logEntry)
+		if err != nil {
+			log.Printf("Ignoring malformed heartbeat from agent %s: %v", agentID, err)
+			return
+		}
+		if !wd.Heartbeat(agentID, hostname, hb.Seq, time.Unix(logEntry.Timestamp, 0)) {
+			return
+		}
+		if err := agentdb.AddTelemetry(agentDB, agentID, time.Now(), hb); err != nil {
+			log.Printf("Error storing telemetry of agent %s: %v", agentID, err)
+		}
+		if version >= protocol.ProfileVersion {
+			if err := agentdb.SetConfigStatus(agentDB, agentID, hb.ConfigVersion, hb.ConfigError); err != nil {
+				log.Printf("Error recording config of agent %s: %v", agentID, err)
+			}
+		}
+	}
+
+	// src is who the logs and dead letters are from, set once the agent has said
+	var src ingest.Source
+
+	// deadLetter keeps what the agent sent that couldn't be decoded
+	deadLetter := func(err error, payload []byte) {
+		if err := pipe.DeadLetter(src, logdb.DeadDecode, err, payload); err != nil {
+			log.Printf("Error keeping undecodable frame from %s: %v", host, err)
+		}
+	}
+
+	// handleLog queues a log from an agent that doesn't wait for acks.
+	// The pipeline keeps logs that fail to be stored as dead letters.
+	handleLog := func(logEntry structs.Log) {
+		track(logEntry)
+		watch(logEntry)
+		logStruct := prepare(logEntry)
+		if err := pipe.Submit(ctx, src, []structs.Log{logStruct}, nil); err != nil {
+			log.Printf("Dropping log from %s for shutdown: %v", host, err)
+		}
+	}
+
+	// handleFrame decodes and queues a line from an agent that doesn't wait for acks
+	handleFrame := func(frame []byte) {
+		var logEntry structs.Log
+		if err := json.Unmarshal(frame, &logEntry); err != nil {
+			deadLetter(err, frame)
+			return
+		}
+		handleLog(logEntry)
+	}
+
+	// frames reads what follows the first message
+	var frames *bufio.Reader
+
+	// the first message is either a hello or, from an old agent, a log
+	var first json.RawMessage
+	if err := decoder.Decode(&first); err != nil {
+		decodeErr(err)
+		return
+	}
+	var hs protocol.Handshake
+	if err := json.Unmarshal(first, &hs); err != nil || hs.Hello == nil {
+		hs.Hello = nil
+	}
+
+	// agents that predate the hello are known by their address
+	agentID = host
+	if hs.Hello != nil {
+		version, err = protocol.Negotiate(hs.Hello.Version, hs.Hello.MinVersion)
+		if err != nil {
+			log.Printf("Turning away agent %s at %s (version %s): %v", hs.Hello.AgentID, host, hs.Hello.AgentVersion, err)
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			json.NewEncoder(conn).Encode(protocol.Handshake{Welcome: &protocol.Welcome{Error: err.Error()}})
+			return
+		}
+		agentID = cmp.Or(hs.Hello.AgentID, host)
+		if !hostNameSet && hs.Hello.Hostname != "" {
+			hostname = hs.Hello.Hostname
+			hostNameSet = true
+		}
+	}
+
+	// remember the agent across restarts, even if it never sends a log
+	inventory := agentdb.Agent{
+		ID:              agentID,
+		Hostname:        hostname,
+		Identity:        identity,
+		RemoteAddr:      host,
+		ProtocolVersion: version,
+		LastSeen:        time.Now(),
+	}
+	if hs.Hello != nil {
+		inventory.AgentVersion = hs.Hello.AgentVersion
+		inventory.OS = hs.Hello.OS
+		inventory.Kernel = hs.Hello.Kernel
+		inventory.Targets = hs.Hello.Targets
+	}
+	// an ID stays with the certificate it was first seen with, so another
+	// enrolled agent can't take over its inventory, profile or heartbeats
+	if err := agentdb.Connected(agentDB, inventory); errors.Is(err, agentdb.ErrIdentityMismatch) {
+		log.Printf("Turning away agent %s at %s: its ID is on record for another certificate than %q", agentID, host, identity)
+		if hs.Hello != nil {
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			json.NewEncoder(conn).Encode(protocol.Handshake{Welcome: &protocol.Welcome{Error: "agent ID belongs to another certificate"}})
+		}
+		return
+	} else if err != nil {
+		log.Printf("Error recording agent %s: %v", agentID, err)
+	}
+
+	src = ingest.Source{AgentID: agentID, RemoteAddr: host}
+	trackedConn = connList.AddToConnList(agentID, host)
+	trackedConn.Lock()
+	trackedConn.Identity = identity
+	if cert != nil {
+		// lets a revoked agent be cut off straight away
+		trackedConn.Serial = pki.Serial(cert.SerialNumber)
+		trackedConn.SetDisconnect(func() { conn.Close() })
+	}
+	if hs.Hello != nil {
+		trackedConn.Hostname = hostname
+		trackedConn.AgentVersion = hs.Hello.AgentVersion
+		trackedConn.OS = hs.Hello.OS
+		trackedConn.Kernel = hs.Hello.Kernel
+		trackedConn.Targets = hs.Hello.Targets
+		trackedConn.Capabilities = hs.Hello.Capabilities
+	}
+	trackedConn.ProtocolVersion = version
+	trackedConn.Open++
+	trackedConn.Unlock()
+	defer func() {
+		trackedConn.Lock()
+		trackedConn.Open--
+		trackedConn.Unlock()
+	}()
+
+	if version >= protocol.ProfileVersion {
+		if err := agentdb.SetConfigStatus(agentDB, agentID, hs.Hello.ConfigVersion, hs.Hello.ConfigError); err != nil {
+			log.Printf("Error recording config of agent %s: %v", agentID, err)
+		}
+	}
+	var expect map[string]time.Duration
+	if hs.Hello != nil {
+		expect = hs.Hello.Expect
+	}
+	wd.Connected(agentID, hostname, expect)
+	lastSaved = inventory.LastSeen
+
+	if hs.Hello != nil {
+		codec = protocol.Choose(hs.Hello.Compression)
+		welcome := protocol.Handshake{Welcome: &protocol.Welcome{Version: version, Compression: codec}}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := json.NewEncoder(conn).Encode(welcome); err != nil {
+			log.Println("Error sending welcome:", err)
+			return
+		}
+
+		// everything after the hello is compressed, including what the decoder already
+		// buffered, except the newline that ended the hello
+		rest := bufio.NewReader(io.MultiReader(decoder.Buffered(), wire))
+		if err := skipNewlines(rest); err != nil {
+			decodeErr(err)
+			return
+		}
+		zr, err := protocol.NewReader(rest, codec)
+		if err != nil {
+			log.Println("Error starting decompression:", err)
+			return
+		}
+		defer zr.Close()
+		frames = bufio.NewReader(protocol.CountReader(zr, &rawBytes))
+		log.Printf("Agent %s (%s, version %s) at %s speaks protocol v%d, using %s compression",
+			agentID, hostname, hs.Hello.AgentVersion, host, version, codec)
+	} else {
+		log.Printf("Agent at %s predates the handshake, reading uncompressed logs", host)
+		frames = bufio.NewReader(io.MultiReader(decoder.Buffered(), wire))
+		handleFrame(first)
+	}
+
+	// agents send one JSON message per line, so a frame that doesn't decode
+	// can be set aside without losing track of the stream
+	if version < protocol.AckedVersion {
+		for {
+			frame, err := readFrame(frames)
+			if err != nil {
+				decodeErr(err)
+				return
+			}
+			handleFrame(frame)
 		}
+	}
 
-		err = logdb.InsertLog(db, logStruct)
+	// acks go back uncompressed; the agent only drops a batch from its spool once it has one.
+	// From ProfileVersion on, profiles go back the same way, whenever they change.
+	acks := json.NewEncoder(conn)
+	var replyMu sync.Mutex
+	reply := func(msg protocol.Downlink) error {
+		replyMu.Lock()
+		defer replyMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if version < protocol.ProfileVersion {
+			return acks.Encode(msg.Ack)
+		}
+		return acks.Encode(msg)
+	}
+	if version >= protocol.ProfileVersion {
+		detach := dist.Attach(agentID, hs.Hello.ConfigVersion, func(p protocol.Profile) error {
+			return reply(protocol.Downlink{Profile: &p})
+		})
+		defer detach()
+	}
+
+	var lastSeq uint64
+	for {
+		frame, err := readFrame(frames)
 		if err != nil {
-			log.Fatalf("Error inserting log into DB: %v. Log: %+v", err, logStruct)
+			decodeErr(err)
+			return
+		}
+		batch, bad, err := protocol.DecodeBatch(frame)
+		if err != nil {
+			// the agent waits on the batch after the last one, so ack that
+			// one once the frame is kept rather than have it resent forever
+			deadLetter(err, frame)
+			batch = protocol.Batch{Seq: lastSeq + 1}
+		}
+		for _, b := range bad {
+			deadLetter(b.Err, b.Raw)
+		}
+		lastSeq = batch.Seq
+
+		if len(batch.Logs) > 0 {
+			track(batch.Logs[len(batch.Logs)-1])
+		}
+		for _, l := range batch.Logs {
+			watch(l)
+		}
+
+		logs := make([]structs.Log, len(batch.Logs))
+		for i, l := range batch.Logs {
+			logs[i] = prepare(l)
+		}
+		// the agent resends anything we don't ack, so a batch that could
+		// be neither stored nor dead-lettered just ends the connection
+		r, err := pipe.Write(ctx, src, logs)
+		if err != nil {
+			log.Printf("Error inserting batch %d from %s, the agent will resend it: %v", batch.Seq, host, err)
+			return
+		}
+
+		ack := protocol.Ack{Seq: batch.Seq, Stored: r.Stored, Rejected: r.DeadLettered + len(bad)}
+		if err := reply(protocol.Downlink{Ack: &ack}); err != nil {
+			log.Printf("Error acking batch %d from %s: %v", batch.Seq, host, err)
+			return
+		}
+	}
+}
+
+// decodeHeartbeat reads the report in a heartbeat log's parsed field
+func decodeHeartbeat(l structs.Log) (protocol.Heartbeat, error) {
+	var hb protocol.Heartbeat
+	data, err := json.Marshal(l.Parsed)
+	if err != nil {
+		return hb, err
+	}
+	err = json.Unmarshal(data, &hb)
+	return hb, err
+}
+
+// pruneTelemetry deletes heartbeat reports past their retention every hour until ctx is done
+func pruneTelemetry(ctx context.Context, agentDB *sql.DB) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		n, err := agentdb.PruneTelemetry(agentDB, time.Now().Add(-telemetryRetention))
+		if err != nil {
+			log.Printf("Error pruning telemetry: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d heartbeat reports older than %v", n, telemetryRetention)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readFrame reads the next line the agent sent, skipping blank ones.
+// A line cut off by the connection closing is io.ErrUnexpectedEOF.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// skipNewlines discards the line breaks json.Encoder leaves between messages
+func skipNewlines(r *bufio.Reader) error {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] != '\n' && b[0] != '\r' {
+			return nil
 		}
+		r.Discard(1)
 	}
 }
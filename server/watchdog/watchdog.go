@@ -0,0 +1,285 @@
+// Package watchdog notices what agents stop doing: sending heartbeats, or
+// logging from targets that are expected to log regularly. What it notices is
+// written to the events table of the logs DB.
+package watchdog
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/TLop503/LogCrunch/server/db/agents"
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/structs"
+)
+
+// Event kinds
+const (
+	KindOffline   = "agent_offline"
+	KindOnline    = "agent_online"
+	KindRestarted = "agent_restarted"
+	KindSilent    = "target_silent"
+	KindResumed   = "target_resumed"
+)
+
+// Config sets how patient the watchdog is
+type Config struct {
+	HeartbeatInterval time.Duration // how often agents send heartbeats
+	MissedHeartbeats  int           // how many in a row an agent may miss before it is offline
+	CheckEvery        time.Duration
+}
+
+// DefaultConfig matches the agent's one-minute heartbeat
+func DefaultConfig() Config {
+	return Config{
+		HeartbeatInterval: 60 * time.Second,
+		MissedHeartbeats:  3,
+		CheckEvery:        15 * time.Second,
+	}
+}
+
+// agentState is what the watchdog knows about one agent
+type agentState struct {
+	host     string
+	lastBeat time.Time // when the last heartbeat arrived
+	sentAt   time.Time // when the agent sent it
+	seq      int64
+	hasSeq   bool
+	offline  bool
+
+	expect  map[string]time.Duration // expected interval per target
+	lastLog map[string]time.Time
+	silent  map[string]bool
+}
+
+// Watchdog tracks heartbeats and target activity for every agent
+type Watchdog struct {
+	mu      sync.Mutex
+	cfg     Config
+	logDB   *sql.DB
+	agentDB *sql.DB
+	agents  map[string]*agentState
+	now     func() time.Time
+}
+
+// New creates a watchdog that writes events to logDB and agent status to agentDB
+func New(logDB, agentDB *sql.DB, cfg Config) *Watchdog {
+	return &Watchdog{
+		cfg:     cfg,
+		logDB:   logDB,
+		agentDB: agentDB,
+		agents:  make(map[string]*agentState),
+		now:     time.Now,
+	}
+}
+
+// Load picks up the agents in the inventory. They get a full grace period
+// from now, since the server being down is no reason to call them offline,
+// and ones already offline stay that way without a second event.
+func (w *Watchdog) Load() error {
+	list, err := agents.List(w.agentDB)
+	if err != nil {
+		return fmt.Errorf("failed to load agents: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	for _, a := range list {
+		st := w.state(a.ID, cmp.Or(a.Hostname, a.ID))
+		st.lastBeat = now
+		st.sentAt = a.HeartbeatAt
+		st.seq, st.hasSeq = a.HeartbeatSeq, !a.HeartbeatAt.IsZero()
+		st.offline = a.Offline
+	}
+	return nil
+}
+
+// state returns the agent's state, creating it if needed. Caller must hold w.mu.
+func (w *Watchdog) state(id, host string) *agentState {
+	st, ok := w.agents[id]
+	if !ok {
+		st = &agentState{
+			lastBeat: w.now(),
+			expect:   make(map[string]time.Duration),
+			lastLog:  make(map[string]time.Time),
+			silent:   make(map[string]bool),
+		}
+		w.agents[id] = st
+	}
+	if host != "" {
+		st.host = host
+	}
+	return st
+}
+
+// Connected starts watching an agent's targets with the intervals it
+// announced. Targets it no longer announces are forgotten.
+func (w *Watchdog) Connected(id, host string, expect map[string]time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	st := w.state(id, host)
+	now := w.now()
+	for name := range st.expect {
+		if _, ok := expect[name]; !ok {
+			delete(st.lastLog, name)
+			delete(st.silent, name)
+		}
+	}
+	st.expect = make(map[string]time.Duration, len(expect))
+	for name, every := range expect {
+		st.expect[name] = every
+		if _, ok := st.lastLog[name]; !ok {
+			st.lastLog[name] = now
+		}
+	}
+}
+
+// Heartbeat records a heartbeat the agent sent at sentAt, and reports whether
+// it was new. A sequence number lower than the last one means the agent
+// restarted. Heartbeats already seen, or older than the last one, are resends
+// and are ignored.
+func (w *Watchdog) Heartbeat(id, host string, seq int64, sentAt time.Time) bool {
+	w.mu.Lock()
+	st := w.state(id, host)
+	if sentAt.Before(st.sentAt) || (st.hasSeq && seq == st.seq && sentAt.Equal(st.sentAt)) {
+		w.mu.Unlock()
+		return false
+	}
+
+	var events []logdb.Event
+	now := w.now()
+	if st.hasSeq && seq < st.seq {
+		events = append(events, w.event(id, st, KindRestarted, "", structs.SeverityNotice,
+			fmt.Sprintf("Agent restarted: heartbeat sequence went from %d to %d", st.seq, seq)))
+	}
+	wasOffline := st.offline
+	if st.offline {
+		st.offline = false
+		events = append(events, w.event(id, st, KindOnline, "", structs.SeverityNotice,
+			fmt.Sprintf("Agent is back after %s without heartbeats", now.Sub(st.lastBeat).Round(time.Second))))
+	}
+	st.seq, st.hasSeq = seq, true
+	st.lastBeat, st.sentAt = now, sentAt
+	w.mu.Unlock()
+
+	if err := agents.Heartbeat(w.agentDB, id, seq, now); err != nil {
+		log.Printf("Error recording heartbeat of agent %s: %v", id, err)
+	}
+	if wasOffline {
+		if err := agents.SetOffline(w.agentDB, id, false); err != nil {
+			log.Printf("Error updating status of agent %s: %v", id, err)
+		}
+	}
+	w.record(events)
+	return true
+}
+
+// Log records that one of the agent's targets produced a log
+func (w *Watchdog) Log(id, target string) {
+	w.mu.Lock()
+	st, ok := w.agents[id]
+	if !ok {
+		w.mu.Unlock()
+		return
+	}
+	if _, watched := st.expect[target]; !watched {
+		w.mu.Unlock()
+		return
+	}
+
+	var events []logdb.Event
+	now := w.now()
+	if st.silent[target] {
+		st.silent[target] = false
+		events = append(events, w.event(id, st, KindResumed, target, structs.SeverityInfo,
+			fmt.Sprintf("Target %s is logging again after %s", target, now.Sub(st.lastLog[target]).Round(time.Second))))
+	}
+	st.lastLog[target] = now
+	w.mu.Unlock()
+
+	w.record(events)
+}
+
+// Run checks on every agent until ctx is done
+func (w *Watchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.CheckEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check raises events for agents that stopped sending heartbeats and targets
+// that stopped logging. Targets of offline agents aren't flagged on top.
+func (w *Watchdog) check() {
+	w.mu.Lock()
+	now := w.now()
+	limit := time.Duration(w.cfg.MissedHeartbeats) * w.cfg.HeartbeatInterval
+
+	var events []logdb.Event
+	var offline []string
+	for id, st := range w.agents {
+		if st.offline {
+			continue
+		}
+		if quiet := now.Sub(st.lastBeat); quiet > limit {
+			st.offline = true
+			offline = append(offline, id)
+			events = append(events, w.event(id, st, KindOffline, "", structs.SeverityWarning,
+				fmt.Sprintf("No heartbeat for %s (%d missed)", quiet.Round(time.Second), int(quiet/w.cfg.HeartbeatInterval))))
+			continue
+		}
+		for target, every := range st.expect {
+			if st.silent[target] {
+				continue
+			}
+			if quiet := now.Sub(st.lastLog[target]); quiet > every {
+				st.silent[target] = true
+				events = append(events, w.event(id, st, KindSilent, target, structs.SeverityWarning,
+					fmt.Sprintf("Target %s has not logged for %s (expected every %s)", target, quiet.Round(time.Second), every)))
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for _, id := range offline {
+		if err := agents.SetOffline(w.agentDB, id, true); err != nil {
+			log.Printf("Error updating status of agent %s: %v", id, err)
+		}
+	}
+	w.record(events)
+}
+
+// event builds an event about an agent. Caller must hold w.mu.
+func (w *Watchdog) event(id string, st *agentState, kind, target string, severity structs.Severity, message string) logdb.Event {
+	return logdb.Event{
+		Time:     w.now(),
+		AgentID:  id,
+		Host:     st.host,
+		Kind:     kind,
+		Target:   target,
+		Message:  message,
+		Severity: severity,
+	}
+}
+
+// record logs events and stores them
+func (w *Watchdog) record(events []logdb.Event) {
+	for _, e := range events {
+		log.Printf("Agent %s (%s): %s", e.AgentID, e.Host, e.Message)
+		if err := logdb.InsertEvent(w.logDB, e); err != nil {
+			log.Printf("Error storing event: %v", err)
+		}
+	}
+}
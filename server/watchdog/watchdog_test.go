@@ -0,0 +1,161 @@
+package watchdog
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TLop503/LogCrunch/server/db/agents"
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+)
+
+// newTestWatchdog returns a watchdog on fresh DBs whose clock is *now
+func newTestWatchdog(t *testing.T, now *time.Time) *Watchdog {
+	t.Helper()
+	dir := t.TempDir()
+	logDB, _, err := logdb.InitLogDB(filepath.Join(dir, "logs.sqlite"))
+	if err != nil {
+		t.Fatalf("InitLogDB failed: %v", err)
+	}
+	agentDB, err := agents.InitAgentDB(filepath.Join(dir, "agents.sqlite"))
+	if err != nil {
+		t.Fatalf("InitAgentDB failed: %v", err)
+	}
+	t.Cleanup(func() {
+		logDB.Close()
+		agentDB.Close()
+	})
+
+	err = agents.Connected(agentDB, agents.Agent{ID: "abc", Hostname: "web01", RemoteAddr: "10.0.0.5", LastSeen: *now})
+	if err != nil {
+		t.Fatalf("Connected failed: %v", err)
+	}
+
+	w := New(logDB, agentDB, Config{HeartbeatInterval: time.Minute, MissedHeartbeats: 3, CheckEvery: time.Second})
+	w.now = func() time.Time { return *now }
+	return w
+}
+
+// kinds lists the kinds of the stored events, oldest first
+func kinds(t *testing.T, w *Watchdog) []string {
+	t.Helper()
+	events, err := logdb.RecentEvents(w.logDB, "abc", 100)
+	if err != nil {
+		t.Fatalf("RecentEvents failed: %v", err)
+	}
+	var out []string
+	for i := len(events) - 1; i >= 0; i-- {
+		out = append(out, events[i].Kind)
+	}
+	return out
+}
+
+func TestWatchdogMarksAgentsOffline(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	w := newTestWatchdog(t, &now)
+	w.Connected("abc", "web01", nil)
+	w.Heartbeat("abc", "web01", 0, now)
+
+	now = now.Add(2 * time.Minute)
+	w.check()
+	if got := kinds(t, w); len(got) != 0 {
+		t.Fatalf("Expected no events after 2 missed heartbeats, got %v", got)
+	}
+
+	now = now.Add(2 * time.Minute)
+	w.check()
+	w.check() // only reported once
+	if got := kinds(t, w); len(got) != 1 || got[0] != KindOffline {
+		t.Fatalf("Expected one offline event, got %v", got)
+	}
+	if a, _ := agents.Get(w.agentDB, "abc"); !a.Offline {
+		t.Error("Expected the agent to be marked offline in the inventory")
+	}
+
+	now = now.Add(time.Minute)
+	w.Heartbeat("abc", "web01", 1, now)
+	if got := kinds(t, w); len(got) != 2 || got[1] != KindOnline {
+		t.Fatalf("Expected the agent to come back online, got %v", got)
+	}
+	if a, _ := agents.Get(w.agentDB, "abc"); a.Offline || a.HeartbeatSeq != 1 {
+		t.Errorf("Expected the agent online at heartbeat 1, got %+v", a)
+	}
+}
+
+func TestWatchdogDetectsRestarts(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	w := newTestWatchdog(t, &now)
+	for seq := int64(0); seq < 3; seq++ {
+		w.Heartbeat("abc", "web01", seq, now)
+		now = now.Add(time.Minute)
+	}
+
+	// a resent batch carries an old heartbeat, which isn't a restart
+	if w.Heartbeat("abc", "web01", 1, now.Add(-2*time.Minute)) {
+		t.Error("Expected an old heartbeat to be reported as a resend")
+	}
+	if w.Heartbeat("abc", "web01", 2, now.Add(-time.Minute)) {
+		t.Error("Expected the last heartbeat sent again to be reported as a resend")
+	}
+	if got := kinds(t, w); len(got) != 0 {
+		t.Fatalf("Expected a resent heartbeat to be ignored, got %v", got)
+	}
+
+	w.Heartbeat("abc", "web01", 0, now)
+	if got := kinds(t, w); len(got) != 1 || got[0] != KindRestarted {
+		t.Fatalf("Expected a restart event, got %v", got)
+	}
+}
+
+func TestWatchdogFlagsSilentTargets(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	w := newTestWatchdog(t, &now)
+	w.Connected("abc", "web01", map[string]time.Duration{"auth": 5 * time.Minute})
+
+	keepAlive := func(d time.Duration) {
+		for end := now.Add(d); now.Before(end); now = now.Add(time.Minute) {
+			w.Heartbeat("abc", "web01", 0, now)
+		}
+	}
+	keepAlive(4 * time.Minute)
+	w.Log("abc", "auth")
+	w.Log("abc", "nginx") // not watched
+	keepAlive(4 * time.Minute)
+	w.check()
+	if got := kinds(t, w); len(got) != 0 {
+		t.Fatalf("Expected no events while auth logs often enough, got %v", got)
+	}
+
+	keepAlive(2 * time.Minute)
+	w.check()
+	w.check()
+	if got := kinds(t, w); len(got) != 1 || got[0] != KindSilent {
+		t.Fatalf("Expected one silent target event, got %v", got)
+	}
+
+	w.Log("abc", "auth")
+	if got := kinds(t, w); len(got) != 2 || got[1] != KindResumed {
+		t.Fatalf("Expected the target to resume, got %v", got)
+	}
+	events, _ := logdb.RecentEvents(w.logDB, "", 1)
+	if events[0].Target != "auth" || events[0].Host != "web01" {
+		t.Errorf("Unexpected event: %+v", events[0])
+	}
+}
+
+func TestLoadKeepsOfflineAgentsQuiet(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	w := newTestWatchdog(t, &now)
+	if err := agents.SetOffline(w.agentDB, "abc", true); err != nil {
+		t.Fatalf("SetOffline failed: %v", err)
+	}
+	if err := w.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	now = now.Add(time.Hour)
+	w.check()
+	if got := kinds(t, w); len(got) != 0 {
+		t.Fatalf("Expected no second offline event after a restart, got %v", got)
+	}
+}
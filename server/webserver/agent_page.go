@@ -0,0 +1,103 @@
+package webserver
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TLop503/LogCrunch/server/db/agents"
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/structs"
+	"github.com/go-chi/chi/v5"
+)
+
+// telemetryWindow is how much heartbeat history the agent page shows
+const telemetryWindow = time.Hour
+
+// serveAgentPage shows one agent's details, its latest telemetry with
+// per-target counters, and its recent heartbeats and events
+func serveAgentPage(connList *structs.ConnectionList, agentDB *sql.DB, logDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		agent, err := agents.Get(agentDB, id)
+		if errors.Is(err, agents.ErrNotFound) {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error looking up agent %s: %v", id, err)
+			http.Error(w, "Failed to look up agent", http.StatusInternalServerError)
+			return
+		}
+
+		data := AgentPageData{Agent: agent, Window: telemetryWindow}
+		connList.RLock()
+		if conn, ok := connList.Connections[id]; ok {
+			conn.Lock()
+			data.Online = conn.Open > 0
+			conn.Unlock()
+		}
+		connList.RUnlock()
+
+		if data.History, err = agents.ListTelemetry(agentDB, id, time.Now().Add(-telemetryWindow)); err != nil {
+			log.Printf("Error listing telemetry of agent %s: %v", id, err)
+			http.Error(w, "Failed to list telemetry", http.StatusInternalServerError)
+			return
+		}
+		if len(data.History) > 0 {
+			data.Latest = &data.History[0]
+			data.Targets = targetRows(data.History)
+		}
+
+		profile, via, ok, err := agents.ProfileFor(agentDB, agent)
+		if err != nil {
+			log.Printf("Error looking up profile of agent %s: %v", id, err)
+			http.Error(w, "Failed to look up profile", http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			data.Profile, data.Via = &profile, via
+		}
+
+		if data.Events, err = logdb.RecentEvents(logDB, id, recentEvents); err != nil {
+			log.Printf("Error listing events of agent %s: %v", id, err)
+			http.Error(w, "Failed to list events", http.StatusInternalServerError)
+			return
+		}
+
+		if err := templates.ExecuteTemplate(w, "agent", data); err != nil {
+			log.Printf("template error: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+	}
+}
+
+// targetRows turns the latest heartbeat's counters into rows, with how many
+// lines each target read and failed to parse over the history.
+// history is newest first.
+func targetRows(history []agents.Telemetry) []TargetRow {
+	latest, oldest := history[0], history[len(history)-1]
+	// counters start over when the agent restarts
+	restarted := slices.ContainsFunc(history[:len(history)-1], func(t agents.Telemetry) bool {
+		return t.Uptime < oldest.Uptime
+	})
+
+	var rows []TargetRow
+	for name, stats := range latest.Targets {
+		row := TargetRow{Name: name, TargetStats: stats, RecentRead: stats.Read, RecentFailed: stats.Failed}
+		if before, ok := oldest.Targets[name]; ok && !restarted && len(history) > 1 {
+			row.RecentRead -= before.Read
+			row.RecentFailed -= before.Failed
+		}
+		if stats.LastErrorTime != 0 {
+			row.LastErrorAt = time.Unix(stats.LastErrorTime, 0)
+		}
+		rows = append(rows, row)
+	}
+	slices.SortFunc(rows, func(a, b TargetRow) int { return strings.Compare(a.Name, b.Name) })
+	return rows
+}
@@ -1,55 +1,51 @@
 package webserver
 
 import (
-	"github.com/TLop503/LogCrunch/structs"
+	"database/sql"
+	"errors"
 	"html/template"
+	"log"
 	"net/http"
+
+	"github.com/TLop503/LogCrunch/server/db/agents"
+	"github.com/TLop503/LogCrunch/server/profiles"
 )
 
-// handleAliasEditForm renders a form to edit the alias for a given connection.
-// expects a GET request with the `ip` parameter in the query string.
+// handleAliasEditForm renders a form to edit the alias for a given agent.
+// expects a GET request with the agent's `id` parameter in the query string.
 // form is rendered using the "alias-edit" template.
-func handleAliasEditForm(connList *structs.ConnectionList, tmpl *template.Template) http.HandlerFunc {
+func handleAliasEditForm(agentDB *sql.DB, tmpl *template.Template) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// get ip addr from query (request)
-		ip := r.URL.Query().Get("ip")
-		if ip == "" {
-			http.Error(w, "Missing IP parameter", http.StatusBadRequest)
+		// get agent id from query (request)
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Missing id parameter", http.StatusBadRequest)
 			return
 		}
 
-		// lookup the connection by IP
-		connList.RLock()
-		conn, ok := connList.Connections[ip]
-		connList.RUnlock()
-
-		if !ok {
-			http.Error(w, "Connection not found", http.StatusNotFound)
+		// lookup the agent in the inventory
+		agent, err := agents.Get(agentDB, id)
+		if errors.Is(err, agents.ErrNotFound) {
+			http.Error(w, "Agent not found", http.StatusNotFound)
 			return
 		}
-
-		// safely extract the alias and remote address under lock
-		conn.Lock()
-		data := struct {
-			RemoteAddr string
-			Alias      string
-		}{
-			RemoteAddr: conn.RemoteAddr,
-			Alias:      conn.Alias,
+		if err != nil {
+			log.Printf("Error looking up agent %s: %v", id, err)
+			http.Error(w, "Failed to look up agent", http.StatusInternalServerError)
+			return
 		}
-		conn.Unlock()
 
-		// render the alias-edit template with the extracted connection info
-		err := tmpl.ExecuteTemplate(w, "alias-edit", data)
+		// render the alias-edit template with the agent's details
+		err = tmpl.ExecuteTemplate(w, "alias-edit", agent)
 		if err != nil {
 			http.Error(w, "Template rendering error: "+err.Error(), http.StatusInternalServerError)
 		}
 	}
 }
 
-// handleAliasSet processes the submitted alias form and updates the in-memory connection alias.
-// expects a POST request with `ip` and `alias` fields.
-func handleAliasSet(connList *structs.ConnectionList) http.HandlerFunc {
+// handleAliasSet processes the submitted alias form and saves the agent's alias.
+// expects a POST request with `id` and `alias` fields.
+func handleAliasSet(agentDB *sql.DB, dist *profiles.Distributor) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// only allow POST method
 		if r.Method != http.MethodPost {
@@ -58,7 +54,7 @@ func handleAliasSet(connList *structs.ConnectionList) http.HandlerFunc {
 		}
 
 		// extract form values
-		ip := r.FormValue("ip")
+		id := r.FormValue("id")
 		alias := r.FormValue("alias")
 
 		// validate alias length (max 32 characters)
@@ -67,20 +63,19 @@ func handleAliasSet(connList *structs.ConnectionList) http.HandlerFunc {
 			return
 		}
 
-		// lookup the connection by IP
-		connList.RLock()
-		conn, ok := connList.Connections[ip]
-		connList.RUnlock()
-
-		if !ok {
-			http.Error(w, "Connection not found", http.StatusNotFound)
+		// save the alias, so it outlives server restarts
+		err := agents.SetAlias(agentDB, id, alias)
+		if errors.Is(err, agents.ErrNotFound) {
+			http.Error(w, "Agent not found", http.StatusNotFound)
 			return
 		}
-
-		// safely update the alias
-		conn.Lock()
-		conn.Alias = alias
-		conn.Unlock()
+		if err != nil {
+			log.Printf("Error setting alias of agent %s: %v", id, err)
+			http.Error(w, "Failed to save alias", http.StatusInternalServerError)
+			return
+		}
+		// profiles may be assigned by alias
+		go dist.Refresh()
 
 		// re-dir back to the connection list after saving
 		http.Redirect(w, r, "/connections", http.StatusSeeOther)
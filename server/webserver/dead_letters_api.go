@@ -0,0 +1,80 @@
+package webserver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/server/ingest"
+	"github.com/go-chi/chi/v5"
+)
+
+// deadLettersShown is how many dead letters the page lists
+const deadLettersShown = 200
+
+// serveDeadLettersPage lists what agents sent that couldn't be stored
+func serveDeadLettersPage(logDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderDeadLettersPage(w, logDB, "")
+	}
+}
+
+// handleDeadLetterAction re-ingests or discards a dead letter
+func handleDeadLetterAction(logDB *sql.DB, pipe *ingest.Pipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid dead letter id", http.StatusBadRequest)
+			return
+		}
+
+		var notice string
+		switch chi.URLParam(r, "action") {
+		case "reingest":
+			res, err := pipe.Reingest(r.Context(), id)
+			if err != nil {
+				notice = fmt.Sprintf("Dead letter %d was not re-ingested: %v", id, err)
+				break
+			}
+			notice = fmt.Sprintf("Re-ingested dead letter %d: %d logs stored", id, res.Stored)
+			if res.DeadLettered > 0 {
+				notice += fmt.Sprintf(", %d failed again and are listed as new dead letters", res.DeadLettered)
+			}
+		case "discard":
+			if err := pipe.Discard(id); errors.Is(err, logdb.ErrDeadLetterNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				log.Printf("Error discarding dead letter %d: %v", id, err)
+				http.Error(w, "Failed to discard dead letter", http.StatusInternalServerError)
+				return
+			}
+			notice = fmt.Sprintf("Discarded dead letter %d", id)
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		log.Println(notice)
+		renderDeadLettersPage(w, logDB, notice)
+	}
+}
+
+// renderDeadLettersPage renders the dead letters page, with notice saying what was just done
+func renderDeadLettersPage(w http.ResponseWriter, logDB *sql.DB, notice string) {
+	letters, total, err := logdb.ListDeadLetters(logDB, deadLettersShown)
+	if err != nil {
+		log.Printf("Error listing dead letters: %v", err)
+		http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	data := DeadLettersPageData{Letters: letters, Total: total, Notice: notice}
+	if err := templates.ExecuteTemplate(w, "dead-letters", data); err != nil {
+		log.Printf("template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,187 @@
+package webserver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/server/db/enroll"
+	"github.com/TLop503/LogCrunch/server/pki"
+	"github.com/TLop503/LogCrunch/structs"
+	"github.com/go-chi/chi/v5"
+)
+
+// agent names end up as certificate names and in queries, so keep them plain
+var agentNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// tokenTTLs are the lifetimes offered when creating an enrollment token
+var tokenTTLs = []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// handleEnroll signs an agent's certificate request in exchange for a one-time token.
+// It is public, since the agent has no credentials yet besides the token.
+func handleEnroll(enrollDB *sql.DB, ca *pki.CA) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reply := func(status int, resp protocol.EnrollResponse) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(resp)
+		}
+		if ca == nil {
+			reply(http.StatusServiceUnavailable, protocol.EnrollResponse{Error: "enrollment is not enabled on this server"})
+			return
+		}
+
+		var req protocol.EnrollRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			reply(http.StatusBadRequest, protocol.EnrollResponse{Error: "invalid request body"})
+			return
+		}
+		if !agentNamePattern.MatchString(req.Name) {
+			reply(http.StatusBadRequest, protocol.EnrollResponse{Error: "invalid agent name"})
+			return
+		}
+		if block, _ := pem.Decode([]byte(req.CSR)); block == nil {
+			reply(http.StatusBadRequest, protocol.EnrollResponse{Error: "invalid certificate request"})
+			return
+		}
+
+		// burn the token before signing, so it can't be raced into two certificates
+		if err := enroll.RedeemToken(enrollDB, req.Token); err != nil {
+			if !errors.Is(err, enroll.ErrInvalidToken) {
+				log.Printf("Error redeeming enrollment token: %v", err)
+			}
+			reply(http.StatusForbidden, protocol.EnrollResponse{Error: enroll.ErrInvalidToken.Error()})
+			return
+		}
+
+		signed, err := ca.SignCSR([]byte(req.CSR), req.Name)
+		if err != nil {
+			reply(http.StatusBadRequest, protocol.EnrollResponse{Error: err.Error()})
+			return
+		}
+
+		remote, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remote = r.RemoteAddr
+		}
+		err = enroll.AddEnrollment(enrollDB, enroll.Enrollment{
+			Name:        req.Name,
+			Serial:      signed.Serial,
+			Fingerprint: signed.Fingerprint,
+			RemoteAddr:  remote,
+			EnrolledAt:  time.Now(),
+			ExpiresAt:   signed.NotAfter,
+		})
+		if err != nil {
+			log.Printf("Error recording enrollment: %v", err)
+			reply(http.StatusInternalServerError, protocol.EnrollResponse{Error: "failed to record enrollment"})
+			return
+		}
+
+		log.Printf("Agent %s enrolled from %s, awaiting approval", req.Name, remote)
+		reply(http.StatusOK, protocol.EnrollResponse{
+			Certificate: string(signed.CertPEM),
+			CA:          string(ca.CertPEM()),
+		})
+	}
+}
+
+// serveEnrollmentPage lists enrolled agents and open tokens
+func serveEnrollmentPage(enrollDB *sql.DB, ca *pki.CA) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderEnrollmentPage(w, enrollDB, ca, "")
+	}
+}
+
+// handleTokenCreate mints an enrollment token and shows it once
+func handleTokenCreate(enrollDB *sql.DB, ca *pki.CA) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ca == nil {
+			http.Error(w, "Enrollment is not enabled on this server", http.StatusServiceUnavailable)
+			return
+		}
+		ttl, err := time.ParseDuration(r.FormValue("ttl"))
+		if err != nil || !slices.Contains(tokenTTLs, ttl) {
+			http.Error(w, "Invalid token lifetime", http.StatusBadRequest)
+			return
+		}
+		note := r.FormValue("note")
+		if len(note) > 64 {
+			http.Error(w, "Note too long (max 64 chars)", http.StatusBadRequest)
+			return
+		}
+
+		token, err := enroll.CreateToken(enrollDB, note, ttl)
+		if err != nil {
+			log.Printf("Error creating enrollment token: %v", err)
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			return
+		}
+		renderEnrollmentPage(w, enrollDB, ca, token)
+	}
+}
+
+// handleEnrollmentStatus approves or revokes an enrolled agent.
+// Revoking also drops the agent's open connection.
+func handleEnrollmentStatus(enrollDB *sql.DB, connList *structs.ConnectionList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid enrollment id", http.StatusBadRequest)
+			return
+		}
+		var status string
+		switch chi.URLParam(r, "action") {
+		case "approve":
+			status = enroll.StatusApproved
+		case "revoke":
+			status = enroll.StatusRevoked
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+
+		serial, err := enroll.SetStatus(enrollDB, id, status)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if status == enroll.StatusRevoked {
+			n := connList.DisconnectSerial(serial)
+			log.Printf("Revoked enrollment %d, closed %d connection(s)", id, n)
+		}
+		http.Redirect(w, r, "/enrollment", http.StatusSeeOther)
+	}
+}
+
+// renderEnrollmentPage renders the enrollment page, showing newToken if one was just created
+func renderEnrollmentPage(w http.ResponseWriter, enrollDB *sql.DB, ca *pki.CA, newToken string) {
+	data := EnrollmentPageData{Enabled: ca != nil, NewToken: newToken, TTLs: tokenTTLs}
+	if ca != nil {
+		data.CAFingerprint = ca.Fingerprint()
+	}
+
+	var err error
+	if data.Enrollments, err = enroll.ListEnrollments(enrollDB); err != nil {
+		http.Error(w, "Failed to list enrollments", http.StatusInternalServerError)
+		return
+	}
+	if data.Tokens, err = enroll.OpenTokens(enrollDB); err != nil {
+		http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+		return
+	}
+
+	if err := templates.ExecuteTemplate(w, "enrollment", data); err != nil {
+		log.Printf("template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
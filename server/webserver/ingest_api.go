@@ -0,0 +1,14 @@
+package webserver
+
+import (
+	"net/http"
+
+	"github.com/TLop503/LogCrunch/server/ingest"
+)
+
+// handleIngestStats reports the ingestion pipeline's throughput, latency and queue depth as JSON
+func handleIngestStats(pipe *ingest.Pipeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pipe.Stats())
+	}
+}
@@ -0,0 +1,116 @@
+package webserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/server/parser"
+	"github.com/go-chi/chi/v5"
+)
+
+// serveModulesPage lists the parser modules and how their last re-parse went
+func serveModulesPage(logDB *sql.DB, logParser *parser.Parser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderModulesPage(w, logDB, logParser, "")
+	}
+}
+
+// handleModuleEditForm renders a form to edit the module named in the query
+// string, or to add one if no name is given
+func handleModuleEditForm(logDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := ModuleEditData{New: true, Module: logdb.DBModule{Schema: "{}"}}
+		if name := r.URL.Query().Get("name"); name != "" {
+			m, err := logdb.GetModule(logDB, name)
+			if errors.Is(err, logdb.ErrModuleNotFound) {
+				http.Error(w, "Module not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Error looking up module %s: %v", name, err)
+				http.Error(w, "Failed to look up module", http.StatusInternalServerError)
+				return
+			}
+			data = ModuleEditData{Module: m}
+		}
+		renderModuleEditForm(w, data)
+	}
+}
+
+// handleModuleSave validates and saves a submitted module. Invalid modules
+// are shown again with what is wrong.
+func handleModuleSave(logDB *sql.DB, logParser *parser.Parser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := logdb.DBModule{
+			Name:   strings.TrimSpace(r.FormValue("name")),
+			Regex:  r.FormValue("regex"),
+			Schema: strings.TrimSpace(r.FormValue("schema")),
+		}
+		if m.Schema == "" {
+			m.Schema = "{}"
+		}
+
+		if err := logParser.Update(m); err != nil {
+			log.Printf("Error saving module %s: %v", m.Name, err)
+			w.WriteHeader(http.StatusBadRequest)
+			renderModuleEditForm(w, ModuleEditData{Module: m, New: r.FormValue("new") != "", Error: err.Error()})
+			return
+		}
+		notice := fmt.Sprintf("Saved module %s. New logs are parsed with it; re-parse to update stored ones.", m.Name)
+		log.Println(notice)
+		renderModulesPage(w, logDB, logParser, notice)
+	}
+}
+
+// handleModuleReparse starts parsing a module's stored logs again in the
+// background. Its progress shows on the modules page.
+func handleModuleReparse(logDB *sql.DB, logParser *parser.Parser) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		notice := fmt.Sprintf("Re-parsing the stored logs of module %s", name)
+		// outlives the request, so it gets its own context
+		if err := logParser.StartReparse(context.Background(), name); err != nil {
+			notice = fmt.Sprintf("Module %s was not re-parsed: %v", name, err)
+		}
+		log.Println(notice)
+		renderModulesPage(w, logDB, logParser, notice)
+	}
+}
+
+// renderModulesPage renders the modules page, with notice saying what was just done
+func renderModulesPage(w http.ResponseWriter, logDB *sql.DB, logParser *parser.Parser, notice string) {
+	modules, err := logdb.ListModules(logDB)
+	if err != nil {
+		log.Printf("Error listing modules: %v", err)
+		http.Error(w, "Failed to list modules", http.StatusInternalServerError)
+		return
+	}
+
+	progress := logParser.Progress()
+	data := ModulesPageData{Notice: notice}
+	for _, m := range modules {
+		row := ModuleRow{DBModule: m}
+		if p, ok := progress[m.Name]; ok {
+			row.Reparse = &p
+		}
+		data.Modules = append(data.Modules, row)
+	}
+	if err := templates.ExecuteTemplate(w, "modules", data); err != nil {
+		log.Printf("template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// renderModuleEditForm renders the module edit form
+func renderModuleEditForm(w http.ResponseWriter, data ModuleEditData) {
+	if err := templates.ExecuteTemplate(w, "module-edit", data); err != nil {
+		log.Printf("template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/TLop503/LogCrunch/server/db/agents"
 	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/server/ingest"
 	"github.com/TLop503/LogCrunch/structs"
 )
 
@@ -20,18 +22,46 @@ func servePage(templateName string, data any) http.HandlerFunc {
 	}
 }
 
-// serveConnectionsPage safely reads the connections list and serves the connections page
-func serveConnectionsPage(connList *structs.ConnectionList) http.HandlerFunc {
+// recentEvents is how many watchdog events the connections page shows
+const recentEvents = 50
+
+// serveConnectionsPage lists every agent in the inventory, including offline ones,
+// alongside the live stats of those currently connected, recent watchdog events,
+// and the ingestion pipeline's load
+func serveConnectionsPage(connList *structs.ConnectionList, agentDB *sql.DB, logDB *sql.DB, pipe *ingest.Pipeline) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := agents.List(agentDB)
+		if err != nil {
+			log.Printf("Error listing agents: %v", err)
+			http.Error(w, "Failed to list agents", http.StatusInternalServerError)
+			return
+		}
+
+		rows := make([]AgentRow, len(list))
 		// Safely read from the connections list
 		connList.RLock()
-		connections := make([]*structs.Connection, 0, len(connList.Connections))
-		for _, conn := range connList.Connections {
-			connections = append(connections, conn)
+		for i, agent := range list {
+			rows[i].Agent = agent
+			conn, ok := connList.Connections[agent.ID]
+			if !ok {
+				continue
+			}
+			conn.Lock()
+			rows[i].Online = conn.Open > 0
+			rows[i].Compression = conn.Compression
+			rows[i].CompressionRatio = conn.CompressionRatio()
+			conn.Unlock()
 		}
 		connList.RUnlock()
 
-		err := templates.ExecuteTemplate(w, "connections", connections)
+		events, err := logdb.RecentEvents(logDB, "", recentEvents)
+		if err != nil {
+			log.Printf("Error listing events: %v", err)
+			http.Error(w, "Failed to list events", http.StatusInternalServerError)
+			return
+		}
+
+		err = templates.ExecuteTemplate(w, "connections", ConnectionsPageData{Agents: rows, Events: events, Ingest: pipe.Stats()})
 		if err != nil {
 			log.Printf("template error: %v", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -39,17 +69,29 @@ func serveConnectionsPage(connList *structs.ConnectionList) http.HandlerFunc {
 	}
 }
 
+// serveQueryPage shows the newest logs, or the results of a user-provided query,
+// optionally limited to logs at or above a severity
 func serveQueryPage(dbase *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var (
-			data []structs.Log
-			err  error
-		)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad form data", http.StatusBadRequest)
+			return
+		}
+		minSeverity, err := structs.ParseSeverity(r.FormValue("severity"))
+		if err != nil {
+			http.Error(w, "Unknown severity", http.StatusBadRequest)
+			return
+		}
+
+		data := QueryPageData{
+			MinSeverity: minSeverity,
+			Severities:  structs.Severities,
+		}
 
 		switch r.Method {
 		case http.MethodGet:
 			// last 50 by default!
-			data, err = logdb.MostRecent50(dbase)
+			data.Logs, err = logdb.RecentLogs(dbase, minSeverity, 50)
 			if err != nil {
 				http.Error(w, "Failed to fetch logs", http.StatusInternalServerError)
 				return
@@ -57,16 +99,17 @@ func serveQueryPage(dbase *sql.DB) http.HandlerFunc {
 
 		case http.MethodPost:
 			// run the user-provided query
-			if err := r.ParseForm(); err != nil {
-				http.Error(w, "Bad form data", http.StatusBadRequest)
-				return
-			}
-			query := r.FormValue("query")
-			data, err = logdb.RunQuery(dbase, query)
+			data.Query = r.FormValue("query")
+			results, err := logdb.RunQuery(dbase, data.Query)
 			if err != nil {
 				http.Error(w, "Query failed", http.StatusInternalServerError)
 				return
 			}
+			for _, l := range results {
+				if l.Severity >= minSeverity {
+					data.Logs = append(data.Logs, l)
+				}
+			}
 
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
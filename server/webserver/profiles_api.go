@@ -0,0 +1,237 @@
+package webserver
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/server/db/agents"
+	"github.com/TLop503/LogCrunch/server/profiles"
+	"github.com/go-chi/chi/v5"
+)
+
+// serveProfilesPage lists the config profiles, who they are assigned to,
+// and which agents run them
+func serveProfilesPage(agentDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderProfilesPage(w, agentDB, "")
+	}
+}
+
+// handleProfileEditForm renders a form to edit the profile named in the
+// query string, or to add one if no name is given
+func handleProfileEditForm(agentDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := ProfileEditData{New: true, Profile: agents.Profile{Config: "Targets:\nServices:\n"}}
+		if name := r.URL.Query().Get("name"); name != "" {
+			p, err := agents.GetProfile(agentDB, name)
+			if errors.Is(err, agents.ErrProfileNotFound) {
+				http.Error(w, "Profile not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				log.Printf("Error looking up profile %s: %v", name, err)
+				http.Error(w, "Failed to look up profile", http.StatusInternalServerError)
+				return
+			}
+			data = ProfileEditData{Profile: p}
+		}
+		renderProfileEditForm(w, data)
+	}
+}
+
+// handleProfileSave checks and saves a submitted profile, then sends it to
+// the agents running it. Invalid profiles are shown again with what is wrong.
+func handleProfileSave(agentDB *sql.DB, dist *profiles.Distributor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSpace(r.FormValue("name"))
+		config := strings.ReplaceAll(r.FormValue("config"), "\r\n", "\n")
+		isNew := r.FormValue("new") != ""
+
+		if err := checkProfile(name, config); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			renderProfileEditForm(w, ProfileEditData{Profile: agents.Profile{Name: name, Config: config}, New: isNew, Error: err.Error()})
+			return
+		}
+		p, err := agents.SaveProfile(agentDB, name, config)
+		if err != nil {
+			log.Printf("Error saving profile %s: %v", name, err)
+			http.Error(w, "Failed to save profile", http.StatusInternalServerError)
+			return
+		}
+		go dist.Refresh()
+
+		notice := fmt.Sprintf("Saved profile %s, sending it to the agents it is assigned to", p.Protocol().Label())
+		log.Println(notice)
+		renderProfilesPage(w, agentDB, notice)
+	}
+}
+
+// checkProfile catches the mistakes that would have every agent reject a
+// profile. Agents check the rest, and report what they reject.
+func checkProfile(name, config string) error {
+	if name == "" {
+		return errors.New("profile needs a name")
+	}
+	cfg, err := protocol.Profile{Name: name, Config: config}.Parse()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, t := range cfg.Targets {
+		if t.Name == "" || t.Path == "" {
+			return fmt.Errorf("every target needs a name and a path")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		names[t.Name] = true
+	}
+	for _, svc := range cfg.Services {
+		if svc.Key == "" {
+			return fmt.Errorf("service %q has no key", svc.Name)
+		}
+	}
+	return nil
+}
+
+// handleProfileDelete deletes a profile. Its agents go back to their own configs.
+func handleProfileDelete(agentDB *sql.DB, dist *profiles.Distributor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		if err := agents.DeleteProfile(agentDB, name); errors.Is(err, agents.ErrProfileNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error deleting profile %s: %v", name, err)
+			http.Error(w, "Failed to delete profile", http.StatusInternalServerError)
+			return
+		}
+		go dist.Refresh()
+
+		notice := fmt.Sprintf("Deleted profile %s", name)
+		log.Println(notice)
+		renderProfilesPage(w, agentDB, notice)
+	}
+}
+
+// handleProfileAssign assigns a profile to an agent ID, alias or tag, or
+// removes the assignment if the profile is empty
+func handleProfileAssign(agentDB *sql.DB, dist *profiles.Distributor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := agents.Assignment{
+			Kind:    r.FormValue("kind"),
+			Value:   strings.TrimSpace(r.FormValue("value")),
+			Profile: r.FormValue("profile"),
+		}
+
+		var notice string
+		if a.Profile == "" {
+			if err := agents.Unassign(agentDB, a.Kind, a.Value); err != nil {
+				log.Printf("Error removing assignment: %v", err)
+				http.Error(w, "Failed to remove assignment", http.StatusInternalServerError)
+				return
+			}
+			notice = fmt.Sprintf("Removed the profile of %s %s", a.Kind, a.Value)
+		} else {
+			if err := agents.Assign(agentDB, a); err != nil {
+				renderProfilesPage(w, agentDB, fmt.Sprintf("Profile %s was not assigned: %v", a.Profile, err))
+				return
+			}
+			notice = fmt.Sprintf("Assigned profile %s to %s %s", a.Profile, a.Kind, a.Value)
+		}
+		go dist.Refresh()
+
+		log.Println(notice)
+		renderProfilesPage(w, agentDB, notice)
+	}
+}
+
+// handleAgentTags replaces an agent's tags, given comma separated
+func handleAgentTags(agentDB *sql.DB, dist *profiles.Distributor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := chi.URLParam(r, "id")
+		var tags []string
+		for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+
+		err := agents.SetTags(agentDB, id, tags)
+		if errors.Is(err, agents.ErrNotFound) {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Error setting tags of agent %s: %v", id, err)
+			http.Error(w, "Failed to save tags", http.StatusInternalServerError)
+			return
+		}
+		go dist.Refresh()
+
+		http.Redirect(w, r, "/agents/"+id, http.StatusSeeOther)
+	}
+}
+
+// renderProfilesPage renders the profiles page, with notice saying what was just done
+func renderProfilesPage(w http.ResponseWriter, agentDB *sql.DB, notice string) {
+	list, err := agents.ListProfiles(agentDB)
+	if err != nil {
+		log.Printf("Error listing profiles: %v", err)
+		http.Error(w, "Failed to list profiles", http.StatusInternalServerError)
+		return
+	}
+	assignments, err := agents.ListAssignments(agentDB)
+	if err != nil {
+		log.Printf("Error listing assignments: %v", err)
+		http.Error(w, "Failed to list assignments", http.StatusInternalServerError)
+		return
+	}
+	inventory, err := agents.List(agentDB)
+	if err != nil {
+		log.Printf("Error listing agents: %v", err)
+		http.Error(w, "Failed to list agents", http.StatusInternalServerError)
+		return
+	}
+
+	data := ProfilesPageData{Notice: notice}
+	rows := make(map[string]*ProfileRow)
+	for _, p := range list {
+		data.Profiles = append(data.Profiles, ProfileRow{Profile: p})
+	}
+	for i := range data.Profiles {
+		rows[data.Profiles[i].Name] = &data.Profiles[i]
+	}
+	for _, a := range assignments {
+		if row, ok := rows[a.Profile]; ok {
+			row.Assignments = append(row.Assignments, a)
+		}
+	}
+	for _, agent := range inventory {
+		via, ok := agents.Match(assignments, agent)
+		if !ok {
+			continue
+		}
+		if row, ok := rows[via.Profile]; ok {
+			row.Agents = append(row.Agents, ProfileAgent{Agent: agent, Via: via, UpToDate: agent.ConfigVersion == row.Protocol().Label()})
+		}
+	}
+
+	if err := templates.ExecuteTemplate(w, "profiles", data); err != nil {
+		log.Printf("template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// renderProfileEditForm renders the profile edit form
+func renderProfileEditForm(w http.ResponseWriter, data ProfileEditData) {
+	if err := templates.ExecuteTemplate(w, "profile-edit", data); err != nil {
+		log.Printf("template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -4,12 +4,20 @@ import (
 	"database/sql"
 	"embed"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"io/fs"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/server/ingest"
+	"github.com/TLop503/LogCrunch/server/parser"
+	"github.com/TLop503/LogCrunch/server/pki"
+	"github.com/TLop503/LogCrunch/server/profiles"
 	"github.com/TLop503/LogCrunch/structs"
 	"github.com/go-chi/chi/v5"
 )
@@ -41,10 +49,35 @@ func helperFuncMap() template.FuncMap {
 			loc, _ := time.LoadLocation("Local")
 			return time.Unix(ts, 0).In(loc).Format("01-02 15:04:05")
 		},
+		"formatDuration": func(d time.Duration) string {
+			switch {
+			case d%(24*time.Hour) == 0:
+				return fmt.Sprintf("%dd", d/(24*time.Hour))
+			case d%time.Hour == 0:
+				return fmt.Sprintf("%dh", d/time.Hour)
+			}
+			return d.String()
+		},
 		"formatGoTime": func(t time.Time) string {
 			loc, _ := time.LoadLocation("Local")
 			return t.In(loc).Format("2006-01-02 15:04:05")
 		},
+		"join": strings.Join,
+		"formatBytes": func(n int64) string {
+			const unit = 1024
+			if n < unit {
+				return fmt.Sprintf("%d B", n)
+			}
+			div, exp := int64(unit), 0
+			for m := n / unit; m >= unit; m /= unit {
+				div *= unit
+				exp++
+			}
+			return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+		},
+		"formatSeconds": func(s int64) string {
+			return (time.Duration(s) * time.Second).String()
+		},
 		"toJSON": func(v interface{}) string {
 			b, err := json.Marshal(v)
 			if err != nil {
@@ -56,7 +89,7 @@ func helperFuncMap() template.FuncMap {
 }
 
 // setupRoutes configures all application routes
-func setupRoutes(r *chi.Mux, connList *structs.ConnectionList, logDb *sql.DB, userDb *sql.DB) {
+func setupRoutes(r *chi.Mux, connList *structs.ConnectionList, logDb *sql.DB, userDb *sql.DB, enrollDb *sql.DB, agentDb *sql.DB, pipe *ingest.Pipeline, logParser *parser.Parser, dist *profiles.Distributor, ca *pki.CA) {
 	// Middleware
 	// r.Use(middleware.Logger) // uncomment for debugging
 
@@ -70,6 +103,7 @@ func setupRoutes(r *chi.Mux, connList *structs.ConnectionList, logDb *sql.DB, us
 	// Public routes (no auth required)
 	r.Get("/login", serveLoginPage())
 	r.Post("/api/auth/login", handleLogin(userDb))
+	r.Post(protocol.EnrollPath, handleEnroll(enrollDb, ca)) // agents authenticate with a one-time token
 
 	// Password change routes (auth required but allows password change pending)
 	r.Group(func(r chi.Router) {
@@ -84,13 +118,31 @@ func setupRoutes(r *chi.Mux, connList *structs.ConnectionList, logDb *sql.DB, us
 
 		// Pages
 		r.Get("/", servePage("index", nil))
-		r.Get("/connections", serveConnectionsPage(connList))
+		r.Get("/connections", serveConnectionsPage(connList, agentDb, logDb, pipe))
+		r.Get("/agents/{id}", serveAgentPage(connList, agentDb, logDb))
 		r.Get("/logs", serveLogPage(logDb))
 		r.Get("/query", serveQueryPage(logDb))
+		r.Post("/query", serveQueryPage(logDb))
+		r.Get("/enrollment", serveEnrollmentPage(enrollDb, ca))
+		r.Get("/dead-letters", serveDeadLettersPage(logDb))
+		r.Get("/modules", serveModulesPage(logDb, logParser))
+		r.Get("/profiles", serveProfilesPage(agentDb))
 
 		// API endpoints
-		r.Post("/alias", handleAliasSet(connList))
-		r.Get("/alias/edit", handleAliasEditForm(connList, templates))
+		r.Post("/alias", handleAliasSet(agentDb, dist))
+		r.Get("/alias/edit", handleAliasEditForm(agentDb, templates))
+		r.Post("/enrollment/token", handleTokenCreate(enrollDb, ca))
+		r.Post("/enrollment/{id}/{action}", handleEnrollmentStatus(enrollDb, connList))
+		r.Post("/dead-letters/{id}/{action}", handleDeadLetterAction(logDb, pipe))
+		r.Get("/api/ingest", handleIngestStats(pipe))
+		r.Get("/modules/edit", handleModuleEditForm(logDb))
+		r.Post("/modules", handleModuleSave(logDb, logParser))
+		r.Post("/modules/{name}/reparse", handleModuleReparse(logDb, logParser))
+		r.Get("/profiles/edit", handleProfileEditForm(agentDb))
+		r.Post("/profiles", handleProfileSave(agentDb, dist))
+		r.Post("/profiles/assign", handleProfileAssign(agentDb, dist))
+		r.Post("/profiles/{name}/delete", handleProfileDelete(agentDb, dist))
+		r.Post("/agents/{id}/tags", handleAgentTags(agentDb, dist))
 
 		// Auth API endpoints (require existing session)
 		r.Post("/api/auth/logout", handleLogout(userDb))
@@ -98,8 +150,10 @@ func setupRoutes(r *chi.Mux, connList *structs.ConnectionList, logDb *sql.DB, us
 	})
 }
 
-// StartRouter starts the webserver on the specified address
-func StartRouter(addr string, connList *structs.ConnectionList, logDb *sql.DB, userDb *sql.DB) {
+// StartRouter starts the webserver on the specified address.
+// ca signs enrolling agents' certificates; with a nil ca enrollment is off.
+// The returned server can be shut down with Shutdown.
+func StartRouter(addr string, connList *structs.ConnectionList, logDb *sql.DB, userDb *sql.DB, enrollDb *sql.DB, agentDb *sql.DB, pipe *ingest.Pipeline, logParser *parser.Parser, dist *profiles.Distributor, ca *pki.CA) *http.Server {
 	// Initialize templates
 	if err := initTemplates(); err != nil {
 		log.Fatalf("error parsing embedded templates: %v", err)
@@ -107,13 +161,15 @@ func StartRouter(addr string, connList *structs.ConnectionList, logDb *sql.DB, u
 
 	// Setup router
 	r := chi.NewRouter()
-	setupRoutes(r, connList, logDb, userDb)
+	setupRoutes(r, connList, logDb, userDb, enrollDb, agentDb, pipe, logParser, dist, ca)
 
 	// Start server
 	log.Printf("Starting webserver at %s\n", addr)
+	srv := &http.Server{Addr: addr, Handler: r}
 	go func() {
-		if err := http.ListenAndServe(addr, r); err != nil {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("server error: %v", err)
 		}
 	}()
+	return srv
 }
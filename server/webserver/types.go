@@ -1,6 +1,16 @@
 package webserver
 
-import "time"
+import (
+	"time"
+
+	"github.com/TLop503/LogCrunch/protocol"
+	"github.com/TLop503/LogCrunch/server/db/agents"
+	"github.com/TLop503/LogCrunch/server/db/enroll"
+	logdb "github.com/TLop503/LogCrunch/server/db/logs"
+	"github.com/TLop503/LogCrunch/server/ingest"
+	"github.com/TLop503/LogCrunch/server/parser"
+	"github.com/TLop503/LogCrunch/structs"
+)
 
 const (
 	sessionCookieName = "logcrunch_session"
@@ -25,3 +35,114 @@ type APIResponse struct {
 	Message string `json:"message,omitempty"`
 	Error   string `json:"error,omitempty"`
 }
+
+// QueryPageData holds the results and filter state rendered by the query page
+type QueryPageData struct {
+	Logs        []structs.Log
+	Query       string
+	MinSeverity structs.Severity
+	Severities  []structs.Severity
+}
+
+// EnrollmentPageData holds enrolled agents, open tokens, and a token that was just created
+type EnrollmentPageData struct {
+	Enabled       bool
+	CAFingerprint string
+	NewToken      string
+	TTLs          []time.Duration
+	Tokens        []enroll.Token
+	Enrollments   []enroll.Enrollment
+}
+
+// AgentRow is an agent from the inventory, with live stats if it is connected
+type AgentRow struct {
+	agents.Agent
+	Online           bool
+	Compression      string
+	CompressionRatio float64
+}
+
+// ConnectionsPageData holds every known agent, what the watchdog noticed
+// recently, and how busy ingestion is
+type ConnectionsPageData struct {
+	Agents []AgentRow
+	Events []logdb.Event
+	Ingest ingest.Stats
+}
+
+// DeadLettersPageData holds the newest dead letters, how many there are, and
+// what was just done to one
+type DeadLettersPageData struct {
+	Letters []logdb.DeadLetter
+	Total   int
+	Notice  string
+}
+
+// AgentPageData holds one agent's details, telemetry, and events
+type AgentPageData struct {
+	Agent   agents.Agent
+	Online  bool
+	Window  time.Duration
+	Latest  *agents.Telemetry // nil until the agent sends a heartbeat with telemetry
+	Targets []TargetRow
+	History []agents.Telemetry // newest first
+	Events  []logdb.Event
+	Profile *agents.Profile   // the profile the agent should run, nil if none is assigned
+	Via     agents.Assignment // the assignment that gave it
+}
+
+// TargetRow is one target's counters from the latest heartbeat, plus what
+// it read and failed to parse within the page's window
+type TargetRow struct {
+	Name string
+	protocol.TargetStats
+	RecentRead   uint64
+	RecentFailed uint64
+	LastErrorAt  time.Time
+}
+
+// ModulesPageData holds the parser modules and what was just done to one
+type ModulesPageData struct {
+	Modules []ModuleRow
+	Notice  string
+}
+
+// ModuleRow is a parser module and its latest re-parse, if it had one
+type ModuleRow struct {
+	logdb.DBModule
+	Reparse *parser.Progress
+}
+
+// ModuleEditData holds a module being edited, and why saving it failed
+type ModuleEditData struct {
+	Module logdb.DBModule
+	New    bool
+	Error  string
+}
+
+// ProfilesPageData holds the config profiles and what was just done to one
+type ProfilesPageData struct {
+	Profiles []ProfileRow
+	Notice   string
+}
+
+// ProfileRow is a profile, what it is assigned to, and the agents it applies to
+type ProfileRow struct {
+	agents.Profile
+	Assignments []agents.Assignment
+	Agents      []ProfileAgent
+}
+
+// ProfileAgent is an agent a profile applies to, and whether it runs the latest version
+type ProfileAgent struct {
+	agents.Agent
+	Via      agents.Assignment
+	UpToDate bool
+}
+
+// ProfileEditData holds a profile being edited, and why saving it failed
+type ProfileEditData struct {
+	Profile agents.Profile
+	New     bool
+	Error   string
+}
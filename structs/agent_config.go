@@ -1,30 +1,161 @@
 package structs
 
-import "regexp"
+import (
+	"regexp"
+	"time"
+)
 
 type IntakeLogFileData struct {
 	FileContent string `json:"fileContent"`
 }
 
 type Target struct {
-	Name     string            `yaml:"name"`
-	Path     string            `yaml:"path"`
-	Severity string            `yaml:"severity"`
-	Custom   bool              `yaml:"custom"`
-	Module   string            `yaml:"module,omitempty"`
-	Regex    string            `yaml:"regex,omitempty"`
-	Schema   map[string]string `yaml:"schema,omitempty"`
+	Name      string            `yaml:"name"`
+	Path      string            `yaml:"path"`
+	Severity  string            `yaml:"severity"`
+	Custom    bool              `yaml:"custom"`
+	Module    string            `yaml:"module,omitempty"`
+	Regex     string            `yaml:"regex,omitempty"`
+	Schema    map[string]string `yaml:"schema,omitempty"`
+	Multiline *MultilineConfig  `yaml:"multiline,omitempty"`
+	Timestamp *TimestampConfig  `yaml:"timestamp,omitempty"`
+	// ServerParse sends lines unparsed, tagged with Module, for the server to
+	// parse with its own definition of the module
+	ServerParse bool `yaml:"server_parse,omitempty"`
+	// Exclude drops files matched by a glob or directory Path.
+	// Patterns without a slash match the file name only.
+	Exclude []string `yaml:"exclude,omitempty"`
+	// IncludeRotated also reads files a glob or directory Path matches that
+	// are named like rotated logs (app.log.1, app.log-20260102). Compressed
+	// files are never read.
+	IncludeRotated bool `yaml:"include_rotated,omitempty"`
+	// Filters decide which logs are sent, see FilterRule
+	Filters []FilterRule `yaml:"filters,omitempty"`
+	// Redact masks secrets before logs leave the host, after the global Redact rules
+	Redact []RedactRule `yaml:"redact,omitempty"`
+	// ExpectEvery is how often the target should produce a log. The server
+	// raises an event when it goes quiet for longer. Zero never flags it.
+	ExpectEvery time.Duration `yaml:"expect_every,omitempty"`
+}
+
+// MultilineConfig groups consecutive lines into a single event, e.g. stack traces.
+// A line matching Start always begins a new event, and a line matching Continue
+// is appended to the current one. With only Start set, every other line is appended.
+// Events are flushed after MaxLines lines or once Timeout passes without a new line.
+type MultilineConfig struct {
+	Start    string        `yaml:"start,omitempty"`
+	Continue string        `yaml:"continue,omitempty"`
+	MaxLines int           `yaml:"max_lines,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+}
+
+// TimestampConfig takes a log's event time from a parsed field instead of the time it was read.
+// Layouts are tried in order; each is syslog, apache, rfc3339, epoch, or a Go time layout.
+// Timezone (an IANA name) applies to layouts without a zone and defaults to the agent's.
+// Syslog times have no year, so the current one is used unless that lands in the future.
+type TimestampConfig struct {
+	Field    string   `yaml:"field"`
+	Layouts  []string `yaml:"layouts"`
+	Timezone string   `yaml:"timezone,omitempty"`
 }
 
 type Service struct {
-	Name     string `yaml:"name"`
-	Key      string `yaml:"key"`
-	Severity string `yaml:"severity"`
+	Name        string        `yaml:"name"`
+	Key         string        `yaml:"key"`
+	Severity    string        `yaml:"severity"`
+	Filters     []FilterRule  `yaml:"filters,omitempty"`
+	Redact      []RedactRule  `yaml:"redact,omitempty"`
+	ExpectEvery time.Duration `yaml:"expect_every,omitempty"` // see Target.ExpectEvery
+}
+
+// FilterRule keeps or drops the logs it matches. Rules are checked in order and the
+// first match decides; logs no rule matches are kept. A rule matches when all of its
+// conditions hold: Raw against the raw line, each Fields regex against that parsed
+// field, and the log's severity within MinSeverity..MaxSeverity. A rule with no
+// conditions matches every log, so {action: drop} last means "drop everything else".
+type FilterRule struct {
+	Action      string            `yaml:"action"` // drop or keep
+	Raw         string            `yaml:"raw,omitempty"`
+	Fields      map[string]string `yaml:"fields,omitempty"`
+	MinSeverity string            `yaml:"min_severity,omitempty"`
+	MaxSeverity string            `yaml:"max_severity,omitempty"`
+}
+
+// RedactRule masks secrets in a log's raw line and parsed fields before it is sent.
+// Pattern (or a built-in Preset) picks what to mask; if it has a group named "secret"
+// only that group is masked. Fields limits the rule to those parsed fields, and their
+// old values are masked in the raw line too; a rule with Fields and no pattern masks
+// the whole field values. Action is "replace" (with Replacement, default [REDACTED]),
+// "hash" (salted HMAC-SHA256, so equal secrets can still be correlated), or "truncate"
+// (keep the first Length characters).
+type RedactRule struct {
+	Preset      string   `yaml:"preset,omitempty"`
+	Pattern     string   `yaml:"pattern,omitempty"`
+	Fields      []string `yaml:"fields,omitempty"`
+	Action      string   `yaml:"action,omitempty"`
+	Replacement string   `yaml:"replacement,omitempty"`
+	Salt        string   `yaml:"salt,omitempty"`
+	Length      int      `yaml:"length,omitempty"`
+}
+
+// SpoolConfig controls the on-disk queue that holds logs until they are sent.
+// Policy is either "drop-oldest" or "drop-newest".
+type SpoolConfig struct {
+	Dir      string `yaml:"dir"`
+	MaxBytes int64  `yaml:"max_bytes"`
+	Policy   string `yaml:"policy"`
+}
+
+// ReconnectConfig bounds the exponential backoff used when redialing the server
+type ReconnectConfig struct {
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// TransportConfig controls the connection to the server.
+// Compression lists the codecs to offer, preferred first: zstd, gzip or none.
+// Legacy falls back to plain JSON when the server doesn't answer the handshake,
+// for servers from before it; otherwise the agent reconnects and tries again.
+type TransportConfig struct {
+	Compression []string `yaml:"compression"`
+	Legacy      bool     `yaml:"legacy"`
+}
+
+// TLSConfig controls how the agent verifies the server and proves who it is.
+// CABundle is a PEM file of CAs to trust instead of the system ones, and
+// PinnedSHA256 lists SHA-256 fingerprints of server certificates to accept.
+// Cert and Key are the agent's client certificate, for servers requiring mTLS.
+type TLSConfig struct {
+	CABundle     string   `yaml:"ca_bundle"`
+	PinnedSHA256 []string `yaml:"pinned_sha256"`
+	Cert         string   `yaml:"cert"`
+	Key          string   `yaml:"key"`
+	ServerName   string   `yaml:"server_name"` // name to verify the server certificate against, defaults to the host
+}
+
+// CheckpointConfig controls where read offsets are kept and how often they are flushed
+type CheckpointConfig struct {
+	Dir      string        `yaml:"dir"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// JournalConfig controls the systemd journal listener.
+// Start is "head" or "tail" and only matters when there is no saved cursor.
+type JournalConfig struct {
+	Start string `yaml:"start"`
 }
 
 type YamlConfig struct {
-	Targets  []Target  `yaml:"Targets"`
-	Services []Service `yaml:"Services"`
+	Targets     []Target         `yaml:"Targets"`
+	Services    []Service        `yaml:"Services"`
+	Spool       SpoolConfig      `yaml:"Spool,omitempty"`
+	Reconnect   ReconnectConfig  `yaml:"Reconnect,omitempty"`
+	Transport   TransportConfig  `yaml:"Transport,omitempty"`
+	TLS         TLSConfig        `yaml:"TLS,omitempty"`
+	Checkpoints CheckpointConfig `yaml:"Checkpoints,omitempty"`
+	Journal     JournalConfig    `yaml:"Journal,omitempty"`
+	// Redact rules apply to every target and service
+	Redact []RedactRule `yaml:"Redact,omitempty"`
 }
 
 type ParserModule struct {
@@ -2,18 +2,49 @@ package structs
 
 import (
 	"log"
-	"net"
 	"sync"
 	"time"
 )
 
 type Connection struct {
 	sync.Mutex
+	ID         string // the agent's persistent ID, or its IP for agents that predate the hello
 	RemoteAddr string
 	FirstSeen  time.Time
 	LastSeen   time.Time
 	Hostname   string
-	Alias      string
+	Identity   string // name on the agent's client certificate, if the server requires them
+	Serial     string // serial number of that certificate
+	Open       int    // connections currently open from the agent
+
+	disconnect func()
+
+	// what the agent said about itself in its hello
+	AgentVersion    string
+	OS              string
+	Kernel          string
+	Targets         []string
+	Capabilities    []string
+	ProtocolVersion int
+
+	// stream compression negotiated with the agent, and bytes received before/after decompression
+	Compression string
+	RawBytes    int64
+	WireBytes   int64
+}
+
+// CompressionRatio is how many bytes of logs each byte on the wire carried
+func (c *Connection) CompressionRatio() float64 {
+	if c.WireBytes == 0 {
+		return 0
+	}
+	return float64(c.RawBytes) / float64(c.WireBytes)
+}
+
+// SetDisconnect registers how to close the agent's current connection.
+// Caller must hold c's lock.
+func (c *Connection) SetDisconnect(fn func()) {
+	c.disconnect = fn
 }
 
 type ConnectionList struct {
@@ -28,37 +59,55 @@ func NewConnList() *ConnectionList {
 	}
 }
 
-// Add new host to list, w/ smart deduplication.
-// duplicate connections are reconciled into a single entry in the connection list
-func (ct *ConnectionList) AddToConnList(conn net.Conn) {
-	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-	if err != nil {
-		log.Println("Invalid remote address:", conn.RemoteAddr())
-		return
-	}
-
+// Add an agent to the list, w/ smart deduplication.
+// Reconnects from the same agent are reconciled into a single entry, keyed by
+// its ID, even if it comes back from a different address.
+func (ct *ConnectionList) AddToConnList(id, remoteAddr string) *Connection {
 	ct.Lock()
 	defer ct.Unlock()
 
-	if existing, exists := ct.Connections[host]; exists {
+	if existing, exists := ct.Connections[id]; exists {
 		// Update metadata if already exists
 		existing.Lock()
+		existing.RemoteAddr = remoteAddr
 		existing.LastSeen = time.Now()
 		existing.Unlock()
-	} else {
-		// Create a new entry
-		ct.Connections[host] = &Connection{
-			RemoteAddr: host,
-			FirstSeen:  time.Now(),
-			LastSeen:   time.Now(),
-		}
+		return existing
 	}
 
+	// Create a new entry
+	conn := &Connection{
+		ID:         id,
+		RemoteAddr: remoteAddr,
+		FirstSeen:  time.Now(),
+		LastSeen:   time.Now(),
+	}
+	ct.Connections[id] = conn
+	return conn
+}
+
+// DisconnectSerial closes every connection from an agent whose certificate
+// has the given serial, and returns how many were closed
+func (ct *ConnectionList) DisconnectSerial(serial string) int {
+	ct.RLock()
+	defer ct.RUnlock()
+
+	closed := 0
+	for _, conn := range ct.Connections {
+		conn.Lock()
+		if conn.Serial == serial && conn.disconnect != nil {
+			conn.disconnect()
+			conn.disconnect = nil
+			closed++
+		}
+		conn.Unlock()
+	}
+	return closed
 }
 
 func (ct *ConnectionList) print() {
 	log.Println("Active connections:")
 	for _, conn := range ct.Connections {
-		log.Printf("- %s / First seen: %s / Last Seen: %s\n", conn.RemoteAddr, conn.FirstSeen, conn.LastSeen)
+		log.Printf("- %s (%s) / First seen: %s / Last Seen: %s\n", conn.ID, conn.RemoteAddr, conn.FirstSeen, conn.LastSeen)
 	}
 }
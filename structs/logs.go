@@ -1,13 +1,17 @@
 package structs
 
 type Log struct {
-	Name      string      `json:"name"`
-	Path      string      `json:"path"`
-	Host      string      `json:"host"`
-	Timestamp int64       `json:"timestamp"`
-	Module    string      `json:"type"`
-	Parsed    interface{} `json:"parsed"`
-	Raw       string      `json:"raw"`
+	ID         string      `json:"id,omitempty"` // assigned once by the agent, so resent logs can be recognised
+	Name       string      `json:"name"`
+	Path       string      `json:"path"`
+	Host       string      `json:"host"`
+	Timestamp  int64       `json:"timestamp"`
+	Module     string      `json:"type"`
+	Parsed     interface{} `json:"parsed"`
+	Raw        string      `json:"raw"`
+	Severity   Severity    `json:"severity,omitempty"`
+	IngestTime int64       `json:"ingest_time,omitempty"` // when the agent read it; Timestamp is when it was logged
+	RawOnly    bool        `json:"raw_only,omitempty"`    // left for the server to parse with Module
 }
 
 type SyslogEntry struct {
@@ -1,8 +1,10 @@
 package structs
 
 import (
+	"fmt"
 	"reflect"
 	"regexp"
+	"strconv"
 )
 
 // MetaParserRegistry maps module names to their regex and struct constructors
@@ -61,3 +63,56 @@ func ReflectSchema(s interface{}) map[string]string {
 
 	return schema
 }
+
+// Parse matches a line against the module's regex and returns the named
+// groups, converted to the types in the schema. The agent parses with it, and
+// so does the server for logs agents leave to it.
+func (m ParserModule) Parse(line string) (map[string]interface{}, error) {
+	match := m.Regex.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("no match found")
+	}
+
+	names := m.Regex.SubexpNames()
+	if len(names) != len(match) {
+		return nil, fmt.Errorf("capture group count mismatch")
+	}
+
+	parsedLog := make(map[string]interface{})
+
+	for i, name := range names {
+		if i == 0 || name == "" {
+			continue // skip full match or unnamed groups
+		}
+
+		// Determine type from schema
+		fieldType, ok := m.Schema[name]
+		if !ok {
+			// if the schema doesn't include this field, just store as string
+			parsedLog[name] = match[i]
+			continue
+		}
+
+		// attempt parse numbers to correct type
+		// if conversion fails, assign as strings instead
+		switch fieldType {
+		case "int":
+			if val, err := strconv.Atoi(match[i]); err == nil {
+				parsedLog[name] = val
+			} else {
+				parsedLog[name] = match[i]
+			}
+		case "float":
+			if val, err := strconv.ParseFloat(match[i], 64); err == nil {
+				parsedLog[name] = val
+			} else {
+				parsedLog[name] = match[i]
+			}
+		default:
+			// if not parsed to number just use string
+			parsedLog[name] = match[i]
+		}
+	}
+
+	return parsedLog, nil
+}
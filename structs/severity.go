@@ -0,0 +1,108 @@
+package structs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Severity is the normalized importance of a log, stored as an integer so it
+// can be indexed and compared. The zero value means no severity is known.
+type Severity int
+
+const (
+	SeverityUnknown Severity = iota
+	SeverityDebug
+	SeverityInfo
+	SeverityNotice
+	SeverityWarning
+	SeverityError
+	SeverityCritical
+)
+
+var severityNames = map[Severity]string{
+	SeverityUnknown:  "unknown",
+	SeverityDebug:    "debug",
+	SeverityInfo:     "info",
+	SeverityNotice:   "notice",
+	SeverityWarning:  "warning",
+	SeverityError:    "error",
+	SeverityCritical: "critical",
+}
+
+// severityAliases maps the names people put in configs and logs onto the scale.
+// low/medium/high are what older configs used.
+var severityAliases = map[string]Severity{
+	"debug":    SeverityDebug,
+	"trace":    SeverityDebug,
+	"info":     SeverityInfo,
+	"low":      SeverityInfo,
+	"notice":   SeverityNotice,
+	"warning":  SeverityWarning,
+	"warn":     SeverityWarning,
+	"medium":   SeverityWarning,
+	"error":    SeverityError,
+	"err":      SeverityError,
+	"high":     SeverityError,
+	"critical": SeverityCritical,
+	"crit":     SeverityCritical,
+	"alert":    SeverityCritical,
+	"emerg":    SeverityCritical,
+	"fatal":    SeverityCritical,
+	"panic":    SeverityCritical,
+}
+
+// Severities lists every known severity from least to most severe
+var Severities = []Severity{
+	SeverityDebug,
+	SeverityInfo,
+	SeverityNotice,
+	SeverityWarning,
+	SeverityError,
+	SeverityCritical,
+}
+
+// String returns the severity's name
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseSeverity reads a severity name (case insensitive) or a syslog level number 0-7.
+// An empty string gives SeverityUnknown.
+func ParseSeverity(s string) (Severity, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return SeverityUnknown, nil
+	}
+	if sev, ok := severityAliases[s]; ok {
+		return sev, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 7 {
+		return SeverityFromSyslog(n), nil
+	}
+	return SeverityUnknown, fmt.Errorf("unknown severity %q", s)
+}
+
+// SeverityFromSyslog maps a syslog level (journal PRIORITY) onto the scale.
+// emerg, alert and crit all become critical.
+func SeverityFromSyslog(level int) Severity {
+	switch {
+	case level < 0 || level > 7:
+		return SeverityUnknown
+	case level <= 2:
+		return SeverityCritical
+	case level == 3:
+		return SeverityError
+	case level == 4:
+		return SeverityWarning
+	case level == 5:
+		return SeverityNotice
+	case level == 6:
+		return SeverityInfo
+	default:
+		return SeverityDebug
+	}
+}